@@ -0,0 +1,9 @@
+package main
+
+import (
+	ozlandlock "github.com/subgraph/oz/oz-landlock"
+)
+
+func main() {
+	ozlandlock.Main()
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -63,7 +65,7 @@ func main() {
 				},
 				{
 					Name:   "show",
-					Usage:  "prints ouf oz configuration",
+					Usage:  "prints ouf oz configuration, or where each setting of a profile came from",
 					Action: handleConfigshow,
 				},
 			},
@@ -106,6 +108,18 @@ func handleConfigcheck(c *cli.Context) {
 	}
 
 	OzConfig = loadConfig()
+	pes, err := oz.ValidateProfiles(OzConfig.ProfileDir, OzConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read profiles from `%s`: %v\n", OzConfig.ProfileDir, err)
+		os.Exit(1)
+	}
+	for _, pe := range pes {
+		fmt.Fprintln(os.Stderr, pe)
+	}
+	if pes.HasErrors() {
+		os.Exit(1)
+	}
+
 	_, err = oz.LoadProfiles(OzConfig.ProfileDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to load profiles from `%s`: %v\n", OzConfig.ProfileDir, err)
@@ -117,6 +131,11 @@ func handleConfigcheck(c *cli.Context) {
 }
 
 func handleConfigshow(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		showProfileOrigins(c.Args()[0])
+		os.Exit(0)
+	}
+
 	config, err := oz.LoadConfig(oz.DefaultConfigPath)
 	useDefaults := false
 	if err != nil {
@@ -175,6 +194,67 @@ func handleConfigshow(c *cli.Context) {
 	os.Exit(0)
 }
 
+func showProfileOrigins(pname string) {
+	OzConfig = loadConfig()
+	p, err := loadProfile(pname, OzConfig.ProfileDir)
+	if err != nil || p == nil {
+		fmt.Fprintf(os.Stderr, "Unable to load profile `%s`: %v\n", pname, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Profile %s (%s)\n", p.Name, p.ProfilePath)
+	fmt.Println("Resolved from:")
+	for i, f := range p.Chain {
+		fmt.Printf("  %d) %s\n", i+1, f)
+	}
+	fmt.Println("")
+
+	jdata, err := json.Marshal(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to marshal profile: %v\n", err)
+		os.Exit(1)
+	}
+	effective := make(map[string]interface{})
+	if err := json.Unmarshal(jdata, &effective); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to unmarshal profile: %v\n", err)
+		os.Exit(1)
+	}
+
+	keys := []string{}
+	maxKeyLength := 0
+	for k := range p.Origins {
+		keys = append(keys, k)
+		if len(k) > maxKeyLength {
+			maxKeyLength = len(k)
+		}
+	}
+	sort.Strings(keys)
+	sfmt := "%-" + strconv.Itoa(maxKeyLength) + "s: %v # %s\n"
+	for _, k := range keys {
+		fmt.Printf(sfmt, k, lookupSetting(effective, k), strings.Join(p.Origins[k], ", "))
+	}
+}
+
+// lookupSetting returns the value at the dotted path key, matching
+// field names without regard to case like encoding/json does
+func lookupSetting(m map[string]interface{}, key string) interface{} {
+	var v interface{} = m
+	for _, part := range strings.Split(key, ".") {
+		mv, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = nil
+		for k, kv := range mv {
+			if strings.EqualFold(k, part) {
+				v = kv
+				break
+			}
+		}
+	}
+	return v
+}
+
 func handleInstall(c *cli.Context) {
 	OzConfig = loadConfig()
 	pname := c.Args()[0]
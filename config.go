@@ -13,6 +13,13 @@ type Config struct {
 	PrefixPath       string   `json:"prefix_path" desc:"Prefix path containing the oz executables"`
 	EtcPrefix        string   `json:"etc_prefix" desc:"Prefix for configuration files"`
 	SandboxPath      string   `json:"sandbox_path" desc:"Path of the sandboxes base"`
+	StatePath        string   `json:"state_path" desc:"Directory where the state of running sandboxes is kept"`
+	PolicyPath       string   `json:"policy_path" desc:"Path of the policy file controlling who may use the daemon"`
+	CgroupPath       string   `json:"cgroup_path" desc:"Cgroup v2 directory under which a cgroup is created for each sandbox"`
+	LogPath          string   `json:"log_path" desc:"Directory under which each profile has a log directory for its sandboxes"`
+	LogMaxSize       string   `json:"log_max_size" desc:"Size at which the log file of a sandbox is rotated (ie: 512K, 10M)"`
+	LogMaxFiles      int      `json:"log_max_files" desc:"Number of rotated log files kept for each sandbox"`
+	LogMaxSandboxes  int      `json:"log_max_sandboxes" desc:"Number of sandboxes of each profile whose log files are kept, 0 keeps all"`
 	OpenVPNRunPath   string   `json:"openvpn_run_path" desc: "Path for OpenVPN run state"`
 	OpenVPNConfDir   string   `json:"openvpn_conf_dir" desc: "Path for OpenVPN conf files"`
 	OpenVPNGroup     string   `json:"openvpn_group" desc: "GID for OpenVPN process"`
@@ -22,6 +29,9 @@ type Config struct {
 	NMIgnoreFile     string   `json:"nm_ignore_file" desc:"Path to the NetworkManager ignore config file, disables the warning if empty"`
 	UseFullDev       bool     `json:"use_full_dev" desc:"Give sandboxes full access to devices instead of a restricted set"`
 	AllowRootShell   bool     `json:"allow_root_shell" desc:"Allow entering a sandbox shell as root"`
+	UserNamespaces   bool     `json:"user_namespaces" desc:"Launch every sandbox in a user namespace so that oz-init does not run as root on the host"`
+	UserNamespaceId  uint32   `json:"user_namespace_id" desc:"Unprivileged host uid and gid which root inside a user namespace is mapped to"`
+	DBusService      bool     `json:"dbus_service" desc:"Export the daemon as com.subgraph.Oz on the D-Bus system bus"`
 	LogXpra          bool     `json:"log_xpra" desc:"Log output of Xpra"`
 	EnableEphemerals bool     `json:"enable_ephemerals" desc:"Enable prompting to launch sandbox in ephemeral mode"`
 	EnvironmentVars  []string `json:"environment_vars" desc:"Default environment variables passed to sandboxes"`
@@ -91,6 +101,13 @@ func NewDefaultConfig() *Config {
 		PrefixPath:       "/usr/local",
 		EtcPrefix:        "/etc/oz",
 		SandboxPath:      "/srv/oz",
+		StatePath:        "/var/run/oz/sandboxes",
+		PolicyPath:       DefaultPolicyPath,
+		CgroupPath:       "/sys/fs/cgroup/oz",
+		LogPath:          "/var/log/oz",
+		LogMaxSize:       "1M",
+		LogMaxFiles:      3,
+		LogMaxSandboxes:  20,
 		OpenVPNRunPath:   "/var/run/openvpn",
 		OpenVPNConfDir:   "/var/lib/oz/openvpn",
 		OpenVPNGroup:     "oz-openvpn",
@@ -100,6 +117,9 @@ func NewDefaultConfig() *Config {
 		DivertSuffix:     "",
 		UseFullDev:       false,
 		AllowRootShell:   false,
+		UserNamespaces:   false,
+		UserNamespaceId:  65534,
+		DBusService:      true,
 		LogXpra:          true,
 		EnableEphemerals: false,
 		EnvironmentVars: []string{
@@ -114,6 +134,15 @@ func NewDefaultConfig() *Config {
 	}
 }
 
+// SandboxLogDir returns the log directory of the sandboxes of a profile, its
+// log_dir if set or a directory named after it under the log path
+func (c *Config) SandboxLogDir(p *Profile) string {
+	if p.LogDir != "" {
+		return p.LogDir
+	}
+	return path.Join(c.LogPath, p.Name)
+}
+
 func LoadConfig(cpath string) (*Config, error) {
 	if _, err := os.Stat(cpath); os.IsNotExist(err) {
 		return nil, err
@@ -67,6 +67,14 @@ func (fs *Filesystem) CreateEmptyDir(target string) error {
 
 func (fs *Filesystem) CreateDevice(devpath string, dev int, mode uint32, gid int) error {
 	p := fs.absPath(devpath)
+	if inUserNamespace() {
+		// Device nodes cannot be created from a user namespace, the node of
+		// the host is bound instead
+		if err := createEmptyFile(p, 0600); err != nil {
+			return fmt.Errorf("failed to create device '%s': %v", p, err)
+		}
+		return bindMount(devpath, p, 0)
+	}
 	um := syscall.Umask(0)
 	if err := syscall.Mknod(p, mode, dev); err != nil {
 		return fmt.Errorf("failed to mknod device '%s': %v", p, err)
@@ -345,11 +353,21 @@ func (fs *Filesystem) MountProc() error {
 }
 
 func (fs *Filesystem) MountFullDev() error {
+	if inUserNamespace() {
+		return fmt.Errorf("devtmpfs cannot be mounted in a user namespace, use_full_dev must be disabled")
+	}
 	return fs.mountSpecial("/dev", "devtmpfs", 0, "")
 }
 
 func (fs *Filesystem) MountSys() error {
-	return fs.mountSpecial("/sys", "sysfs", syscall.MS_RDONLY, "")
+	err := fs.mountSpecial("/sys", "sysfs", syscall.MS_RDONLY, "")
+	if err == syscall.EPERM && inUserNamespace() {
+		// sysfs can only be mounted by the owner of the network namespace,
+		// which is not the case with host networking
+		fs.log.Warning("Unable to mount /sys in user namespace, leaving it empty")
+		return nil
+	}
+	return err
 }
 
 func (fs *Filesystem) MountTmp() error {
@@ -359,6 +377,10 @@ func (fs *Filesystem) MountTmp() error {
 func (fs *Filesystem) MountPts() error {
 	//ma := "newinstance,mode=620,gid=5,ptmxmode=0600"
 	ma := "newinstance,mode=620,gid=5,ptmxmode=0666"
+	if inUserNamespace() {
+		// The tty group is not mapped in the namespace
+		ma = "newinstance,mode=620,ptmxmode=0666"
+	}
 	return fs.mountSpecial("/dev/pts", "devpts", 0, ma)
 }
 
@@ -389,6 +411,9 @@ func bindMount(source, target string, flags int) error {
 }
 
 func remount(target string, flags int) error {
+	if inUserNamespace() {
+		flags |= lockedMountFlags(target)
+	}
 	fl := uintptr(flags | syscall.MS_BIND | syscall.MS_REMOUNT)
 	if err := syscall.Mount("", target, "", fl, ""); err != nil {
 		return fmt.Errorf("failed to remount %s with flags %x: %v", target, flags, err)
@@ -18,6 +18,11 @@ func ResolvePathNoGlob(p string, d int, u *user.User, xdgDirs *xdgdirs.Dirs, pro
 	return resolveVars(p, d, u, xdgDirs, profile)
 }
 
+// ResolvePath resolves the variables of p and expands it if it is globbed
+func ResolvePath(p string, d int, u *user.User, xdgDirs *xdgdirs.Dirs, profile *oz.Profile) ([]string, error) {
+	return resolvePath(p, d, u, xdgDirs, profile)
+}
+
 func resolvePath(p string, d int, u *user.User, xdgDirs *xdgdirs.Dirs, profile *oz.Profile) ([]string, error) {
 	p, err := resolveVars(p, d, u, xdgDirs, profile)
 	if err != nil {
@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Flags reported by statfs(2) for a mount
+const (
+	stRdonly     = 0x0001
+	stNosuid     = 0x0002
+	stNodev      = 0x0004
+	stNoexec     = 0x0008
+	stNoatime    = 0x0400
+	stNodiratime = 0x0800
+	stRelatime   = 0x1000
+)
+
+var userNamespace struct {
+	once   sync.Once
+	nested bool
+}
+
+// inUserNamespace returns true if the process runs in a user namespace other
+// than the initial one, which is the case of oz-init when the sandbox has been
+// launched with a uid mapping
+func inUserNamespace() bool {
+	userNamespace.once.Do(func() {
+		bs, err := ioutil.ReadFile("/proc/self/uid_map")
+		if err != nil {
+			return
+		}
+		// The initial namespace maps the whole range of ids onto itself
+		fields := strings.Fields(string(bs))
+		userNamespace.nested = len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+	})
+	return userNamespace.nested
+}
+
+// lockedMountFlags returns the flags of the mount holding target which cannot
+// be cleared from inside a user namespace. A remount that omits any of them is
+// refused by the kernel.
+func lockedMountFlags(target string) int {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return 0
+	}
+	flags := 0
+	for _, f := range []struct {
+		st    int64
+		mount int
+	}{
+		{stRdonly, syscall.MS_RDONLY},
+		{stNosuid, syscall.MS_NOSUID},
+		{stNodev, syscall.MS_NODEV},
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.mount
+		}
+	}
+	return flags
+}
@@ -11,17 +11,25 @@ type handlerMap map[string]reflect.Value
 
 var defaultLog = logging.MustGetLogger("ipc")
 
+// An Authorizer decides whether a message may be passed on to its handler.
+// A non-nil error rejects the message, in which case the Authorizer is
+// responsible for answering the sender.
+type Authorizer func(m *Message) error
+
 type msgDispatcher struct {
-	log  *logging.Logger
-	msgs chan *Message
-	hmap handlerMap
+	log   *logging.Logger
+	msgs  chan *Message
+	calls chan func()
+	hmap  handlerMap
+	auth  Authorizer
 }
 
 func createDispatcher(log *logging.Logger, handlers ...interface{}) (*msgDispatcher, error) {
 	md := &msgDispatcher{
-		log:  log,
-		msgs: make(chan *Message),
-		hmap: make(map[string]reflect.Value),
+		log:   log,
+		msgs:  make(chan *Message),
+		calls: make(chan func()),
+		hmap:  make(map[string]reflect.Value),
 	}
 	for _, h := range handlers {
 		if err := md.hmap.addHandler(h); err != nil {
@@ -40,6 +48,11 @@ func (md *msgDispatcher) dispatch(m *Message) {
 	md.msgs <- m
 }
 
+// call runs f on the dispatcher goroutine, between two messages
+func (md *msgDispatcher) call(f func()) {
+	md.calls <- f
+}
+
 func (md *msgDispatcher) logger() *logging.Logger {
 	if md.log != nil {
 		return md.log
@@ -48,11 +61,30 @@ func (md *msgDispatcher) logger() *logging.Logger {
 }
 
 func (md *msgDispatcher) runDispatcher() {
-	for m := range md.msgs {
-		if err := md.hmap.dispatch(m); err != nil {
-			md.logger().Warning("error dispatching message: %v", err)
+	for {
+		select {
+		case m, ok := <-md.msgs:
+			if !ok {
+				return
+			}
+			md.handleMessage(m)
+		case f := <-md.calls:
+			f()
+		}
+	}
+}
+
+func (md *msgDispatcher) handleMessage(m *Message) {
+	if md.auth != nil {
+		if err := md.auth(m); err != nil {
+			md.logger().Debug("message %s (%d) rejected: %v", m.Type, m.MsgID, err)
+			m.Free()
+			return
 		}
 	}
+	if err := md.hmap.dispatch(m); err != nil {
+		md.logger().Warning("error dispatching message: %v", err)
+	}
 }
 
 func (handlers handlerMap) dispatch(m *Message) error {
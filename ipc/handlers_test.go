@@ -89,3 +89,29 @@ func TestDispatch(t *testing.T) {
 		t.Errorf("count was not incremented to 2 as expected. count = %d", count)
 	}
 }
+
+func TestDispatcherCall(t *testing.T) {
+	type testStruct struct {
+		t int "tester"
+	}
+	var order []string
+	h := func(ts *testStruct, m *Message) error {
+		order = append(order, "message")
+		return nil
+	}
+	md, err := createDispatcher(nil, h)
+	if err != nil {
+		t.Fatalf("unexpected failure to create dispatcher: %v", err)
+	}
+	defer md.close()
+
+	md.dispatch(&Message{Type: "tester", Body: new(testStruct)})
+	md.call(func() { order = append(order, "call") })
+	done := make(chan bool)
+	md.call(func() { close(done) })
+	<-done
+
+	if !reflect.DeepEqual(order, []string{"message", "call"}) {
+		t.Errorf("calls and messages were not run in order: %v", order)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"sync"
 	"syscall"
 
 	"encoding/binary"
@@ -28,6 +29,9 @@ type MsgConn struct {
 	idGen    <-chan int
 	respMan  *responseManager
 	onClose  func()
+	peer     *HelloMsg
+	closer   sync.Once
+	closeErr error
 }
 
 type MsgServer struct {
@@ -66,6 +70,12 @@ func NewServer(address string, factory MsgFactory, log *logging.Logger, handlers
 	}, nil
 }
 
+// SetAuthorizer installs a function which is consulted for every message
+// received by the server before it is dispatched. It must be called before Run.
+func (s *MsgServer) SetAuthorizer(auth Authorizer) {
+	s.disp.auth = auth
+}
+
 func (s *MsgServer) Run() error {
 	for !s.isClosed {
 		conn, err := s.listener.AcceptUnix()
@@ -93,6 +103,37 @@ func (s *MsgServer) Run() error {
 	return nil
 }
 
+// Deliver passes a message received through another transport to the
+// authorizer and the handlers of the server, as if it had been sent by a
+// peer with the given credentials. Responses are passed to respond.
+func (s *MsgServer) Deliver(body interface{}, ucred *syscall.Ucred, respond func(msg interface{}) error) error {
+	if s.isClosed {
+		return errors.New("server is closed")
+	}
+	msgType, err := getMessageType(body)
+	if err != nil {
+		return err
+	}
+	s.disp.dispatch(&Message{
+		Type:    msgType,
+		MsgID:   <-s.idGen,
+		Body:    body,
+		Ucred:   ucred,
+		respond: respond,
+	})
+	return nil
+}
+
+// Call runs f on the goroutine which dispatches messages to the handlers of
+// the server, so that it never runs concurrently with a handler.
+func (s *MsgServer) Call(f func()) error {
+	if s.isClosed {
+		return errors.New("server is closed")
+	}
+	s.disp.call(f)
+	return nil
+}
+
 func (s *MsgServer) Close() error {
 	if s.isClosed {
 		return nil
@@ -128,6 +169,12 @@ func Connect(address string, factory MsgFactory, log *logging.Logger, handlers .
 		},
 	}
 	go mc.readLoop()
+	if factory.version > 0 {
+		if err := mc.handshake(); err != nil {
+			mc.Close()
+			return nil, err
+		}
+	}
 	return mc, nil
 }
 
@@ -179,23 +226,39 @@ func (mc *MsgConn) processOneMessage() bool {
 				return true
 			}
 		}
+		if _, ok := err.(*unknownTypeError); ok {
+			// Sent by a newer peer, the connection remains usable
+			mc.logger().Warning("error on MsgConn.readMessage(): %v", err)
+			return false
+		}
 		if !mc.isClosed {
 			mc.logger().Warning("error on MsgConn.readMessage(): %v, %s", err)
 		}
 		return true
 	}
-	if !mc.respMan.handle(m) {
-		mc.disp.dispatch(m)
+	if mc.respMan.handle(m) {
+		return false
+	}
+	if hello, ok := m.Body.(*HelloMsg); ok {
+		mc.handleHello(hello, m)
+		return false
 	}
+	mc.disp.dispatch(m)
 	return false
 }
 
+// Close closes the connection. It may be called again, by the read loop when
+// the peer goes away or by the owner of the connection, without effect.
 func (mc *MsgConn) Close() error {
-	mc.isClosed = true
-	if mc.onClose != nil {
-		mc.onClose()
-	}
-	return mc.conn.Close()
+	mc.closer.Do(func() {
+		mc.isClosed = true
+		mc.respMan.closeAll()
+		if mc.onClose != nil {
+			mc.onClose()
+		}
+		mc.closeErr = mc.conn.Close()
+	})
+	return mc.closeErr
 }
 
 func createOobBuffer() []byte {
@@ -270,10 +333,16 @@ func (mc *MsgConn) AddHandlers(args ...interface{}) error {
 }
 
 func (mc *MsgConn) SendMsg(msg interface{}, fds ...int) error {
+	if err := mc.checkSupported(msg); err != nil {
+		return err
+	}
 	return mc.sendMessage(msg, <-mc.idGen, fds...)
 }
 
 func (mc *MsgConn) ExchangeMsg(msg interface{}, fds ...int) (ResponseReader, error) {
+	if err := mc.checkSupported(msg); err != nil {
+		return nil, err
+	}
 	id := <-mc.idGen
 	rr := mc.respMan.register(id)
 
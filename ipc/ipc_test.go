@@ -1,6 +1,8 @@
 package ipc
 
 import (
+	"errors"
+	"net"
 	"os"
 	"sync"
 	"testing"
@@ -97,3 +99,94 @@ func TestPassFDs(t *testing.T) {
 
 	})
 }
+
+func TestAuthorizer(t *testing.T) {
+	var wg sync.WaitGroup
+	rejected := 0
+	handled := 0
+	handler := func(tm *TestMsg, msg *Message) error {
+		handled++
+		wg.Done()
+		return nil
+	}
+	auth := func(msg *Message) error {
+		if rejected == 0 {
+			rejected++
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	s, err := NewServer(testSocket, testFactory, nil, handler)
+	if err != nil {
+		t.Fatal("error setting up test server:", err)
+	}
+	s.SetAuthorizer(auth)
+	go s.Run()
+	c, err := Connect(testSocket, testFactory, nil)
+	if err != nil {
+		s.Close()
+		t.Fatal("error connecting to test server:", err)
+	}
+	wg.Add(1)
+	c.SendMsg(&TestMsg{})
+	c.SendMsg(&TestMsg{})
+	wg.Wait()
+	c.Close()
+	s.Close()
+	if rejected != 1 || handled != 1 {
+		t.Errorf("expecting one rejected and one handled message, got %d and %d", rejected, handled)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s, err := NewServer(testSocket, testFactory.WithProtocol(2), nil)
+	if err != nil {
+		t.Fatal("error setting up test server:", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	c, err := Connect(testSocket, testFactory.WithProtocol(2), nil)
+	if err != nil {
+		t.Fatal("handshake with the same version failed:", err)
+	}
+	if !c.PeerSupports("Test") || c.PeerSupports("Unknown") {
+		t.Error("features advertised by the server do not match its factory")
+	}
+	c.Close()
+
+	_, err = Connect(testSocket, testFactory.WithProtocol(1), nil)
+	if _, ok := err.(*IncompatibleError); !ok {
+		t.Errorf("expecting an IncompatibleError for a version mismatch, got %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: testSocket, Net: "unix"})
+	if err != nil {
+		t.Fatal("error setting up test listener:", err)
+	}
+	defer l.Close()
+	go func() {
+		// A peer which goes away during the handshake, then one which stays
+		for i := 0; i < 2; i++ {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				conn.Close()
+			}
+		}
+	}()
+	if _, err := Connect(testSocket, testFactory.WithProtocol(2), nil); err == nil {
+		t.Error("handshake with a closed connection succeeded")
+	}
+
+	c, err := Connect(testSocket, testFactory, nil)
+	if err != nil {
+		t.Fatal("error connecting to test listener:", err)
+	}
+	c.Close()
+	c.Close()
+}
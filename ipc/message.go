@@ -9,20 +9,27 @@ import (
 )
 
 func NewMsgFactory(msgTypes ...interface{}) MsgFactory {
-	mf := (MsgFactory)(make(map[string]func() interface{}))
-	for _, mt := range msgTypes {
+	mf := MsgFactory{types: make(map[string]func() interface{})}
+	for _, mt := range append([]interface{}{new(HelloMsg)}, msgTypes...) {
 		if err := mf.register(mt); err != nil {
 			defaultLog.Fatalf("failed adding (%T) in NewMsgFactory: %v", mt, err)
-			return nil
+			return MsgFactory{}
 		}
 	}
 	return mf
 }
 
-type MsgFactory map[string](func() interface{})
+// A MsgFactory creates the message structures received on a connection. A
+// factory with a protocol version performs a handshake on every connection
+// it is used to establish, see WithProtocol.
+type MsgFactory struct {
+	version  int
+	features []string
+	types    map[string](func() interface{})
+}
 
 func (mf MsgFactory) create(msgType string) (interface{}, error) {
-	f, ok := mf[msgType]
+	f, ok := mf.types[msgType]
 	if !ok {
 		return nil, fmt.Errorf("cannot create msg type: %s %v", msgType, ok)
 	}
@@ -42,13 +49,21 @@ func (mf MsgFactory) register(mt interface{}) error {
 	}
 	tag := string(t.Field(0).Tag)
 
-	mf[tag] = func() interface{} {
+	mf.types[tag] = func() interface{} {
 		v := reflect.New(t)
 		return v.Interface()
 	}
 	return nil
 }
 
+type unknownTypeError struct {
+	msgType string
+}
+
+func (e *unknownTypeError) Error() string {
+	return "cannot create msg type: " + e.msgType
+}
+
 type Message struct {
 	Type  string
 	MsgID int
@@ -56,6 +71,8 @@ type Message struct {
 	Ucred *syscall.Ucred
 	Fds   []int
 	mconn *MsgConn
+	// Set for messages passed to MsgServer.Deliver
+	respond func(msg interface{}) error
 }
 
 type BaseMsg struct {
@@ -72,7 +89,7 @@ func (mc *MsgConn) parseMessage(data []byte) (*Message, error) {
 	}
 	body, err := mc.factory.create(base.Type)
 	if err != nil {
-		return nil, err
+		return nil, &unknownTypeError{base.Type}
 	}
 	if err := json.Unmarshal(base.Body, body); err != nil {
 		return nil, err
@@ -116,5 +133,20 @@ func (m *Message) parseControlData(data []byte) error {
 }
 
 func (m *Message) Respond(msg interface{}, fds ...int) error {
+	if m.respond != nil {
+		if len(fds) > 0 {
+			return errors.New("cannot pass file descriptors in response to a delivered message")
+		}
+		return m.respond(msg)
+	}
 	return m.mconn.sendMessage(msg, m.MsgID, fds...)
 }
+
+// Disconnect closes the connection the message was received on, failing the
+// responses being sent. It does nothing for delivered messages.
+func (m *Message) Disconnect() error {
+	if m.mconn == nil {
+		return nil
+	}
+	return m.mconn.Close()
+}
@@ -0,0 +1,131 @@
+package ipc
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How long Connect waits for the peer to answer the handshake. A peer which
+// predates the handshake drops the connection without answering.
+const handshakeTimeout = 2 * time.Second
+
+// HelloMsg is sent by a client right after connecting when its factory has a
+// protocol version, and answered by the server with its own. It is
+// registered in every MsgFactory.
+//
+// Version changes only when the messages change in an incompatible way,
+// peers with different versions refuse to talk to each other. Adding an
+// optional field to a message does not need a new version: unknown fields are
+// ignored when decoding and missing ones keep their zero value. Features
+// lists the message types known to the sender along with the optional
+// features passed to WithProtocol.
+type HelloMsg struct {
+	Version  int "Hello"
+	Features []string
+}
+
+// IncompatibleError is returned when the peer of a connection does not speak
+// the same protocol.
+type IncompatibleError struct {
+	Reason string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "incompatible peer: " + e.Reason
+}
+
+// WithProtocol returns a copy of the factory which advertises the given
+// protocol version and optional features during the handshake.
+func (mf MsgFactory) WithProtocol(version int, features ...string) MsgFactory {
+	mf.version = version
+	mf.features = features
+	return mf
+}
+
+// Version returns the protocol version advertised by the factory.
+func (mf MsgFactory) Version() int {
+	return mf.version
+}
+
+func (mf MsgFactory) hello() *HelloMsg {
+	h := &HelloMsg{Version: mf.version}
+	for t := range mf.types {
+		h.Features = append(h.Features, t)
+	}
+	sort.Strings(h.Features)
+	h.Features = append(h.Features, mf.features...)
+	return h
+}
+
+// handshake exchanges HelloMsg with the server and checks it speaks the same
+// version of the protocol.
+func (mc *MsgConn) handshake() error {
+	rr, err := mc.ExchangeMsg(mc.factory.hello())
+	if err != nil {
+		return err
+	}
+	defer rr.Done()
+	select {
+	case resp, ok := <-rr.Chan():
+		if !ok {
+			return &IncompatibleError{"connection closed during the protocol handshake"}
+		}
+		peer, ok := resp.Body.(*HelloMsg)
+		if !ok {
+			return &IncompatibleError{fmt.Sprintf("unexpected %s message received in answer to the handshake", resp.Type)}
+		}
+		if peer.Version != mc.factory.version {
+			return &IncompatibleError{fmt.Sprintf("peer speaks protocol version %d, expected version %d", peer.Version, mc.factory.version)}
+		}
+		mc.peer = peer
+		return nil
+	case <-time.After(handshakeTimeout):
+		return &IncompatibleError{"no answer to the protocol handshake, the peer probably runs an older version"}
+	}
+}
+
+// handleHello answers the handshake of a client. The server does not enforce
+// the version, it is up to the client to give up on a mismatch.
+func (mc *MsgConn) handleHello(peer *HelloMsg, m *Message) {
+	if peer.Version != mc.factory.version {
+		mc.logger().Info("client pid %d speaks protocol version %d, expected version %d", ucredPid(m), peer.Version, mc.factory.version)
+	}
+	mc.peer = peer
+	if err := m.Respond(mc.factory.hello()); err != nil {
+		mc.logger().Warning("error answering handshake: %v", err)
+	}
+}
+
+// PeerSupports returns true if the peer advertised the message type or
+// optional feature during the handshake. A peer which did not take part in a
+// handshake is assumed to support everything.
+func (mc *MsgConn) PeerSupports(feature string) bool {
+	if mc.peer == nil {
+		return true
+	}
+	for _, f := range mc.peer.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (mc *MsgConn) checkSupported(msg interface{}) error {
+	msgType, err := getMessageType(msg)
+	if err != nil {
+		return err
+	}
+	if !mc.PeerSupports(msgType) {
+		return &IncompatibleError{fmt.Sprintf("peer does not support %s messages", msgType)}
+	}
+	return nil
+}
+
+func ucredPid(m *Message) int32 {
+	if m.Ucred == nil {
+		return 0
+	}
+	return m.Ucred.Pid
+}
@@ -24,8 +24,9 @@ func (rw *responseWaiter) Chan() <-chan *Message {
 func (rw *responseWaiter) Done() {
 	rw.rm.lock.Lock()
 	defer rw.rm.lock.Unlock()
-	close(rw.ch)
-	delete(rw.rm.responseMap, rw.id)
+	if rw.rm.responseMap[rw.id] == rw {
+		rw.rm.removeById(rw.id, true)
+	}
 }
 
 type responseManager struct {
@@ -76,3 +77,13 @@ func (rm *responseManager) removeById(id int, klose bool) *responseWaiter {
 	}
 	return rw
 }
+
+// closeAll closes the channels of every waiter, called when the connection
+// goes away so that readers do not wait for responses forever.
+func (rm *responseManager) closeAll() {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	for id := range rm.responseMap {
+		rm.removeById(id, true)
+	}
+}
@@ -0,0 +1,186 @@
+// Package landlock restricts the filesystem access of a process and of its
+// future children with the Landlock LSM.
+package landlock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SYS_LANDLOCK_CREATE_RULESET = 444
+	SYS_LANDLOCK_ADD_RULE       = 445
+	SYS_LANDLOCK_RESTRICT_SELF  = 446
+
+	createRulesetVersion = 1 << 0
+	rulePathBeneath      = 1
+)
+
+// Filesystem access rights
+const (
+	AccessExecute    = 1 << 0
+	AccessWriteFile  = 1 << 1
+	AccessReadFile   = 1 << 2
+	AccessReadDir    = 1 << 3
+	AccessRemoveDir  = 1 << 4
+	AccessRemoveFile = 1 << 5
+	AccessMakeChar   = 1 << 6
+	AccessMakeDir    = 1 << 7
+	AccessMakeReg    = 1 << 8
+	AccessMakeSock   = 1 << 9
+	AccessMakeFifo   = 1 << 10
+	AccessMakeBlock  = 1 << 11
+	AccessMakeSym    = 1 << 12
+	AccessRefer      = 1 << 13
+	AccessTruncate   = 1 << 14
+	AccessIoctlDev   = 1 << 15
+)
+
+const (
+	// Rights to read and execute files and list directories
+	AccessRead = AccessExecute | AccessReadFile | AccessReadDir
+	// Rights to modify existing files
+	AccessWrite = AccessRead | AccessWriteFile | AccessTruncate | AccessIoctlDev
+	// Rights to create, rename and remove entries of directories
+	AccessCreate = AccessWrite | AccessRemoveDir | AccessRemoveFile | AccessMakeDir |
+		AccessMakeReg | AccessMakeSock | AccessMakeFifo | AccessMakeSym | AccessRefer
+
+	// Rights which apply to files, as opposed to directories
+	accessFile = AccessExecute | AccessWriteFile | AccessReadFile | AccessTruncate | AccessIoctlDev
+)
+
+// Rights handled by each version of the Landlock ABI
+var abiAccess = []uint64{
+	0,
+	1<<13 - 1,
+	1<<14 - 1,
+	1<<15 - 1,
+	1<<15 - 1,
+	1<<16 - 1,
+}
+
+// Rule grants Access to the file or directory hierarchy at Path, unless Path
+// is one of Except, which then only gets the rights granted by its own rules
+type Rule struct {
+	Path   string
+	Access uint64
+	Except []string `json:",omitempty"`
+}
+
+type rulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type pathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// Version returns the Landlock ABI version supported by the kernel, or an
+// error if Landlock is not available
+func Version() (int, error) {
+	v, _, errno := syscall.Syscall(SYS_LANDLOCK_CREATE_RULESET, 0, 0, createRulesetVersion)
+	if errno != 0 {
+		switch errno {
+		case syscall.ENOSYS:
+			return 0, errors.New("kernel does not support landlock")
+		case syscall.EOPNOTSUPP:
+			return 0, errors.New("landlock is disabled in the kernel")
+		}
+		return 0, errno
+	}
+	return int(v), nil
+}
+
+// Restrict applies rules to the calling thread, which is denied every right not
+// granted by a rule. Paths missing from the filesystem are skipped. The calling
+// goroutine must be locked to its thread, and only processes executed from this
+// thread afterward inherit the restrictions. no_new_privs is set as Landlock
+// requires it from unprivileged processes.
+func Restrict(rules []Rule) error {
+	abi, err := Version()
+	if err != nil {
+		return err
+	}
+	if abi >= len(abiAccess) {
+		abi = len(abiAccess) - 1
+	}
+	handled := abiAccess[abi]
+
+	attr := rulesetAttr{handledAccessFS: handled}
+	fd, _, errno := syscall.Syscall(SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, r := range expandRules(rules) {
+		if err := addRule(int(fd), r, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %v", errno)
+	}
+	return nil
+}
+
+// expandRules drops the rules whose path is one of their exceptions. Rights
+// only add up down a hierarchy in Landlock, so a writable directory holding
+// an exception still grants it its rights: the read-only whitelist items below
+// it are kept read-only by their bind mount.
+func expandRules(rules []Rule) []Rule {
+	expanded := []Rule{}
+	for _, r := range rules {
+		dropped := false
+		for _, e := range r.Except {
+			if path.Clean(e) == path.Clean(r.Path) {
+				dropped = true
+			}
+		}
+		if !dropped {
+			expanded = append(expanded, Rule{Path: r.Path, Access: r.Access})
+		}
+	}
+	return expanded
+}
+
+func addRule(rulesetFd int, r Rule, handled uint64) error {
+	fd, err := syscall.Open(r.Path, unix.O_PATH|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s for landlock rule: %v", r.Path, err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s for landlock rule: %v", r.Path, err)
+	}
+	access := r.Access & handled
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= accessFile
+	}
+	if access == 0 {
+		return nil
+	}
+	attr := pathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+	_, _, errno := syscall.Syscall6(SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), rulePathBeneath,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %v", r.Path, errno)
+	}
+	return nil
+}
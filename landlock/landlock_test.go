@@ -0,0 +1,26 @@
+package landlock
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandRules(t *testing.T) {
+	home := "/home/user"
+	ro := "/home/user/.config/app"
+	rules := expandRules([]Rule{
+		{Path: home, Access: AccessCreate, Except: []string{ro, "/elsewhere"}},
+		{Path: ro, Access: AccessRead},
+		{Path: "/tmp", Access: AccessCreate, Except: []string{"/tmp/"}},
+		{Path: "/run/user/1000/", Access: AccessCreate, Except: []string{"/run/user/1000"}},
+	})
+	// The home directory keeps its rights, creating entries in it and
+	// in the directories leading to the read-only item is allowed
+	want := []Rule{
+		{Path: home, Access: AccessCreate},
+		{Path: ro, Access: AccessRead},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("expandRules() = %+v, expected %+v", rules, want)
+	}
+}
@@ -9,9 +9,11 @@ import (
 )
 
 type subnetAllocator struct {
-	baseNet    *net.IPNet
-	nextSubnet int
-	log        *logging.Logger
+	baseNet     *net.IPNet
+	nextSubnet  int
+	ula         *net.IPNet // ULA prefix from which the IPv6 subnets are allocated
+	nextSubnet6 uint16
+	log         *logging.Logger
 }
 
 func (sa *subnetAllocator) allocateRange(iface string) (*IPRange, error) {
@@ -23,6 +25,18 @@ func (sa *subnetAllocator) allocateRange(iface string) (*IPRange, error) {
 	return newIPRange(n, iface), nil
 }
 
+// allocateRange6 returns an IPv6 range for a new bridge, a /64 of the ULA
+// prefix of the host
+func (sa *subnetAllocator) allocateRange6(iface string) (*IPRange6, error) {
+	if sa.nextSubnet6 == 0xffff {
+		return nil, fmt.Errorf("Cannot allocate any more subnets from %v", sa.ula)
+	}
+	n := ulaSubnet(sa.ula, sa.nextSubnet6)
+	sa.nextSubnet6 += 1
+	sa.log.Infof("Allocating new subnet range (%v) for interface '%s'", n, iface)
+	return newIPRange6(n, iface), nil
+}
+
 func (sa *subnetAllocator) allocate() (*net.IPNet, error) {
 	if sa.nextSubnet > 255 {
 		return nil, fmt.Errorf("Cannot allocate any more subnets from %v", sa.baseNet)
@@ -48,9 +62,11 @@ func newAllocator(log *logging.Logger) (*subnetAllocator, error) {
 	}
 	log.Infof("Subnet allocator created with base network: %v", base)
 	return &subnetAllocator{
-		baseNet:    base,
-		nextSubnet: 1,
-		log:        log,
+		baseNet:     base,
+		nextSubnet:  1,
+		ula:         hostULAPrefix(),
+		nextSubnet6: 1,
+		log:         log,
 	}, nil
 }
 
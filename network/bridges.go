@@ -22,6 +22,8 @@ type OzBridge struct {
 	Name          string          // Name of bridge
 	ipr           *IPRange        // IPRange for allocating addresses to veth interfaces
 	ip            *net.IP         // IP assigned to the bridge itself
+	ipr6          *IPRange6       // IPv6 range of the bridge, nil if IPv6 is unavailable
+	ip6           *net.IP         // IPv6 address assigned to the bridge itself
 	veths         map[int]*OzVeth // map from sandbox id to OzVeth instances
 	log           *logging.Logger
 }
@@ -33,6 +35,11 @@ type OzVeth struct {
 	peerPid      int       // The process id of the init process of the sandbox this veth pair belongs to
 	bridge       *OzBridge // The bridge this veth pair is attached to
 	sbip         net.IP    // The sandbox's IP through the bridge
+	sbip6        net.IP    // The sandbox's IPv6 address through the bridge
+	noIPv6       bool      // Whether the sandbox has IPv6 disabled
+	fw           *Firewall // The firewall of the sandbox, if it has one
+	owner        string    // The name of the profile of the sandbox
+	ipByte       uint      // The last byte of the static IP of the sandbox, if it has one
 	log          *logging.Logger
 }
 
@@ -50,13 +57,32 @@ func (b *OzBridge) configure() error {
 		return fmt.Errorf("error bringing bridge interface up: %v", err)
 		return err
 	}
+	b.configureIPv6()
 	return nil
 }
 
+// configureIPv6 assigns the first address of its IPv6 range to the bridge.
+// Sandboxes on the bridge only get IPv4 addresses if this fails, which is
+// expected on hosts with IPv6 disabled.
+func (b *OzBridge) configureIPv6() {
+	if b.ipr6 == nil {
+		return
+	}
+	ip6 := b.ipr6.FirstIP()
+	b.log.Infof("Configuring bridge %s with IPv6 address %v from ULA prefix %v", b.Name, ip6, subnetULAPrefix(b.ipr6.IPNet))
+	if err := b.SetLinkIp(ip6, b.ipr6.IPNet); err != nil {
+		b.log.Warningf("Unable to configure IPv6 address of bridge %s, IPv6 is disabled for its sandboxes: %v", b.Name, err)
+		b.ipr6 = nil
+		return
+	}
+	b.ip6 = &ip6
+}
+
 func (b *OzBridge) reconfigure(ipr *IPRange) error {
 	if err := b.SetLinkIp(ipr.FirstIP(), ipr.IPNet); err != nil {
 
 	}
+	ipr.static = b.ipr.static
 	b.ipr = ipr
 	for _, veth := range b.veths {
 		if err := veth.AssignIP(); err != nil {
@@ -66,7 +92,9 @@ func (b *OzBridge) reconfigure(ipr *IPRange) error {
 	return nil
 }
 
-func (b *OzBridge) NewVeth(id int, peerPid int) (*OzVeth, error) {
+// NewVeth creates the veth pair of a sandbox of the profile named owner. Its
+// address is the one of the range ending with ipByte if it is not zero.
+func (b *OzBridge) NewVeth(id int, peerPid int, owner string, ipByte uint) (*OzVeth, error) {
 	if b.veths[id] != nil {
 		return nil, fmt.Errorf("a veth already exists on this bridge for id=%d", id)
 	}
@@ -74,10 +102,18 @@ func (b *OzBridge) NewVeth(id int, peerPid int) (*OzVeth, error) {
 	if err != nil {
 		return nil, err
 	}
+	v.owner = owner
+	v.ipByte = ipByte
 	b.veths[id] = v
 	return v, nil
 }
 
+// ReserveStatic keeps the static addresses of profiles, given by last byte
+// along with the profile names, from being handed out to other sandboxes
+func (b *OzBridge) ReserveStatic(bytes map[uint]string) {
+	b.ipr.reserveStatic(bytes)
+}
+
 func (b *OzBridge) newVeth(id int, peerPid int) (*OzVeth, error) {
 	vpair, err := createVethPair()
 	if err != nil {
@@ -93,10 +129,72 @@ func (b *OzBridge) newVeth(id int, peerPid int) (*OzVeth, error) {
 	}, nil
 }
 
+// AdoptVeth attaches to the bridge the host side of a veth pair created by a
+// previous instance of the daemon for a sandbox which is still running
+func (b *OzBridge) AdoptVeth(id int, peerPid int, hostName, peerName string, sbip, sbip6 net.IP, owner string) (*OzVeth, error) {
+	if b.veths[id] != nil {
+		return nil, fmt.Errorf("a veth already exists on this bridge for id=%d", id)
+	}
+	link, err := tenus.NewLinkFrom(hostName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find veth %s: %v", hostName, err)
+	}
+	v := &OzVeth{
+		Vether:  &adoptedVeth{Linker: link, peer: &net.Interface{Name: peerName}},
+		id:      id,
+		peerPid: peerPid,
+		bridge:  b,
+		sbip:    sbip,
+		sbip6:   sbip6,
+		owner:   owner,
+		log:     b.log,
+	}
+	if err := b.AddSlaveIfc(link.NetInterface()); err != nil {
+		return nil, fmt.Errorf("failed to add veth %s to bridge: %v", hostName, err)
+	}
+	if err := v.SetLinkUp(); err != nil {
+		return nil, fmt.Errorf("failed to bring host veth %s up: %v", hostName, err)
+	}
+	if sbip != nil && !b.ipr.reserve(sbip) {
+		b.log.Warningf("Address %v of adopted veth %s is outside of the range of bridge %s", sbip, hostName, b.Name)
+	}
+	b.ipr.setOwner(sbip, owner)
+	if sbip6 != nil && (b.ipr6 == nil || !b.ipr6.reserve(sbip6)) {
+		b.log.Warningf("IPv6 address %v of adopted veth %s is outside of the range of bridge %s", sbip6, hostName, b.Name)
+	}
+	b.veths[id] = v
+	return v, nil
+}
+
+var errPeerUnavailable = errors.New("peer interface of an adopted veth pair cannot be configured")
+
+// adoptedVeth is the host side of a veth pair found on startup. Its peer lives in
+// the network namespace of a sandbox and can no longer be reached through netlink.
+type adoptedVeth struct {
+	tenus.Linker
+	peer *net.Interface
+}
+
+func (av *adoptedVeth) PeerNetInterface() *net.Interface           { return av.peer }
+func (av *adoptedVeth) SetPeerLinkUp() error                       { return errPeerUnavailable }
+func (av *adoptedVeth) DeletePeerLink() error                      { return errPeerUnavailable }
+func (av *adoptedVeth) SetPeerLinkIp(net.IP, *net.IPNet) error     { return errPeerUnavailable }
+func (av *adoptedVeth) SetPeerLinkNsToDocker(string, string) error { return errPeerUnavailable }
+func (av *adoptedVeth) SetPeerLinkNsPid(int) error                 { return errPeerUnavailable }
+func (av *adoptedVeth) SetPeerLinkNsFd(string) error               { return errPeerUnavailable }
+func (av *adoptedVeth) SetPeerLinkNetInNs(int, net.IP, *net.IPNet, *net.IP) error {
+	return errPeerUnavailable
+}
+
 func (b *OzBridge) GetIP() *net.IP {
 	return b.ip
 }
 
+// GetIP6 returns the IPv6 address of the bridge, or nil if it has none
+func (b *OzBridge) GetIP6() *net.IP {
+	return b.ip6
+}
+
 func createVethPair() (tenus.Vether, error) {
 	hostName := tenus.MakeNetInterfaceName(ozDefaultInterfacePrefix)
 	guestName := hostName + "1"
@@ -123,18 +221,62 @@ func (v *OzVeth) Setup() error {
 	if err := v.AssignIP(); err != nil {
 		return fmt.Errorf("failed to assign address to peer veth %s: %v", v.PeerNetInterface().Name, err)
 	}
+
+	if err := v.AssignIP6(); err != nil {
+		v.log.Warningf("Failed to assign IPv6 address to peer veth %s: %v", v.PeerNetInterface().Name, err)
+	}
+	return nil
+}
+
+// DisableIPv6 keeps the veth from getting an IPv6 address in Setup
+func (v *OzVeth) DisableIPv6() {
+	v.noIPv6 = true
+}
+
+// AssignIP6 gives the peer veth an address of the IPv6 range of the bridge,
+// and a default route through the bridge. It does nothing if IPv6 is
+// disabled for the sandbox or unavailable on the bridge.
+func (v *OzVeth) AssignIP6() error {
+	ipr6 := v.bridge.ipr6
+	if v.noIPv6 || ipr6 == nil || v.bridge.ip6 == nil {
+		return nil
+	}
+	ip := ipr6.FreshIP()
+	if ip == nil {
+		return errors.New("unable to find usable IPv6 address")
+	}
+	v.log.Infof("Assigning IPv6 address %v to sandbox veth %s", ip, v.PeerNetInterface().Name)
+	if err := v.SetPeerLinkNetInNs(v.peerPid, ip, ipr6.IPNet, v.bridge.ip6); err != nil {
+		ipr6.release(ip)
+		return err
+	}
+	v.sbip6 = ip
 	return nil
 }
 
 func (v *OzVeth) AssignIP() error {
-	ip := v.bridge.ipr.FreshIP()
+	var ip net.IP
+	if v.ipByte != 0 {
+		sip, err := v.bridge.ipr.staticIP(v.ipByte, v.owner)
+		if err != nil {
+			return err
+		}
+		ip = sip
+	} else {
+		ip = v.bridge.ipr.FreshIP()
+		v.bridge.ipr.setOwner(ip, v.owner)
+	}
 
 	v.log.Infof("Assigning IP address %v to sandbox veth %s", ip, v.PeerNetInterface().Name)
 
 	if ip == nil {
 		return errors.New("unable to find usable IP address")
 	}
-	return v.SetIP(ip)
+	if err := v.SetIP(ip); err != nil {
+		v.bridge.ipr.release(ip)
+		return err
+	}
+	return nil
 }
 
 func (v *OzVeth) SetIP(ip net.IP) error {
@@ -143,6 +285,7 @@ func (v *OzVeth) SetIP(ip net.IP) error {
 	err := v.SetPeerLinkNetInNs(v.peerPid, ip, ipnet.IPNet, gw)
 
 	if err == nil {
+		fw := v.fw
 		if v.sbip != nil {
 			err2 := v.RemoveFWRules()
 
@@ -151,6 +294,11 @@ func (v *OzVeth) SetIP(ip net.IP) error {
 			}
 		}
 		v.sbip = ip
+		if fw != nil {
+			if err2 := v.SetFirewall(fw.Rules, fw.DefaultDeny, fw.GatewayDNSOnly); err2 != nil {
+				v.log.Warningf("Could not apply firewall rules for reconfigured interface: %v", err2)
+			}
+		}
 	}
 
 	return err
@@ -161,7 +309,55 @@ func (v *OzVeth) GetSandboxIP() net.IP {
 	return v.sbip
 }
 
+// GetSandboxIP6 returns the IPv6 address of the sandbox, or nil if it has none
+func (v *OzVeth) GetSandboxIP6() net.IP {
+	return v.sbip6
+}
+
+// SetFirewall applies firewall rules to the traffic of the sandbox from its
+// addresses, replacing the previous ones. If gatewayDNSOnly is set, the
+// sandbox may only send DNS queries to the bridge.
+func (v *OzVeth) SetFirewall(rules []FirewallRule, defaultDeny, gatewayDNSOnly bool) error {
+	if v.sbip == nil {
+		return errors.New("sandbox veth has no address")
+	}
+	fw := &Firewall{
+		Addrs:          []net.IP{v.sbip},
+		Rules:          append([]FirewallRule{}, rules...),
+		DefaultDeny:    defaultDeny,
+		GatewayDNSOnly: gatewayDNSOnly,
+	}
+	if v.sbip6 != nil {
+		fw.Addrs = append(fw.Addrs, v.sbip6)
+	}
+	if v.bridge.ip != nil {
+		fw.Gateways = append(fw.Gateways, *v.bridge.ip)
+	}
+	if v.bridge.ip6 != nil {
+		fw.Gateways = append(fw.Gateways, *v.bridge.ip6)
+	}
+	// Closed first so that a pending refresh of its host names cannot
+	// install its rules again over the new ones
+	if v.fw != nil {
+		v.fw.Close()
+	}
+	if err := fw.Apply(v.log); err != nil {
+		fw.Close()
+		return err
+	}
+	v.fw = fw
+	return nil
+}
+
+// Delete removes the veth pair and makes its address available again
 func (v *OzVeth) Delete() error {
+	if v.sbip != nil {
+		v.bridge.ipr.release(v.sbip)
+	}
+	if v.sbip6 != nil && v.bridge.ipr6 != nil {
+		v.bridge.ipr6.release(v.sbip6)
+	}
+	delete(v.bridge.veths, v.id)
 	return v.DeleteLink()
 }
 
@@ -218,10 +414,15 @@ func (bs *Bridges) createBridge(name string) (*OzBridge, error) {
 	if err != nil {
 		return nil, err
 	}
+	r6, err := bs.alloc.allocateRange6(brname)
+	if err != nil {
+		return nil, err
+	}
 	return &OzBridge{
 		Bridger: br,
 		Name:    name,
 		ipr:     r,
+		ipr6:    r6,
 		veths:   make(map[int]*OzVeth),
 		log:     bs.log,
 	}, nil
@@ -247,6 +448,8 @@ func (bs *Bridges) Reconfigure() error {
 	if err != nil {
 		return err
 	}
+	// The IPv6 ranges of the bridges are kept, they cannot overlap local networks
+	a.ula, a.nextSubnet6 = bs.alloc.ula, bs.alloc.nextSubnet6
 	bs.alloc = a
 
 	for _, ozb := range bs.bridgeMap {
@@ -265,35 +468,3 @@ func (bs *Bridges) Reconfigure() error {
 func (v *OzVeth) GetVethBridge() *OzBridge {
 	return v.bridge
 }
-
-const ReceiverSocketPath = "/tmp/fwoz.sock"
-
-func (v *OzVeth) RemoveFWRules() error {
-	src := v.sbip
-	fmt.Println("--------------- removing all rules by if = ", src.String())
-	if src == nil {
-		return errors.New("Could not remove firewall rules from null interface")
-	}
-	c, err := net.Dial("unix", ReceiverSocketPath)
-	if err != nil {
-		return err
-	}
-
-	defer c.Close()
-
-	reqstr := "removeall " + src.String() + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(buf[0:n]))
-	}
-
-	fmt.Println("Done.")
-	return nil
-}
@@ -0,0 +1,467 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	dnsPort        = 53
+	dnsHeaderLen   = 12
+	dnsMaxMsgLen   = 65535
+	dnsTimeout     = 5 * time.Second
+	dnsTCPIdle     = 10 * time.Second
+	dnsMaxUDP      = 64 // Queries over UDP handled at once, others are dropped
+	dnsMaxTCP      = 16 // Connections served at once, others are closed
+	hostResolvConf = "/etc/resolv.conf"
+)
+
+// Response codes used by the DNS proxy
+const (
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+)
+
+var dnsTypeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	64:  "SVCB",
+	65:  "HTTPS",
+	255: "ANY",
+}
+
+// DNSTypeName returns the name of a query type, ie: AAAA
+func DNSTypeName(qtype uint16) string {
+	if name, ok := dnsTypeNames[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+var errDNSMalformed = errors.New("malformed DNS query")
+
+// dnsQuestion returns the name and type of the single question of a query,
+// along with the length of the message up to the end of the question.
+func dnsQuestion(msg []byte) (string, uint16, int, error) {
+	if len(msg) < dnsHeaderLen || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, 0, errDNSMalformed
+	}
+	labels := []string{}
+	off := dnsHeaderLen
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, errDNSMalformed
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Compression pointers have no place in the question of a query
+		if n > 63 || off+n > len(msg) {
+			return "", 0, 0, errDNSMalformed
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, errDNSMalformed
+	}
+	qtype := binary.BigEndian.Uint16(msg[off:])
+	return strings.Join(labels, "."), qtype, off + 4, nil
+}
+
+// dnsError builds the response to a query carrying only its question and
+// the given response code
+func dnsError(msg []byte, qlen int, rcode byte) []byte {
+	resp := append([]byte{}, msg[:qlen]...)
+	resp[2] = resp[2]&0x79 | 0x80
+	resp[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	return resp
+}
+
+// DNSDomainAllowed returns true if name may be resolved under the allow and
+// deny lists of a profile. A domain in the lists also covers its subdomains.
+// A name must be covered by the allow list unless it is empty, and must not
+// be covered by the deny list.
+func DNSDomainAllowed(name string, allow, deny []string) bool {
+	for _, d := range deny {
+		if domainCovers(d, name) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, d := range allow {
+		if domainCovers(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func domainCovers(domain, name string) bool {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" {
+		return false
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// DNSQueryFunc is called by the DNS proxy for every query of a sandbox, and
+// returns whether the name may be resolved.
+type DNSQueryFunc func(name string, qtype uint16) bool
+
+// DNSProxy is a stub DNS forwarder listening on the addresses of a bridge.
+// It answers the sandboxes registered with it, passing their queries to the
+// name servers of the host.
+type DNSProxy struct {
+	ips      []net.IP
+	udp      []*net.UDPConn
+	tcp      []*net.TCPListener
+	udpSlots chan struct{}
+	tcpSlots chan struct{}
+	lock     sync.Mutex
+	clients  map[string]DNSQueryFunc
+	servers  []string
+	modTime  time.Time
+	log      *logging.Logger
+}
+
+// NewDNSProxy starts a DNS proxy on port 53 of the addresses of a bridge,
+// over UDP and TCP. It fails if it cannot listen on the first address, and
+// only warns about the others.
+func NewDNSProxy(ips []net.IP, log *logging.Logger) (*DNSProxy, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+	dp := &DNSProxy{
+		udpSlots: make(chan struct{}, dnsMaxUDP),
+		tcpSlots: make(chan struct{}, dnsMaxTCP),
+		clients:  make(map[string]DNSQueryFunc),
+		log:      log,
+	}
+	for i, ip := range ips {
+		if err := dp.listen(ip); err != nil {
+			if i == 0 {
+				dp.Close()
+				return nil, err
+			}
+			log.Warning("DNS proxy unable to listen on %v: %v", ip, err)
+			continue
+		}
+		log.Info("DNS proxy listening on %v", ip)
+	}
+	return dp, nil
+}
+
+func (dp *DNSProxy) listen(ip net.IP) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: dnsPort})
+	if err != nil {
+		return err
+	}
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: dnsPort})
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	dp.ips = append(dp.ips, ip)
+	dp.udp = append(dp.udp, udp)
+	dp.tcp = append(dp.tcp, tcp)
+	go dp.serveUDP(udp)
+	go dp.serveTCP(tcp)
+	return nil
+}
+
+// IPs returns the addresses the proxy listens on
+func (dp *DNSProxy) IPs() []net.IP {
+	return dp.ips
+}
+
+// Register makes the proxy answer the queries sent from the addresses
+func (dp *DNSProxy) Register(ips []net.IP, query DNSQueryFunc) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	for _, ip := range ips {
+		dp.clients[ip.String()] = query
+	}
+}
+
+func (dp *DNSProxy) Unregister(ips []net.IP) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	for _, ip := range ips {
+		delete(dp.clients, ip.String())
+	}
+}
+
+func (dp *DNSProxy) Close() error {
+	var err error
+	for i := range dp.udp {
+		dp.tcp[i].Close()
+		if e := dp.udp[i].Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (dp *DNSProxy) client(ip net.IP) DNSQueryFunc {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	return dp.clients[ip.String()]
+}
+
+// upstreams returns the name servers of the host, read again from its
+// resolv.conf whenever it changes
+func (dp *DNSProxy) upstreams() []string {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	fi, err := os.Stat(hostResolvConf)
+	if err != nil {
+		return dp.servers
+	}
+	if dp.servers == nil || !fi.ModTime().Equal(dp.modTime) {
+		dp.servers = ResolvConfNameservers(hostResolvConf)
+		dp.modTime = fi.ModTime()
+	}
+	return dp.servers
+}
+
+// serveUDP answers the queries received on conn, dropping those arriving
+// while dnsMaxUDP queries are already being forwarded
+func (dp *DNSProxy) serveUDP(conn *net.UDPConn) {
+	buf := make([]byte, dnsMaxMsgLen)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case dp.udpSlots <- struct{}{}:
+		default:
+			continue
+		}
+		msg := append([]byte{}, buf[:n]...)
+		go func() {
+			defer func() { <-dp.udpSlots }()
+			if resp := dp.handleQuery(src.IP, msg, "udp"); resp != nil {
+				conn.WriteToUDP(resp, src)
+			}
+		}()
+	}
+}
+
+// serveTCP serves the connections accepted on l, closing those arriving
+// while dnsMaxTCP connections are already being served
+func (dp *DNSProxy) serveTCP(l *net.TCPListener) {
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		select {
+		case dp.tcpSlots <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-dp.tcpSlots }()
+			dp.serveTCPConn(conn)
+		}()
+	}
+}
+
+func (dp *DNSProxy) serveTCPConn(conn *net.TCPConn) {
+	defer conn.Close()
+	src := conn.RemoteAddr().(*net.TCPAddr).IP
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdle))
+		msg, err := readTCPMsg(conn)
+		if err != nil {
+			return
+		}
+		resp := dp.handleQuery(src, msg, "tcp")
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMsg(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery returns the response to a query, or nil if it is dropped
+func (dp *DNSProxy) handleQuery(src net.IP, msg []byte, proto string) []byte {
+	name, qtype, qlen, err := dnsQuestion(msg)
+	if err != nil {
+		return nil
+	}
+	query := dp.client(src)
+	if query == nil {
+		dp.log.Debug("DNS proxy refused query from unknown address %v", src)
+		return dnsError(msg, qlen, dnsRcodeRefused)
+	}
+	if !query(name, qtype) {
+		return dnsError(msg, qlen, dnsRcodeNXDomain)
+	}
+	for _, server := range dp.upstreams() {
+		resp, err := forwardDNS(server, msg, proto)
+		if err == nil {
+			return resp
+		}
+		dp.log.Debug("DNS proxy failed to query %s: %v", server, err)
+	}
+	return dnsError(msg, qlen, dnsRcodeServFail)
+}
+
+// forwardDNS sends a query to a name server and returns its response
+func forwardDNS(server string, msg []byte, proto string) ([]byte, error) {
+	conn, err := net.DialTimeout(proto, net.JoinHostPort(server, fmt.Sprint(dnsPort)), dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	var resp []byte
+	if proto == "tcp" {
+		if err := writeTCPMsg(conn, msg); err != nil {
+			return nil, err
+		}
+		if resp, err = readTCPMsg(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxMsgLen)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp = buf[:n]
+	}
+	if len(resp) < dnsHeaderLen || resp[0] != msg[0] || resp[1] != msg[1] {
+		return nil, errors.New("mismatched response")
+	}
+	return resp, nil
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// ResolvConfNameservers returns the name servers listed in a resolv.conf file
+func ResolvConfNameservers(fpath string) []string {
+	bs, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return []string{}
+	}
+	servers := []string{}
+	for _, line := range strings.Split(string(bs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// Lease files of the DHCP clients, either written by dhclient or holding
+// DNS= lines like those of NetworkManager and systemd-networkd
+var dhcpLeaseGlobs = []string{
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/NetworkManager/dhclient-*.lease",
+	"/var/lib/NetworkManager/internal-*.lease",
+	"/run/systemd/netif/leases/*",
+}
+
+// DHCPNameservers returns the name servers handed out with the most recently
+// updated DHCP lease of the host
+func DHCPNameservers() []string {
+	var servers []string
+	var newest time.Time
+	for _, glob := range dhcpLeaseGlobs {
+		files, _ := filepath.Glob(glob)
+		for _, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil || fi.ModTime().Before(newest) {
+				continue
+			}
+			bs, err := ioutil.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			if ss := parseLeaseNameservers(string(bs)); len(ss) > 0 {
+				servers = ss
+				newest = fi.ModTime()
+			}
+		}
+	}
+	return servers
+}
+
+// parseLeaseNameservers returns the name servers of the last lease found in
+// the contents of a lease file
+func parseLeaseNameservers(data string) []string {
+	var servers []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		var list []string
+		if strings.HasPrefix(line, "option domain-name-servers ") {
+			line = strings.TrimSuffix(strings.TrimPrefix(line, "option domain-name-servers "), ";")
+			list = strings.Split(line, ",")
+		} else if strings.HasPrefix(line, "DNS=") {
+			list = strings.Fields(strings.TrimPrefix(line, "DNS="))
+		} else {
+			continue
+		}
+		servers = []string{}
+		for _, s := range list {
+			if s = strings.TrimSpace(s); net.ParseIP(s) != nil {
+				servers = append(servers, s)
+			}
+		}
+	}
+	return servers
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func testQuery(labels ...string) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1}
+	for _, l := range labels {
+		msg = append(msg, byte(len(l)))
+		msg = append(msg, l...)
+	}
+	msg = append(msg, 0, 0, 28, 0, 1)
+	// EDNS OPT record in the additional section
+	return append(msg, 0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestDNSQuestion(t *testing.T) {
+	msg := testQuery("WWW", "Example", "com")
+	name, qtype, qlen, err := dnsQuestion(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "www.example.com" || qtype != 28 || qlen != len(msg)-11 {
+		t.Errorf("dnsQuestion() = %s, %d, %d", name, qtype, qlen)
+	}
+
+	resp := dnsError(msg, qlen, dnsRcodeNXDomain)
+	if len(resp) != qlen || resp[0] != 0x12 || resp[1] != 0x34 {
+		t.Errorf("response does not match the query: %v", resp)
+	}
+	if resp[2] != 0x81 || resp[3] != 0x83 || resp[5] != 1 || resp[11] != 0 {
+		t.Errorf("unexpected response header: %v", resp[:dnsHeaderLen])
+	}
+	if _, _, _, err := dnsQuestion(resp); err == nil {
+		t.Errorf("a response was accepted as a query")
+	}
+
+	for _, bad := range [][]byte{
+		msg[:8],
+		msg[:20],
+		append(msg[:dnsHeaderLen:dnsHeaderLen], 0xc0, 0x0c, 0, 1, 0, 1),
+	} {
+		if _, _, _, err := dnsQuestion(bad); err == nil {
+			t.Errorf("malformed query accepted: %v", bad)
+		}
+	}
+}
+
+func TestDNSDomainAllowed(t *testing.T) {
+	allow := []string{"example.com", ".example.org."}
+	deny := []string{"ads.example.com"}
+	cases := map[string]bool{
+		"example.com":        true,
+		"www.example.com":    true,
+		"www.example.org":    true,
+		"ads.example.com":    false,
+		"x.ads.example.com":  false,
+		"badexample.com":     false,
+		"example.net":        false,
+		"com":                false,
+		"notads.example.com": true,
+	}
+	for name, want := range cases {
+		if got := DNSDomainAllowed(name, allow, deny); got != want {
+			t.Errorf("DNSDomainAllowed(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if !DNSDomainAllowed("example.net", nil, deny) || DNSDomainAllowed("ads.example.com", nil, deny) {
+		t.Errorf("deny list alone not applied as expected")
+	}
+}
+
+func TestParseLeaseNameservers(t *testing.T) {
+	dhclient := `lease {
+  interface "wlan0";
+  option domain-name-servers 10.0.0.1;
+}
+lease {
+  interface "wlan0";
+  option domain-name-servers 192.168.1.1, 192.168.1.2;
+  option domain-name "lan";
+}
+`
+	if ss := parseLeaseNameservers(dhclient); !reflect.DeepEqual(ss, []string{"192.168.1.1", "192.168.1.2"}) {
+		t.Errorf("dhclient lease: %v", ss)
+	}
+	internal := "ADDRESS=192.168.1.20\nDNS=9.9.9.9 bogus 2620:fe::fe\nROUTER=192.168.1.1\n"
+	if ss := parseLeaseNameservers(internal); !reflect.DeepEqual(ss, []string{"9.9.9.9", "2620:fe::fe"}) {
+		t.Errorf("DNS= lease: %v", ss)
+	}
+	if ss := parseLeaseNameservers("ADDRESS=192.168.1.20\n"); len(ss) != 0 {
+		t.Errorf("lease without name servers: %v", ss)
+	}
+}
+
+func TestDNSProxyRefused(t *testing.T) {
+	dp, err := NewDNSProxy([]net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, logging.MustGetLogger("test"))
+	if err != nil {
+		t.Skipf("unable to start DNS proxy: %v", err)
+	}
+	defer dp.Close()
+	if len(dp.IPs()) != 2 {
+		t.Skipf("DNS proxy only listening on %v", dp.IPs())
+	}
+	for _, ip := range dp.IPs() {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: dnsPort})
+		if err != nil {
+			t.Fatalf("unable to reach DNS proxy on %v: %v", ip, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write(testQuery("example", "com")); err != nil {
+			t.Fatalf("unable to send query to %v: %v", ip, err)
+		}
+		buf := make([]byte, dnsMaxMsgLen)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no response from DNS proxy on %v: %v", ip, err)
+		}
+		if n < dnsHeaderLen || buf[3]&0x0f != dnsRcodeRefused {
+			t.Errorf("query from unregistered address not refused on %v: %v", ip, buf[:n])
+		}
+	}
+}
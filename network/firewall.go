@@ -0,0 +1,390 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Path of the nftables utility programming the firewall of the sandboxes
+const nftPath = "/usr/sbin/nft"
+
+// Prefix of the names of the nftables tables of the sandboxes
+const fwTablePrefix = "oz_"
+
+// Families of the nftables tables of each sandbox
+var fwTableFamilies = []string{"inet", "bridge"}
+
+// FirewallRule allows or denies the traffic of a sandbox to some destinations
+type FirewallRule struct {
+	Allow   bool
+	Dst     []*net.IPNet // Destination networks, any destination if empty and Host is not set
+	Host    string       // Destination host name, whose addresses are kept in Dst
+	Proto   string       // One of tcp, udp, or empty for both
+	Port    int          // Destination port, any port if 0
+	PortEnd int          // Last port of the range starting at Port, if it is a range
+}
+
+// Firewall is the set of rules applied to the egress traffic of a sandbox.
+// Rules are matched in order, and the traffic they do not match is dropped
+// if DefaultDeny is set. DNS queries to other name servers than the bridge
+// are dropped before any rule if GatewayDNSOnly is set.
+type Firewall struct {
+	Addrs          []net.IP // Addresses of the sandbox
+	Gateways       []net.IP // Addresses of the bridge, whose DNS forwarder stays reachable
+	Rules          []FirewallRule
+	DefaultDeny    bool
+	GatewayDNSOnly bool
+	lock           sync.Mutex
+	stop           chan struct{} // Closed when the firewall is removed
+	stopped        bool
+}
+
+// ParseFirewallHost returns the networks matching a firewall destination
+// given as an address or a CIDR network, any destination for an empty one or
+// `*`. It returns false if the destination is a host name.
+func ParseFirewallHost(host string) ([]*net.IPNet, bool) {
+	if host == "" || host == "*" {
+		return nil, true
+	}
+	if _, n, err := net.ParseCIDR(host); err == nil {
+		return []*net.IPNet{n}, true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []*net.IPNet{hostNet(ip)}, true
+	}
+	return nil, false
+}
+
+// ValidFirewallHost checks that a firewall destination is an address, a
+// CIDR network or a well formed host name
+func ValidFirewallHost(host string) error {
+	if _, ok := ParseFirewallHost(host); ok {
+		return nil
+	}
+	if strings.Contains(host, "/") {
+		return fmt.Errorf("invalid CIDR network `%s`", host)
+	}
+	name := strings.TrimSuffix(host, ".")
+	if len(name) > 253 {
+		return fmt.Errorf("host name `%s` is too long", host)
+	}
+	for _, l := range strings.Split(name, ".") {
+		if !validHostLabel(l) {
+			return fmt.Errorf("invalid host name `%s`", host)
+		}
+	}
+	return nil
+}
+
+func validHostLabel(l string) bool {
+	if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+		return false
+	}
+	for _, c := range l {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// fwTableName returns the name of the table of the sandbox with address ip
+func fwTableName(ip net.IP) string {
+	r := strings.NewReplacer(".", "_", ":", "_")
+	return fwTablePrefix + r.Replace(ip.String())
+}
+
+// Apply resolves the host names of the rules and replaces the nftables table
+// of the sandbox with one holding the rules of the firewall, in a single
+// transaction. The table is only removed if the firewall has no rules and
+// allows everything. Host names are resolved again when their records expire
+// until the firewall is closed, and the table replaced if their addresses
+// changed.
+func (fw *Firewall) Apply(log *logging.Logger) error {
+	if len(fw.Addrs) == 0 {
+		return fmt.Errorf("firewall has no sandbox address")
+	}
+	if len(fw.Rules) == 0 && !fw.DefaultDeny && !fw.GatewayDNSOnly {
+		return RemoveFWRulesForIP(fw.Addrs[0])
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	ttl, err := fw.resolve()
+	if err != nil {
+		// The rules of the hosts which did not resolve match nothing
+		// until refresh manages to look them up
+		log.Warningf("Applying the firewall rules of %v without some of their hosts: %v", fw.Addrs[0], err)
+	}
+	if err := runNft(fw.ruleset()); err != nil {
+		return err
+	}
+	if ttl > 0 && fw.stop == nil {
+		fw.stop = make(chan struct{})
+		go fw.refresh(ttl, log)
+	}
+	return nil
+}
+
+// resolve looks up the addresses of the host names of the rules, keeping
+// the previous addresses of those which fail to resolve. It returns the time
+// until the addresses should be looked up again, or 0 without host names.
+func (fw *Firewall) resolve() (time.Duration, error) {
+	var next time.Duration
+	var errs []string
+	for i := range fw.Rules {
+		r := &fw.Rules[i]
+		if r.Host == "" {
+			continue
+		}
+		ips, ttl, err := LookupHostTTL(r.Host)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("unable to resolve firewall host %s: %v", r.Host, err))
+			ttl = resolveMinTTL
+		} else {
+			r.Dst = hostNets(ips)
+		}
+		if next == 0 || ttl < next {
+			next = ttl
+		}
+	}
+	if len(errs) > 0 {
+		return next, errors.New(strings.Join(errs, ", "))
+	}
+	return next, nil
+}
+
+func (fw *Firewall) refresh(next time.Duration, log *logging.Logger) {
+	for {
+		select {
+		case <-fw.stop:
+			return
+		case <-time.After(next):
+		}
+		fw.lock.Lock()
+		if fw.stopped {
+			fw.lock.Unlock()
+			return
+		}
+		before := fw.ruleset()
+		ttl, err := fw.resolve()
+		if err != nil {
+			log.Warningf("Keeping previous addresses of firewall hosts: %v", err)
+		}
+		if rs := fw.ruleset(); rs != before {
+			log.Infof("Addresses of firewall hosts of %v changed, updating its rules", fw.Addrs[0])
+			if err := runNft(rs); err != nil {
+				log.Warningf("Could not update firewall rules of %v: %v", fw.Addrs[0], err)
+			}
+		}
+		fw.lock.Unlock()
+		next = ttl
+	}
+}
+
+// Close stops resolving the host names of the rules again
+func (fw *Firewall) Close() {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if !fw.stopped && fw.stop != nil {
+		close(fw.stop)
+	}
+	fw.stopped = true
+}
+
+// hostNets returns the networks matching the addresses, sorted so that the
+// rules do not change when a name server rotates the records
+func hostNets(ips []net.IP) []*net.IPNet {
+	ns := []*net.IPNet{}
+	for _, ip := range ips {
+		ns = append(ns, hostNet(ip))
+	}
+	sort.Sort(netsByString(ns))
+	return ns
+}
+
+type netsByString []*net.IPNet
+
+func (n netsByString) Len() int           { return len(n) }
+func (n netsByString) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n netsByString) Less(i, j int) bool { return n[i].String() < n[j].String() }
+
+// ruleset returns the nftables script creating the tables of the sandbox,
+// deleting the previous ones first. Traffic routed by the host goes through
+// the inet table, while traffic between the sandboxes of a bridge is only
+// seen by the bridge table.
+func (fw *Firewall) ruleset() string {
+	name := fwTableName(fw.Addrs[0])
+	b := &bytes.Buffer{}
+	for _, family := range fwTableFamilies {
+		table := family + " " + name
+		fmt.Fprintf(b, "table %s\ndelete table %s\n", table, table)
+	}
+
+	fmt.Fprintf(b, "table inet %s {\n", name)
+	fw.writeRules(b)
+	fmt.Fprintf(b, "\tchain forward {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fw.writeJumps(b)
+	fmt.Fprintf(b, "\t}\n")
+
+	// Traffic to the host itself, which keeps answering neighbour
+	// discovery and DNS queries on the bridge
+	fmt.Fprintf(b, "\tchain input {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(b, "\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	for _, ip := range fw.Addrs {
+		for _, gw := range fw.Gateways {
+			if nftFamily(gw) == nftFamily(ip) {
+				fmt.Fprintf(b, "\t\t%s saddr %v %s daddr %v meta l4proto { tcp, udp } th dport 53 accept\n",
+					nftFamily(ip), ip, nftFamily(ip), gw)
+			}
+		}
+		fmt.Fprintf(b, "\t\t%s saddr %v jump rules\n", nftFamily(ip), ip)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+
+	// Traffic to the other sandboxes of the bridge, which is switched
+	// without going through the hooks of the inet family
+	fmt.Fprintf(b, "table bridge %s {\n", name)
+	fw.writeRules(b)
+	fmt.Fprintf(b, "\tchain forward {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(b, "\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	fw.writeJumps(b)
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+	return b.String()
+}
+
+// writeRules writes the chain holding the rules of the firewall
+func (fw *Firewall) writeRules(b *bytes.Buffer) {
+	fmt.Fprintf(b, "\tchain rules {\n")
+	fmt.Fprintf(b, "\t\tct state established,related accept\n")
+	if fw.GatewayDNSOnly {
+		fmt.Fprintf(b, "\t\tmeta l4proto { tcp, udp } th dport 53 drop\n")
+	}
+	for _, r := range fw.Rules {
+		for _, line := range r.nftRules() {
+			fmt.Fprintf(b, "\t\t%s\n", line)
+		}
+	}
+	if fw.DefaultDeny {
+		fmt.Fprintf(b, "\t\tdrop\n")
+	}
+	fmt.Fprintf(b, "\t}\n")
+}
+
+// writeJumps writes the rules sending the traffic of the sandbox to the
+// chain holding the rules of the firewall
+func (fw *Firewall) writeJumps(b *bytes.Buffer) {
+	for _, ip := range fw.Addrs {
+		fmt.Fprintf(b, "\t\t%s saddr %v jump rules\n", nftFamily(ip), ip)
+	}
+}
+
+// nftRules returns the nftables rules matching the rule, one for each
+// address family of its destinations
+func (r *FirewallRule) nftRules() []string {
+	verdict := "drop"
+	if r.Allow {
+		verdict = "accept"
+	}
+	ports := fmt.Sprint(r.Port)
+	if r.PortEnd > r.Port {
+		ports = fmt.Sprintf("%d-%d", r.Port, r.PortEnd)
+	}
+	match := ""
+	switch {
+	case r.Proto != "" && r.Port != 0:
+		match = fmt.Sprintf("%s dport %s ", r.Proto, ports)
+	case r.Proto != "":
+		match = fmt.Sprintf("meta l4proto %s ", r.Proto)
+	case r.Port != 0:
+		match = fmt.Sprintf("meta l4proto { tcp, udp } th dport %s ", ports)
+	}
+	if len(r.Dst) == 0 {
+		if r.Host != "" {
+			// A host name without addresses matches nothing
+			return nil
+		}
+		return []string{match + verdict}
+	}
+	dsts := map[string][]string{}
+	for _, n := range r.Dst {
+		f := nftFamily(n.IP)
+		dsts[f] = append(dsts[f], n.String())
+	}
+	rules := []string{}
+	for _, f := range []string{"ip", "ip6"} {
+		if len(dsts[f]) > 0 {
+			rules = append(rules, fmt.Sprintf("%s daddr { %s } %s%s", f, strings.Join(dsts[f], ", "), match, verdict))
+		}
+	}
+	return rules
+}
+
+func nftFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+func runNft(script string) error {
+	cmd := exec.Command(nftPath, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// RemoveFWRules removes the firewall of the sandbox. The table of its
+// address is deleted even if the firewall could not be applied again, since
+// a sandbox adopted after a restart of the daemon keeps its previous table.
+func (v *OzVeth) RemoveFWRules() error {
+	if v.fw != nil {
+		v.fw.Close()
+		v.fw = nil
+	}
+	if v.sbip == nil {
+		return nil
+	}
+	return RemoveFWRulesForIP(v.sbip)
+}
+
+// RemoveFWRulesForIP removes the firewall rules of the sandbox using address
+// src by deleting its tables, which is not an error if it has none or if
+// nftables is not installed.
+func RemoveFWRulesForIP(src net.IP) error {
+	if src == nil {
+		return fmt.Errorf("could not remove firewall rules of sandbox without address")
+	}
+	if _, err := os.Stat(nftPath); os.IsNotExist(err) {
+		return nil
+	}
+	script := ""
+	for _, family := range fwTableFamilies {
+		table := family + " " + fwTableName(src)
+		script += fmt.Sprintf("table %s\ndelete table %s\n", table, table)
+	}
+	return runNft(script)
+}
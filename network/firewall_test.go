@@ -0,0 +1,117 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFirewallHost(t *testing.T) {
+	cases := map[string][]string{
+		"":              nil,
+		"*":             nil,
+		"10.1.2.3":      {"10.1.2.3/32"},
+		"10.1.2.3/8":    {"10.0.0.0/8"},
+		"2001:db8::1":   {"2001:db8::1/128"},
+		"2001:db8::/32": {"2001:db8::/32"},
+	}
+	for host, want := range cases {
+		ns, ok := ParseFirewallHost(host)
+		if !ok {
+			t.Errorf("ParseFirewallHost(%s) failed", host)
+			continue
+		}
+		var got []string
+		for _, n := range ns {
+			got = append(got, n.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseFirewallHost(%s) = %v, want %v", host, got, want)
+		}
+	}
+
+	if _, ok := ParseFirewallHost("api.example.com"); ok {
+		t.Errorf("host name parsed as an address")
+	}
+	for _, host := range []string{"api.example.com", "example.com.", "_srv.example-1.org", "10.0.0.0/8"} {
+		if err := ValidFirewallHost(host); err != nil {
+			t.Errorf("ValidFirewallHost(%s) failed: %v", host, err)
+		}
+	}
+	for _, host := range []string{"10.0.0.0/33", "example..com", "-example.com", "exa mple.com", strings.Repeat("a", 64) + ".com"} {
+		if err := ValidFirewallHost(host); err == nil {
+			t.Errorf("ValidFirewallHost(%s) accepted an invalid host", host)
+		}
+	}
+}
+
+func TestFirewallRuleset(t *testing.T) {
+	dst, _ := ParseFirewallHost("10.0.0.0/8")
+	dst6, _ := ParseFirewallHost("2001:db8::1")
+	api := hostNets([]net.IP{net.ParseIP("192.0.2.20"), net.ParseIP("192.0.2.10")})
+	fw := &Firewall{
+		Addrs:    []net.IP{net.ParseIP("10.0.1.23"), net.ParseIP("fd00::5")},
+		Gateways: []net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("fd00::1")},
+		Rules: []FirewallRule{
+			{Allow: false, Dst: dst, Port: 25},
+			{Allow: true, Dst: append(dst, dst6...), Proto: "udp", Port: 443},
+			{Allow: true, Host: "api.example.com", Dst: api, Proto: "tcp", Port: 443},
+			{Allow: true, Host: "gone.example.com"},
+			{Allow: false, Proto: "udp", Port: 1000, PortEnd: 2000},
+			{Allow: true, Proto: "tcp"},
+		},
+		DefaultDeny: true,
+	}
+	rs := fw.ruleset()
+	if !strings.HasPrefix(rs, "table inet oz_10_0_1_23\ndelete table inet oz_10_0_1_23\n") {
+		t.Errorf("ruleset does not replace the previous table:\n%s", rs)
+	}
+	for _, line := range []string{
+		"\t\tct state established,related accept\n" +
+			"\t\tip daddr { 10.0.0.0/8 } meta l4proto { tcp, udp } th dport 25 drop\n" +
+			"\t\tip daddr { 10.0.0.0/8 } udp dport 443 accept\n" +
+			"\t\tip6 daddr { 2001:db8::1/128 } udp dport 443 accept\n" +
+			"\t\tip daddr { 192.0.2.10/32, 192.0.2.20/32 } tcp dport 443 accept\n" +
+			"\t\tudp dport 1000-2000 drop\n" +
+			"\t\tmeta l4proto tcp accept\n" +
+			"\t\tdrop\n",
+		"\t\tip saddr 10.0.1.23 jump rules\n\t\tip6 saddr fd00::5 jump rules\n",
+		"\t\tip saddr 10.0.1.23 ip daddr 10.0.1.1 meta l4proto { tcp, udp } th dport 53 accept\n",
+		"\t\tip6 saddr fd00::5 ip6 daddr fd00::1 meta l4proto { tcp, udp } th dport 53 accept\n",
+	} {
+		if !strings.Contains(rs, line) {
+			t.Errorf("ruleset does not contain:\n%s\n%s", line, rs)
+		}
+	}
+	i := strings.Index(rs, "table bridge oz_10_0_1_23 {")
+	if i < 0 {
+		t.Fatalf("ruleset has no bridge table:\n%s", rs)
+	}
+	bridge := rs[i:]
+	if !strings.Contains(rs, "table bridge oz_10_0_1_23\ndelete table bridge oz_10_0_1_23\n") ||
+		!strings.Contains(bridge, "\t\tudp dport 1000-2000 drop\n") ||
+		!strings.Contains(bridge, "type filter hook forward priority 0; policy accept;\n"+
+			"\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert } accept\n"+
+			"\t\tip saddr 10.0.1.23 jump rules\n\t\tip6 saddr fd00::5 jump rules\n") {
+		t.Errorf("traffic between sandboxes of the bridge not filtered:\n%s", rs)
+	}
+	if strings.Contains(rs, "ip saddr 10.0.1.23 ip6 daddr") || strings.Contains(rs, "ip6 saddr fd00::5 ip daddr") {
+		t.Errorf("gateway of another family used for sandbox address:\n%s", rs)
+	}
+	if strings.Contains(rs, "th dport 53 drop") {
+		t.Errorf("DNS queries restricted to the gateway:\n%s", rs)
+	}
+
+	fw.DefaultDeny = false
+	if rs := fw.ruleset(); strings.Contains(rs, "\t\tdrop\n") {
+		t.Errorf("traffic denied by default:\n%s", rs)
+	}
+
+	fw.GatewayDNSOnly = true
+	if rs := fw.ruleset(); !strings.Contains(rs, "\t\tct state established,related accept\n"+
+		"\t\tmeta l4proto { tcp, udp } th dport 53 drop\n"+
+		"\t\tip daddr { 10.0.0.0/8 } meta l4proto { tcp, udp } th dport 25 drop\n") {
+		t.Errorf("DNS queries not restricted to the gateway:\n%s", rs)
+	}
+}
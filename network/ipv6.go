@@ -0,0 +1,200 @@
+package network
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Path of the file identifying the host, from which its ULA prefix is derived
+const machineIdPath = "/etc/machine-id"
+
+// How long a neighbour solicitation waits for an advertisement
+const ndpTimeout = 150 * time.Millisecond
+
+// ICMPv6 neighbour discovery message types
+const (
+	icmp6NeighborSolicitation  = 135
+	icmp6NeighborAdvertisement = 136
+)
+
+// ulaPrefix returns the /48 unique local prefix (RFC 4193) whose global id is
+// derived from id, so that the sandboxes keep their prefix across restarts of
+// the daemon.
+func ulaPrefix(id []byte) *net.IPNet {
+	sum := sha1.Sum(id)
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	copy(ip[1:6], sum[len(sum)-5:])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(48, 128)}
+}
+
+// hostULAPrefix returns the ULA prefix of the host, or a random one if the
+// host has no machine id.
+func hostULAPrefix() *net.IPNet {
+	bs, err := ioutil.ReadFile(machineIdPath)
+	id := strings.TrimSpace(string(bs))
+	if err != nil || id == "" {
+		bs = make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, uint64(rand.Int63()))
+		return ulaPrefix(bs)
+	}
+	return ulaPrefix([]byte(id))
+}
+
+// ulaSubnet returns the /64 of the /48 prefix with the given subnet id
+func ulaSubnet(prefix *net.IPNet, subnet uint16) *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:6])
+	binary.BigEndian.PutUint16(ip[6:8], subnet)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+}
+
+// subnetULAPrefix returns the /48 prefix a subnet was allocated from
+func subnetULAPrefix(subnet *net.IPNet) *net.IPNet {
+	mask := net.CIDRMask(48, 128)
+	return &net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask}
+}
+
+// IPRange6 is an IPv6 /64 from which the addresses of the sandboxes are
+// drawn with random interface identifiers
+type IPRange6 struct {
+	*net.IPNet
+	inUse  map[string]bool
+	pinger pinger
+}
+
+func newIPRange6(ipnet *net.IPNet, iface string) *IPRange6 {
+	return newIPRange6WithPinger(ipnet, &ndpPinger{iface})
+}
+
+func newIPRange6WithPinger(ipnet *net.IPNet, pinger pinger) *IPRange6 {
+	return &IPRange6{
+		IPNet:  ipnet,
+		inUse:  make(map[string]bool),
+		pinger: pinger,
+	}
+}
+
+// FirstIP returns the address of the range ending with ::1, used by the bridge
+func (ipr *IPRange6) FirstIP() net.IP {
+	return ipr.addressOf(1)
+}
+
+// FreshIP returns an unused address of the range, or nil if every random
+// address tried answers to neighbour solicitations
+func (ipr *IPRange6) FreshIP() net.IP {
+	for i := 0; i < ozMaxRandTries; i++ {
+		iid := uint64(rand.Int63())<<1 ^ uint64(rand.Int63())
+		if iid <= 1 {
+			continue
+		}
+		ip := ipr.addressOf(iid)
+		if ipr.inUse[ip.String()] {
+			continue
+		}
+		ipr.inUse[ip.String()] = true
+		if ipr.pinger.ping(ip) {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
+
+// reserve marks ip as allocated so that it is not handed out again.
+// It returns false if ip is not an address of this IPRange6.
+func (ipr *IPRange6) reserve(ip net.IP) bool {
+	if ip.To4() != nil || !ipr.Contains(ip) {
+		return false
+	}
+	ipr.inUse[ip.String()] = true
+	return true
+}
+
+// release makes an allocated address available again
+func (ipr *IPRange6) release(ip net.IP) {
+	delete(ipr.inUse, ip.String())
+}
+
+func (ipr *IPRange6) addressOf(iid uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipr.IP.To16()[:8])
+	binary.BigEndian.PutUint64(ip[8:], iid)
+	return ip
+}
+
+// ndpPinger looks for hosts using an address with neighbour discovery, the
+// IPv6 counterpart of arpPinger
+type ndpPinger struct {
+	iface string
+}
+
+func (np *ndpPinger) ping(dst net.IP) bool {
+	ifc, err := net.InterfaceByName(np.iface)
+	if err != nil {
+		return false
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	// Neighbour discovery messages are dropped unless sent with a hop limit of 255
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifc.Index)
+	tv := syscall.NsecToTimeval(int64(ndpTimeout))
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(ifc.Index)}
+	copy(sa.Addr[:], solicitedNodeAddr(dst))
+	if err := syscall.Sendto(fd, neighborSolicitation(dst, ifc.HardwareAddr), 0, sa); err != nil {
+		return false
+	}
+	deadline := time.Now().Add(ndpTimeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return false
+		}
+		if isNeighborAdvertisement(buf[:n], dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// solicitedNodeAddr returns the multicast address listened to by the hosts
+// using ip
+func solicitedNodeAddr(ip net.IP) net.IP {
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip.To16()[13:])
+	return addr
+}
+
+// neighborSolicitation builds the ICMPv6 message asking for the link layer
+// address of target. The checksum is filled in by the kernel.
+func neighborSolicitation(target net.IP, hwaddr net.HardwareAddr) []byte {
+	msg := make([]byte, 8, 32)
+	msg[0] = icmp6NeighborSolicitation
+	msg = append(msg, target.To16()...)
+	if len(hwaddr) == 6 {
+		// Source link-layer address option
+		msg = append(msg, 1, 1)
+		msg = append(msg, hwaddr...)
+	}
+	return msg
+}
+
+// isNeighborAdvertisement returns true if msg is an ICMPv6 neighbour
+// advertisement for target
+func isNeighborAdvertisement(msg []byte, target net.IP) bool {
+	return len(msg) >= 24 && msg[0] == icmp6NeighborAdvertisement && msg[1] == 0 &&
+		net.IP(msg[8:24]).Equal(target)
+}
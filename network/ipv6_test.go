@@ -0,0 +1,96 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// pingerFunc answers the pings of a test range with a function
+type pingerFunc func(dst net.IP) bool
+
+func (f pingerFunc) ping(dst net.IP) bool {
+	return f(dst)
+}
+
+func TestULAPrefix(t *testing.T) {
+	p := ulaPrefix([]byte("0123456789abcdef0123456789abcdef"))
+	if p.IP[0] != 0xfd || p.String() != ulaPrefix([]byte("0123456789abcdef0123456789abcdef")).String() {
+		t.Errorf("unexpected ULA prefix %v", p)
+	}
+	if ones, bits := p.Mask.Size(); ones != 48 || bits != 128 {
+		t.Errorf("unexpected ULA prefix length %v", p)
+	}
+	if p.String() == ulaPrefix([]byte("fedcba9876543210fedcba9876543210")).String() {
+		t.Errorf("machine ids share ULA prefix %v", p)
+	}
+
+	_, prefix, _ := net.ParseCIDR("fd12:3456:789a::/48")
+	subnet := ulaSubnet(prefix, 0x2a)
+	if s := subnet.String(); s != "fd12:3456:789a:2a::/64" {
+		t.Errorf("ulaSubnet() = %s", s)
+	}
+	if s := subnetULAPrefix(subnet).String(); s != prefix.String() {
+		t.Errorf("subnetULAPrefix() = %s", s)
+	}
+}
+
+func TestFreshIP6(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("fd12:3456:789a:1::/64")
+	pinged := 0
+	ipr := newIPRange6WithPinger(ipnet, pingerFunc(func(dst net.IP) bool {
+		pinged++
+		return pinged == 1
+	}))
+	if s := ipr.FirstIP().String(); s != "fd12:3456:789a:1::1" {
+		t.Errorf("FirstIP() = %s", s)
+	}
+	ip := ipr.FreshIP()
+	if ip == nil || !ipnet.Contains(ip) || ip.Equal(ipr.FirstIP()) {
+		t.Fatalf("FreshIP() = %v", ip)
+	}
+	if pinged != 2 {
+		t.Errorf("address answering neighbour solicitations not skipped")
+	}
+
+	ipr = newIPRange6WithPinger(ipnet, pingerFunc(func(net.IP) bool { return true }))
+	if ip := ipr.FreshIP(); ip != nil {
+		t.Errorf("FreshIP() returned %v though every address is used", ip)
+	}
+
+	if ipr.reserve(net.ParseIP("fd12:3456:789a:2::5")) || ipr.reserve(net.ParseIP("10.0.0.5")) {
+		t.Errorf("address outside of the range reserved")
+	}
+	ip = net.ParseIP("fd12:3456:789a:1::5")
+	if !ipr.reserve(ip) || !ipr.inUse[ip.String()] {
+		t.Errorf("address of the range not reserved")
+	}
+	ipr.release(ip)
+	if ipr.inUse[ip.String()] {
+		t.Errorf("address not released")
+	}
+}
+
+func TestNeighborDiscovery(t *testing.T) {
+	target := net.ParseIP("fd12:3456:789a:1:aabb:ccdd:ee01:2345")
+	if s := solicitedNodeAddr(target).String(); s != "ff02::1:ff01:2345" {
+		t.Errorf("solicitedNodeAddr() = %s", s)
+	}
+
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	ns := neighborSolicitation(target, hw)
+	if len(ns) != 32 || ns[0] != icmp6NeighborSolicitation || !bytes.Equal(ns[8:24], target) || !bytes.Equal(ns[26:], hw) {
+		t.Errorf("unexpected neighbour solicitation %v", ns)
+	}
+	if ns := neighborSolicitation(target, nil); len(ns) != 24 {
+		t.Errorf("neighbour solicitation without link layer address has length %d", len(ns))
+	}
+
+	na := append([]byte{icmp6NeighborAdvertisement, 0, 0, 0, 0x60, 0, 0, 0}, target...)
+	if !isNeighborAdvertisement(na, target) {
+		t.Errorf("neighbour advertisement not recognized")
+	}
+	if isNeighborAdvertisement(na, net.ParseIP("fd12:3456:789a:1::2")) || isNeighborAdvertisement(ns, target) || isNeighborAdvertisement(na[:20], target) {
+		t.Errorf("unexpected message accepted as neighbour advertisement")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	//Builtin
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	// Internal
@@ -43,3 +44,24 @@ func setupLoopback() error {
 
 	return nil
 }
+
+// Sysctl files disabling IPv6 on the interfaces of the network namespace
+var disableIPv6Paths = []string{
+	"/proc/sys/net/ipv6/conf/all/disable_ipv6",
+	"/proc/sys/net/ipv6/conf/default/disable_ipv6",
+}
+
+// DisableIPv6 turns IPv6 off in the network namespace of the calling process,
+// including on the interfaces moved into it later.
+func DisableIPv6() error {
+	for _, p := range disableIPv6Paths {
+		if err := ioutil.WriteFile(p, []byte("1\n"), 0644); err != nil {
+			if os.IsNotExist(err) {
+				// IPv6 is not supported by the kernel
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
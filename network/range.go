@@ -1,6 +1,7 @@
 package network
 
 import (
+	"fmt"
 	"github.com/j-keck/arping"
 	"math/rand"
 	"net"
@@ -30,8 +31,10 @@ func init() {
 type IPRange struct {
 	*net.IPNet
 	inUse  []bool
-	first  uint32 // first usable IP address in the range
-	size   int    // number of usable addresses in the range
+	first  uint32         // first usable IP address in the range
+	size   int            // number of usable addresses in the range
+	owners map[int]string // names of the profiles using the allocated addresses, by offset
+	static map[int]string // offsets kept for the static addresses of profiles, to their names
 	pinger pinger
 }
 
@@ -49,6 +52,8 @@ func newIPRangeWithPinger(ipnet *net.IPNet, pinger pinger) *IPRange {
 		first:  firstIP(ipnet),
 		inUse:  inUse,
 		size:   sz,
+		owners: make(map[int]string),
+		static: make(map[int]string),
 		pinger: pinger,
 	}
 }
@@ -108,7 +113,7 @@ func (ipr *IPRange) availableAt(offset int) net.IP {
 	if offset < 0 || offset >= ipr.size {
 		return nil
 	}
-	if ipr.inUse[offset] {
+	if _, ok := ipr.static[offset]; ok || ipr.inUse[offset] {
 		return nil
 	}
 	ip := ipr.usableAt(offset)
@@ -120,6 +125,86 @@ func (ipr *IPRange) availableAt(offset int) net.IP {
 	return ip
 }
 
+// reserve marks ip as allocated so that it is not handed out again.
+// It returns false if ip is not a usable address of this IPRange.
+func (ipr *IPRange) reserve(ip net.IP) bool {
+	offset, ok := ipr.offsetOf(ip)
+	if !ok {
+		return false
+	}
+	ipr.inUse[offset] = true
+	return true
+}
+
+// release makes an allocated address available again
+func (ipr *IPRange) release(ip net.IP) {
+	if offset, ok := ipr.offsetOf(ip); ok && offset > 0 {
+		ipr.inUse[offset] = false
+		delete(ipr.owners, offset)
+	}
+}
+
+// setOwner records the name of the profile using an allocated address
+func (ipr *IPRange) setOwner(ip net.IP, owner string) {
+	if offset, ok := ipr.offsetOf(ip); ok {
+		ipr.owners[offset] = owner
+	}
+}
+
+// reserveStatic keeps the static addresses of profiles, given by last byte
+// along with the profile names, from being handed out by FreshIP
+func (ipr *IPRange) reserveStatic(bytes map[uint]string) {
+	ipr.static = make(map[int]string)
+	for b, owner := range bytes {
+		if offset, ok := ipr.staticOffset(b); ok {
+			ipr.static[offset] = owner
+		}
+	}
+}
+
+// staticIP allocates to owner the address of the range ending with byte b.
+// It fails if that address is not usable, is already allocated or answers
+// to ARP requests.
+func (ipr *IPRange) staticIP(b uint, owner string) (net.IP, error) {
+	offset, ok := ipr.staticOffset(b)
+	if !ok || offset == 0 {
+		return nil, fmt.Errorf("ip byte %d is not usable in range %v", b, ipr.IPNet)
+	}
+	ip := ipr.usableAt(offset)
+	if ipr.inUse[offset] {
+		if o := ipr.owners[offset]; o != "" {
+			return nil, fmt.Errorf("address %v is already used by a sandbox of %s", ip, o)
+		}
+		return nil, fmt.Errorf("address %v is already in use", ip)
+	}
+	if ipr.pinger.ping(ip) {
+		return nil, fmt.Errorf("address %v is already used by another host", ip)
+	}
+	ipr.inUse[offset] = true
+	ipr.owners[offset] = owner
+	return ip, nil
+}
+
+// staticOffset returns the offset of the address of the range whose last
+// byte is b
+func (ipr *IPRange) staticOffset(b uint) (int, bool) {
+	if b > 255 {
+		return 0, false
+	}
+	return ipr.offsetOf(toIP(toUint32(ipr.IP)&^0xff | uint32(b)))
+}
+
+func (ipr *IPRange) offsetOf(ip net.IP) (int, bool) {
+	if ip.To4() == nil || !ipr.Contains(ip) {
+		return 0, false
+	}
+	offset := int(toUint32(ip)) - int(ipr.first)
+	if offset < 0 || offset >= ipr.size {
+		return 0, false
+	}
+	return offset, true
+}
+
 // usableAt returns an IPv4 address from this IPRange at offset
 // from the first usable address in the range.  If offset is
 // negative or greater or equal to number of usable addresses
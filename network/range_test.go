@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -66,6 +67,21 @@ func TestFreshIP(t *testing.T) {
 		newTestRange("192.168.1.0/28", "192.168.1.3", "192.168.1.8").FreshIP)
 }
 
+func TestReserve(t *testing.T) {
+	r := newTestRange("192.168.1.0/29")
+	for _, s := range []string{"192.168.1.2", "192.168.1.4", "192.168.1.5"} {
+		if !r.reserve(net.ParseIP(s)) {
+			t.Errorf("failed to reserve %s", s)
+		}
+	}
+	for _, s := range []string{"192.168.1.0", "192.168.1.7", "192.168.2.3"} {
+		if r.reserve(net.ParseIP(s)) {
+			t.Errorf("reserved %s which is not a usable address of the range", s)
+		}
+	}
+	runRangeTest(t, []byte{3, 6}, r.scanIP)
+}
+
 var firstIPTestData = []struct {
 	cidr  string
 	first net.IP
@@ -137,3 +153,40 @@ func TestToIP(t *testing.T) {
 		}
 	}
 }
+
+func TestStaticIP(t *testing.T) {
+	r := newTestRange("192.168.1.0/24", "192.168.1.20")
+	ip, err := r.staticIP(10, "a")
+	if err != nil || !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Fatalf("staticIP(10) = %v, %v", ip, err)
+	}
+	if _, err := r.staticIP(10, "b"); err == nil || !strings.Contains(err.Error(), "used by a sandbox of a") {
+		t.Errorf("collision with profile a not reported: %v", err)
+	}
+	r.reserve(net.ParseIP("192.168.1.11"))
+	for _, b := range []uint{0, 1, 11, 20, 255, 256} {
+		if ip, err := r.staticIP(b, "b"); err == nil {
+			t.Errorf("staticIP(%d) = %v, expected an error", b, ip)
+		}
+	}
+	r.release(ip)
+	if ip, err := r.staticIP(10, "b"); err != nil || ip[3] != 10 {
+		t.Errorf("staticIP(10) after release = %v, %v", ip, err)
+	}
+}
+
+func TestReserveStatic(t *testing.T) {
+	r := newTestRange("192.168.1.0/28", "192.168.1.8")
+	r.reserveStatic(map[uint]string{3: "a", 5: "b", 200: "c"})
+	runRangeTest(t, []byte{2, 4, 6, 7, 9, 10, 11, 12, 13, 14}, r.scanIP)
+	if ip := r.scanIP(); ip != nil {
+		t.Errorf("static address %v handed out by scanIP", ip)
+	}
+	for _, b := range []uint{3, 5} {
+		if ip, err := r.staticIP(b, "a"); err != nil || ip[3] != byte(b) {
+			t.Errorf("staticIP(%d) = %v, %v", b, ip, err)
+		}
+	}
+	r.release(net.ParseIP("192.168.1.4"))
+	runRangeTest(t, []byte{4}, r.scanIP)
+}
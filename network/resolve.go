@@ -0,0 +1,189 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Types of the address records
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// Bounds of the time the addresses of a host name are kept before it is
+// resolved again, whatever the TTL of its records
+const (
+	resolveMinTTL = 30 * time.Second
+	resolveMaxTTL = time.Hour
+)
+
+var errDNSResponse = errors.New("malformed DNS response")
+
+// LookupHostTTL resolves the IPv4 and IPv6 addresses of name with the name
+// servers of the host. It also returns how long the addresses may be kept,
+// the lowest TTL of their records within resolveMinTTL and resolveMaxTTL.
+// Names the name servers do not know are resolved like any other name of the
+// host, with /etc/hosts and the search domains, and kept for resolveMinTTL.
+func LookupHostTTL(name string) ([]net.IP, time.Duration, error) {
+	ips, ttl, err := lookupHostDNS(name)
+	if err == nil {
+		return ips, ttl, nil
+	}
+	ips, lerr := net.LookupIP(name)
+	if lerr != nil || len(ips) == 0 {
+		return nil, 0, err
+	}
+	return ips, resolveMinTTL, nil
+}
+
+func lookupHostDNS(name string) ([]net.IP, time.Duration, error) {
+	servers := ResolvConfNameservers(hostResolvConf)
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no name servers found in %s", hostResolvConf)
+	}
+	ips := []net.IP{}
+	ttl := resolveMaxTTL
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		as, t, err := lookupRecords(servers, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips = append(ips, as...)
+		if len(as) > 0 && t < ttl {
+			ttl = t
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, fmt.Errorf("no address found for %s", name)
+	}
+	if ttl < resolveMinTTL {
+		ttl = resolveMinTTL
+	}
+	return ips, ttl, nil
+}
+
+// lookupRecords asks the name servers in turn for the address records of
+// name of type qtype, over TCP when the answer does not fit in UDP
+func lookupRecords(servers []string, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	msg, err := dnsQuery(uint16(rand.Intn(0x10000)), name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, s := range servers {
+		resp, err := forwardDNS(s, msg, "udp")
+		if err == nil && resp[2]&0x02 != 0 {
+			resp, err = forwardDNS(s, msg, "tcp")
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dnsAnswers(resp, qtype)
+	}
+	return nil, 0, lastErr
+}
+
+// dnsQuery builds a recursive query for the records of name of type qtype
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l == "" || len(l) > 63 {
+			return nil, fmt.Errorf("invalid host name %s", name)
+		}
+		msg = append(msg, byte(len(l)))
+		msg = append(msg, l...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	return msg, nil
+}
+
+// dnsAnswers returns the addresses of the records of type qtype found in the
+// answer section of a response, along with their lowest TTL
+func dnsAnswers(resp []byte, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(resp) < dnsHeaderLen || resp[2]&0x80 == 0 {
+		return nil, 0, errDNSResponse
+	}
+	switch rcode := resp[3] & 0x0f; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, 0, errors.New("no such host")
+	default:
+		return nil, 0, fmt.Errorf("name server returned error code %d", rcode)
+	}
+	off := dnsHeaderLen
+	for i := binary.BigEndian.Uint16(resp[4:]); i > 0; i-- {
+		n, err := skipDNSName(resp, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = n + 4
+	}
+	ips := []net.IP{}
+	var ttl time.Duration
+	for i := binary.BigEndian.Uint16(resp[6:]); i > 0; i-- {
+		n, err := skipDNSName(resp, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n+10 > len(resp) {
+			return nil, 0, errDNSResponse
+		}
+		rtype := binary.BigEndian.Uint16(resp[n:])
+		class := binary.BigEndian.Uint16(resp[n+2:])
+		rttl := time.Duration(binary.BigEndian.Uint32(resp[n+4:])) * time.Second
+		rlen := int(binary.BigEndian.Uint16(resp[n+8:]))
+		off = n + 10 + rlen
+		if off > len(resp) {
+			return nil, 0, errDNSResponse
+		}
+		// Records of the aliases of the name are skipped, their targets
+		// follow in the same answer
+		if rtype != qtype || class != 1 || (rlen != net.IPv4len && rlen != net.IPv6len) {
+			continue
+		}
+		ips = append(ips, net.IP(append([]byte{}, resp[n+10:off]...)))
+		if len(ips) == 1 || rttl < ttl {
+			ttl = rttl
+		}
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset following the possibly compressed name
+// starting at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSResponse
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, errDNSResponse
+			}
+			return off + 2, nil
+		case n > 63:
+			return 0, errDNSResponse
+		}
+		off += 1 + n
+	}
+}
@@ -0,0 +1,55 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testAnswer(qtype uint16, ttl byte, rdata ...byte) []byte {
+	rr := []byte{0xc0, 0x0c, byte(qtype >> 8), byte(qtype), 0, 1, 0, 0, 0, ttl, 0, byte(len(rdata))}
+	return append(rr, rdata...)
+}
+
+func TestDNSAnswers(t *testing.T) {
+	q, err := dnsQuery(0x1234, "api.example.com.", dnsTypeA)
+	if err != nil {
+		t.Fatalf("dnsQuery() failed: %v", err)
+	}
+	if name, qtype, qlen, err := dnsQuestion(q); err != nil || name != "api.example.com" || qtype != dnsTypeA || qlen != len(q) {
+		t.Errorf("dnsQuestion(dnsQuery()) = %s, %d, %d, %v", name, qtype, qlen, err)
+	}
+	if _, err := dnsQuery(1, "example..com", dnsTypeA); err == nil {
+		t.Errorf("query built for invalid name")
+	}
+
+	resp := append([]byte{}, q...)
+	resp[2] |= 0x80
+	resp[7] = 3
+	// An alias of the name, followed by the addresses of its target
+	resp = append(resp, testAnswer(5, 200, 0xc0, 0x0c)...)
+	resp = append(resp, testAnswer(dnsTypeA, 120, 192, 0, 2, 10)...)
+	resp = append(resp, testAnswer(dnsTypeA, 60, 192, 0, 2, 20)...)
+	ips, ttl, err := dnsAnswers(resp, dnsTypeA)
+	if err != nil {
+		t.Fatalf("dnsAnswers() failed: %v", err)
+	}
+	want := []net.IP{net.ParseIP("192.0.2.10").To4(), net.ParseIP("192.0.2.20").To4()}
+	if !reflect.DeepEqual(ips, want) || ttl != 60*time.Second {
+		t.Errorf("dnsAnswers() = %v, %v", ips, ttl)
+	}
+
+	if _, _, err := dnsAnswers(resp[:len(resp)-2], dnsTypeA); err == nil {
+		t.Errorf("truncated response accepted")
+	}
+	if _, _, err := dnsAnswers(q, dnsTypeA); err == nil {
+		t.Errorf("query accepted as a response")
+	}
+	nx := append([]byte{}, q...)
+	nx[2] |= 0x80
+	nx[3] = dnsRcodeNXDomain
+	if _, _, err := dnsAnswers(nx, dnsTypeA); err == nil {
+		t.Errorf("non-existent domain not reported")
+	}
+}
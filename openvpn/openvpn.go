@@ -3,6 +3,7 @@ package openvpn
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -15,7 +16,9 @@ import (
 	"github.com/subgraph/oz"
 )
 
-func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runtoken string) (cmd *exec.Cmd, err error) {
+// StartOpenVPN starts openvpn with its output written to stderr, or to the
+// standard error of the caller if nil
+func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runtoken string, stderr io.Writer) (cmd *exec.Cmd, err error) {
 
 	confFile := path.Join(c.OpenVPNConfDir, conf)
 	cmdArgs, err := parseOpenVPNConf(c, confFile, ip, table, dev, auth, runtoken)
@@ -27,6 +30,10 @@ func StartOpenVPN(c *oz.Config, conf string, ip *net.IP, table, dev, auth, runto
 	runcmd := exec.Command("/usr/sbin/openvpn", cmdArgs...)
 	runcmd.Stdin = os.Stdin
 	runcmd.Stderr = os.Stderr
+	if stderr != nil {
+		runcmd.Stdout = stderr
+		runcmd.Stderr = stderr
+	}
 
 	ovpngroup, err := user.LookupGroup(c.OpenVPNGroup)
 	if err != nil {
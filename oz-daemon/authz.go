@@ -0,0 +1,192 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+)
+
+// caller describes the peer of a control socket connection.
+type caller struct {
+	cred   *syscall.Ucred
+	name   string
+	groups []string
+}
+
+func (d *daemonState) loadPolicy() (*oz.Policy, error) {
+	policy, err := oz.LoadPolicy(d.config.PolicyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			d.log.Info("Policy file (%s) is missing, using defaults.", d.config.PolicyPath)
+			return oz.NewDefaultPolicy(), nil
+		}
+		return nil, err
+	}
+	return policy, nil
+}
+
+// lookupCaller resolves the user name and the group names of the sender of a message.
+func (d *daemonState) lookupCaller(cred *syscall.Ucred) *caller {
+	c := &caller{cred: cred}
+	gids := []string{strconv.FormatUint(uint64(cred.Gid), 10)}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10)); err != nil {
+		d.Warning("Unable to look up user for uid %d: %v", cred.Uid, err)
+	} else {
+		c.name = u.Username
+		if ids, err := u.GroupIds(); err == nil {
+			gids = append(gids, ids...)
+		}
+	}
+	for _, gid := range gids {
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			continue
+		}
+		for name, g := range d.systemGroups {
+			if g.Gid == uint32(id) {
+				c.groups = append(c.groups, name)
+			}
+		}
+	}
+	return c
+}
+
+func (c *caller) owns(sbox *Sandbox) bool {
+	return sbox.cred != nil && sbox.cred.Uid == c.cred.Uid
+}
+
+// owner returns the name of the user who launched the sandbox
+func (sbox *Sandbox) owner() string {
+	if sbox.user != nil {
+		return sbox.user.Username
+	}
+	return strconv.FormatUint(uint64(sbox.cred.Uid), 10)
+}
+
+// authorize is consulted by the control socket server before dispatching a
+// message, rejected messages are logged and answered with an error.
+func (d *daemonState) authorize(m *ipc.Message) error {
+	if m.Ucred == nil {
+		err := errors.New("no credentials received")
+		d.logDenied(m, nil, err)
+		m.Respond(&ErrorMsg{"Permission denied: " + err.Error()})
+		return err
+	}
+	c := d.lookupCaller(m.Ucred)
+	err := d.authorizeMessage(c, m)
+	if err != nil {
+		d.logDenied(m, c, err)
+		m.Respond(&ErrorMsg{"Permission denied: " + err.Error()})
+	}
+	return err
+}
+
+// authorizeMessage decides whether the caller may send the message, only the
+// messages listed here are accepted.
+func (d *daemonState) authorizeMessage(c *caller, m *ipc.Message) error {
+	var err error
+	switch msg := m.Body.(type) {
+	case *PingMsg, *GetConfigMsg, *ListProfilesMsg, *GetProfileMsg, *IsRunningMsg,
+		*ListSandboxesMsg, *ListBridgesMsg, *ListProxiesMsg:
+		// Open to anyone, ListSandboxesMsg only lists the sandboxes
+		// of the caller
+	case *LaunchMsg:
+		err = d.authorizeLaunch(c, msg)
+	case *KillSandboxMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *RelaunchXpraClientMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *MountFilesMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *UnmountFileMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *ListForwardersMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *AskForwarderMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *SandboxUsageMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *SubscribeMsg:
+		err = d.authorizeSandbox(c, msg.Id)
+	case *LogsMsg, *ReloadMsg, *ListRecordingsMsg, *ExportRecordingMsg:
+		err = d.authorizeAdmin(c)
+	default:
+		// Replies and messages added without a rule
+		err = fmt.Errorf("message %s is not accepted by the daemon", m.Type)
+	}
+	return err
+}
+
+func (d *daemonState) authorizeAdmin(c *caller) error {
+	if d.policy.IsAdmin(c.name, c.groups) {
+		return nil
+	}
+	return errors.New("not an administrator")
+}
+
+func (d *daemonState) authorizeLaunch(c *caller, msg *LaunchMsg) error {
+	p, err := d.getProfileFromLaunchMsg(msg)
+	if err != nil {
+		// Reported by the handler
+		return nil
+	}
+	if !d.policy.CanLaunch(p.Name, c.name, c.groups) {
+		return fmt.Errorf("not allowed to launch profile `%s`", p.Name)
+	}
+	return nil
+}
+
+// authorizeSandbox allows acting on a sandbox to its owner and to the
+// administrators. An id of -1 stands for all the sandboxes of the caller
+// and is scoped by the handlers.
+func (d *daemonState) authorizeSandbox(c *caller, id int) error {
+	if id == -1 || d.authorizeAdmin(c) == nil {
+		return nil
+	}
+	if sbox := d.sandboxById(id); sbox != nil && !c.owns(sbox) {
+		return fmt.Errorf("sandbox %d is owned by another user", sbox.id)
+	}
+	return nil
+}
+
+// sandboxesFor returns the running sandboxes the sender of a message may act
+// on: all of them for an administrator, the ones it owns otherwise.
+func (d *daemonState) sandboxesFor(cred *syscall.Ucred) []*Sandbox {
+	c := d.lookupCaller(cred)
+	if d.authorizeAdmin(c) == nil {
+		return d.sandboxes
+	}
+	sboxes := []*Sandbox{}
+	for _, sb := range d.sandboxes {
+		if c.owns(sb) {
+			sboxes = append(sboxes, sb)
+		}
+	}
+	return sboxes
+}
+
+// sandboxByIdFor is like sandboxById but does not return sandboxes the
+// sender of a message may not act on.
+func (d *daemonState) sandboxByIdFor(id int, cred *syscall.Ucred) *Sandbox {
+	for _, sb := range d.sandboxesFor(cred) {
+		if sb.id == id {
+			return sb
+		}
+	}
+	return nil
+}
+
+func (d *daemonState) logDenied(m *ipc.Message, c *caller, err error) {
+	if c == nil {
+		d.Warning("authorization denied: msg=%s reason=%q", m.Type, err)
+		return
+	}
+	d.Warning("authorization denied: msg=%s uid=%d gid=%d pid=%d user=%q reason=%q",
+		m.Type, c.cred.Uid, c.cred.Gid, c.cred.Pid, c.name, err)
+}
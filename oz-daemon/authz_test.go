@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+
+	"github.com/op/go-logging"
+)
+
+func newTestDaemon() *daemonState {
+	return &daemonState{
+		policy: &oz.Policy{
+			Admins: oz.PolicySubjects{Users: []string{"admin"}, Groups: []string{"wheel"}},
+			Launch: []oz.LaunchRule{
+				{Profiles: []string{"fire*"}, PolicySubjects: oz.PolicySubjects{Users: []string{"alice"}}},
+			},
+		},
+		profiles: oz.Profiles{
+			&oz.Profile{Name: "firefox", Path: "/usr/bin/firefox"},
+			&oz.Profile{Name: "vlc", Path: "/usr/bin/vlc"},
+		},
+		sandboxes: []*Sandbox{
+			{id: 1, cred: &syscall.Credential{Uid: 1000}},
+			{id: 2, cred: &syscall.Credential{Uid: 1001}},
+		},
+	}
+}
+
+func TestAuthorizeMessage(t *testing.T) {
+	d := newTestDaemon()
+	alice := &caller{cred: &syscall.Ucred{Uid: 1000}, name: "alice"}
+	bob := &caller{cred: &syscall.Ucred{Uid: 1001}, name: "bob"}
+	admin := &caller{cred: &syscall.Ucred{Uid: 1002}, name: "admin"}
+	carol := &caller{cred: &syscall.Ucred{Uid: 1003}, name: "carol", groups: []string{"wheel"}}
+
+	cases := []struct {
+		c    *caller
+		body interface{}
+		ok   bool
+	}{
+		{alice, &PingMsg{}, true},
+		{alice, &ListProfilesMsg{}, true},
+		{alice, &ListSandboxesMsg{}, true},
+		{alice, &OkMsg{}, false},
+		{alice, &EventMsg{}, false},
+		{alice, &LaunchMsg{Name: "firefox"}, true},
+		{alice, &LaunchMsg{Path: "/usr/bin/firefox"}, true},
+		{alice, &LaunchMsg{Name: "vlc"}, false},
+		{bob, &LaunchMsg{Name: "firefox"}, false},
+		{bob, &LaunchMsg{Name: "missing"}, true},
+		{alice, &KillSandboxMsg{Id: 1}, true},
+		{alice, &KillSandboxMsg{Id: 2}, false},
+		{alice, &KillSandboxMsg{Id: -1}, true},
+		{alice, &KillSandboxMsg{Id: 42}, true},
+		{alice, &MountFilesMsg{Id: 2}, false},
+		{alice, &SubscribeMsg{Id: 2}, false},
+		{admin, &KillSandboxMsg{Id: 2}, true},
+		{carol, &SandboxUsageMsg{Id: 1}, true},
+		{alice, &LogsMsg{}, false},
+		{alice, &ReloadMsg{}, false},
+		{admin, &ReloadMsg{}, true},
+		{carol, &ExportRecordingMsg{}, true},
+	}
+	for _, tc := range cases {
+		m := &ipc.Message{Type: "test", Body: tc.body}
+		err := d.authorizeMessage(tc.c, m)
+		if tc.ok && err != nil {
+			t.Errorf("%T %+v from %s denied: %v", tc.body, tc.body, tc.c.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%T %+v from %s allowed", tc.body, tc.body, tc.c.name)
+		}
+	}
+}
+
+func TestAuthorizeSandbox(t *testing.T) {
+	d := newTestDaemon()
+	cases := []struct {
+		c  *caller
+		id int
+		ok bool
+	}{
+		{&caller{cred: &syscall.Ucred{Uid: 1000}}, 1, true},
+		{&caller{cred: &syscall.Ucred{Uid: 1000}}, 2, false},
+		{&caller{cred: &syscall.Ucred{Uid: 1001}}, 2, true},
+		{&caller{cred: &syscall.Ucred{Uid: 1001}}, -1, true},
+		{&caller{cred: &syscall.Ucred{Uid: 1004}}, 1, false},
+		{&caller{cred: &syscall.Ucred{Uid: 1004}, name: "admin"}, 1, true},
+		{&caller{cred: &syscall.Ucred{Uid: 1004}, groups: []string{"wheel"}}, 2, true},
+	}
+	for _, tc := range cases {
+		err := d.authorizeSandbox(tc.c, tc.id)
+		if tc.ok != (err == nil) {
+			t.Errorf("authorizeSandbox(uid %d, %q, %v, %d) = %v", tc.c.cred.Uid, tc.c.name, tc.c.groups, tc.id, err)
+		}
+	}
+}
+
+func TestSandboxesFor(t *testing.T) {
+	d := newTestDaemon()
+	d.log = logging.MustGetLogger("oz-test")
+	// Unknown uids are warned about
+	logging.SetLevel(logging.ERROR, "oz-test")
+	d.policy.Admins.Users = []string{"root"}
+	ids := func(sboxes []*Sandbox) []int {
+		r := []int{}
+		for _, sb := range sboxes {
+			r = append(r, sb.id)
+		}
+		return r
+	}
+
+	cases := []struct {
+		uid  uint32
+		want []int
+	}{
+		{0, []int{1, 2}},
+		{1000, []int{1}},
+		{1001, []int{2}},
+		{4000001, []int{}},
+	}
+	for _, tc := range cases {
+		cred := &syscall.Ucred{Uid: tc.uid, Gid: tc.uid}
+		got := ids(d.sandboxesFor(cred))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sandboxesFor(uid %d) = %v, expected %v", tc.uid, got, tc.want)
+		}
+		for _, id := range []int{1, 2} {
+			owned := false
+			for _, w := range tc.want {
+				owned = owned || w == id
+			}
+			if sb := d.sandboxByIdFor(id, cred); (sb != nil) != owned {
+				t.Errorf("sandboxByIdFor(%d, uid %d) = %v", id, tc.uid, sb)
+			}
+		}
+	}
+}
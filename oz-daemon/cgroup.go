@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/subgraph/oz"
+)
+
+// Controllers enabled for the cgroups of the sandboxes
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// Period used to express the CPU quota of a sandbox, in microseconds
+const cgroupCPUPeriod = 100000
+
+func (sbox *Sandbox) cgroupName() string {
+	return fmt.Sprintf("%s-%d", sbox.profile.Name, sbox.id)
+}
+
+// ensureCgroupRoot creates the parent cgroup of the sandboxes and enables the
+// controllers needed to apply limits to its children
+func (d *daemonState) ensureCgroupRoot() error {
+	root := d.config.CgroupPath
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	for _, dir := range []string{path.Dir(root), root} {
+		for _, c := range cgroupControllers {
+			// Controllers unavailable on this system are skipped
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+c); err != nil {
+				d.Debug("Unable to enable cgroup controller %s in %s: %v", c, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setupCgroup creates the cgroup of the sandbox, applies the limits of its
+// profile and moves the init process into it. Children forked by oz-init
+// afterwards inherit the cgroup.
+func (sbox *Sandbox) setupCgroup() error {
+	d := sbox.daemon
+	if err := d.ensureCgroupRoot(); err != nil {
+		return err
+	}
+	cg := path.Join(d.config.CgroupPath, sbox.cgroupName())
+	if err := os.Mkdir(cg, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	sbox.cgroup = cg
+
+	r := sbox.profile.Resources
+	if r.MemoryMax != "" {
+		max, err := oz.ParseMemorySize(r.MemoryMax)
+		if err != nil {
+			return err
+		}
+		if err := writeCgroupFile(cg, "memory.max", strconv.FormatUint(max, 10)); err != nil {
+			return err
+		}
+	}
+	if r.CPUWeight != 0 {
+		if err := writeCgroupFile(cg, "cpu.weight", strconv.FormatUint(uint64(r.CPUWeight), 10)); err != nil {
+			return err
+		}
+	}
+	if r.CPUQuota != 0 {
+		quota := fmt.Sprintf("%d %d", uint64(r.CPUQuota)*cgroupCPUPeriod/100, cgroupCPUPeriod)
+		if err := writeCgroupFile(cg, "cpu.max", quota); err != nil {
+			return err
+		}
+	}
+	if r.PidsMax != 0 {
+		if err := writeCgroupFile(cg, "pids.max", strconv.FormatUint(uint64(r.PidsMax), 10)); err != nil {
+			return err
+		}
+	}
+	if r.IOWeight != 0 {
+		if err := writeCgroupFile(cg, "io.weight", "default "+strconv.FormatUint(uint64(r.IOWeight), 10)); err != nil {
+			return err
+		}
+	}
+	return writeCgroupFile(cg, "cgroup.procs", strconv.Itoa(sbox.init.Process.Pid))
+}
+
+// removeCgroup deletes the cgroup of the sandbox once all of its processes are gone
+func (sbox *Sandbox) removeCgroup() {
+	if sbox.cgroup == "" {
+		return
+	}
+	if err := removeCgroupDir(sbox.cgroup); err != nil {
+		sbox.daemon.Warning("Unable to remove cgroup %s: %v", sbox.cgroup, err)
+		return
+	}
+	sbox.cgroup = ""
+}
+
+func removeCgroupDir(cg string) error {
+	var err error
+	// Processes of the sandbox may take a moment to be released after init exits
+	for i := 0; i < 10; i++ {
+		if err = syscall.Rmdir(cg); err == nil || err == syscall.ENOENT {
+			return nil
+		}
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// usage reads the current resource usage of the sandbox from its cgroup
+func (sbox *Sandbox) usage() (*ResourceUsage, error) {
+	if sbox.cgroup == "" {
+		return nil, fmt.Errorf("sandbox %d has no cgroup", sbox.id)
+	}
+	cg := sbox.cgroup
+	u := &ResourceUsage{Id: sbox.id, Profile: sbox.profile.Name}
+	u.MemoryCurrent, _ = readCgroupUint(cg, "memory.current")
+	u.MemoryMax, _ = readCgroupUint(cg, "memory.max")
+	u.PidsCurrent, _ = readCgroupUint(cg, "pids.current")
+	u.PidsMax, _ = readCgroupUint(cg, "pids.max")
+	if stat, err := readCgroupKeyed(cg, "cpu.stat"); err == nil {
+		u.CPUUsec = stat["usage_usec"]
+	}
+	if f, err := os.Open(path.Join(cg, "io.stat")); err == nil {
+		// One line per device: "8:0 rbytes=1 wbytes=2 rios=3 ..."
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			for _, kv := range strings.Fields(scanner.Text())[1:] {
+				parts := strings.SplitN(kv, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				n, _ := strconv.ParseUint(parts[1], 10, 64)
+				switch parts[0] {
+				case "rbytes":
+					u.IOReadBytes += n
+				case "wbytes":
+					u.IOWriteBytes += n
+				}
+			}
+		}
+		f.Close()
+	}
+	return u, nil
+}
+
+func writeCgroupFile(cg, name, value string) error {
+	return ioutil.WriteFile(path.Join(cg, name), []byte(value), 0644)
+}
+
+// readCgroupUint reads a single value file, "max" is reported as zero
+func readCgroupUint(cg, name string) (uint64, error) {
+	bs, err := ioutil.ReadFile(path.Join(cg, name))
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(bs))
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readCgroupKeyed reads a flat keyed file made of "key value" lines
+func readCgroupKeyed(cg, name string) (map[string]uint64, error) {
+	bs, err := ioutil.ReadFile(path.Join(cg, name))
+	if err != nil {
+		return nil, err
+	}
+	vals := make(map[string]uint64)
+	for _, line := range strings.Split(string(bs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			vals[fields[0]] = n
+		}
+	}
+	return vals, nil
+}
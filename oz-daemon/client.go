@@ -27,7 +27,10 @@ func clientSend(msg interface{}) (*ipc.Message, error) {
 		return nil, err
 	}
 
-	resp := <-rr.Chan()
+	resp, ok := <-rr.Chan()
+	if !ok {
+		return nil, errors.New("connection closed by the daemon")
+	}
 	rr.Done()
 	return resp, nil
 }
@@ -151,10 +154,12 @@ func IsRunning(cpath string, args []string) (bool, error) {
 	return false, fmt.Errorf("Unexpected error occured")
 }
 
-func Launch(arg, cpath string, args []string, noexec, ephemeral bool) error {
+// Launch asks the daemon to run a program in a sandbox for a profile. When
+// wait is set it returns once the program exits, along with its exit status.
+func Launch(arg, cpath string, args []string, noexec, ephemeral, wait bool) (int, error) {
 	idx, name, err := parseProfileArg(arg)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	pwd, _ := os.Getwd()
 	groups, _ := os.Getgroups()
@@ -175,19 +180,28 @@ func Launch(arg, cpath string, args []string, noexec, ephemeral bool) error {
 		Env:       os.Environ(),
 		Noexec:    noexec,
 		Ephemeral: ephemeral,
+		Wait:      wait,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
+		if wait {
+			return 0, errors.New(body.Msg)
+		}
 		fmt.Printf("error was %s\n", body.Msg)
 	case *OkMsg:
 		fmt.Println("ok received from application launch request")
+	case *ProgramExitedMsg:
+		if body.Signal != 0 {
+			return 128 + body.Signal, nil
+		}
+		return body.Status, nil
 	default:
 		fmt.Printf("Unexpected message received %+v", body)
 	}
-	return nil
+	return 0, nil
 }
 
 func KillAllSandboxes() error {
@@ -209,6 +223,36 @@ func KillSandbox(id int) error {
 	}
 }
 
+func SandboxUsage(id int) ([]ResourceUsage, error) {
+	resp, err := clientSend(&SandboxUsageMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *SandboxUsageResp:
+		return body.Usage, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func Reload() ([]ReloadResult, error) {
+	resp, err := clientSend(&ReloadMsg{})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *ReloadResp:
+		return body.Results, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
 func RelaunchXpraClient(id int) error {
 	resp, err := clientSend(&RelaunchXpraClientMsg{Id: id})
 	if err != nil {
@@ -324,6 +368,138 @@ func dumpLogs(out chan<- string, rr ipc.ResponseReader) {
 			out <- fmt.Sprintf("Unexpected response type (%T)", body)
 		}
 	}
+	close(out)
+}
+
+// FilteredLogs returns the structured records of the sandbox log files
+// matching the filter, followed by the new ones if filter.Follow is set.
+func FilteredLogs(filter *LogsMsg) (chan LogRecord, error) {
+	c, err := clientConnect()
+	if err != nil {
+		return nil, err
+	}
+	rr, err := c.ExchangeMsg(filter)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp, ok := <-rr.Chan()
+	if !ok {
+		return nil, errors.New("connection closed by the daemon")
+	}
+	switch body := resp.Body.(type) {
+	case *OkMsg:
+	case *ErrorMsg:
+		rr.Done()
+		c.Close()
+		return nil, errors.New(body.Msg)
+	default:
+		rr.Done()
+		c.Close()
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+	out := make(chan LogRecord)
+	go dumpLogRecords(out, rr, c)
+	return out, nil
+}
+
+func dumpLogRecords(out chan<- LogRecord, rr ipc.ResponseReader, c *ipc.MsgConn) {
+	defer c.Close()
+	defer close(out)
+	for resp := range rr.Chan() {
+		switch body := resp.Body.(type) {
+		case *OkMsg:
+			rr.Done()
+			return
+		case *LogRecords:
+			for _, rec := range body.Records {
+				out <- rec
+			}
+		}
+	}
+}
+
+// ListRecordings returns the recorded shell sessions of a profile, or of all
+// the profiles if it is empty.
+func ListRecordings(profile string) ([]Recording, error) {
+	resp, err := clientSend(&ListRecordingsMsg{Profile: profile})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *ListRecordingsResp:
+		return body.Recordings, nil
+	default:
+		return nil, fmt.Errorf("Unexpected response type (%T)", body)
+	}
+}
+
+// ExportRecording returns a file open on a recorded shell session
+func ExportRecording(profile, name string) (*os.File, error) {
+	resp, err := clientSend(&ExportRecordingMsg{Profile: profile, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *OkMsg:
+		if len(resp.Fds) == 0 {
+			return nil, errors.New("ExportRecording message returned Ok, but no file descriptor received")
+		}
+		return os.NewFile(uintptr(resp.Fds[0]), name), nil
+	default:
+		return nil, fmt.Errorf("Unexpected response type (%T)", body)
+	}
+}
+
+// Subscribe returns a channel receiving the events about the sandbox with the
+// given id, or about every visible sandbox and the daemon itself for an id of
+// -1. The channel is closed when the sandbox is removed or the daemon goes away.
+func Subscribe(id int) (chan *EventMsg, error) {
+	c, err := clientConnect()
+	if err != nil {
+		return nil, err
+	}
+	rr, err := c.ExchangeMsg(&SubscribeMsg{Id: id})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp, ok := <-rr.Chan()
+	if !ok {
+		return nil, errors.New("connection closed by the daemon")
+	}
+	switch body := resp.Body.(type) {
+	case *OkMsg:
+	case *ErrorMsg:
+		rr.Done()
+		c.Close()
+		return nil, errors.New(body.Msg)
+	default:
+		rr.Done()
+		c.Close()
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+	out := make(chan *EventMsg)
+	go dumpEvents(out, rr, c)
+	return out, nil
+}
+
+func dumpEvents(out chan<- *EventMsg, rr ipc.ResponseReader, c *ipc.MsgConn) {
+	defer c.Close()
+	defer close(out)
+	for resp := range rr.Chan() {
+		switch body := resp.Body.(type) {
+		case *OkMsg:
+			rr.Done()
+			return
+		case *EventMsg:
+			out <- body
+		}
+	}
 }
 
 var isSocketName = regexp.MustCompile(`^@[A-Za-z0-9_-]+$`).MatchString
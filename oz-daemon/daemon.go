@@ -11,6 +11,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/subgraph/oz"
@@ -31,6 +32,7 @@ type groupEntry struct {
 type daemonState struct {
 	log         *logging.Logger
 	config      *oz.Config
+	policy      *oz.Policy
 	profiles    oz.Profiles
 	sandboxes   []*Sandbox
 	nextSboxId  int
@@ -41,6 +43,16 @@ type daemonState struct {
 	// openvpns     *network.OpenVPNs
 	systemGroups map[string]groupEntry
 	envOverrides []string
+	reloadLock   sync.Mutex
+	watcher      *configWatcher
+	eventLock    sync.Mutex
+	subscribers  []*eventSubscriber
+	logLock      sync.Mutex
+	logFollowers []*recordFollower
+	dnsLock      sync.Mutex
+	dnsProxies   map[string]*network.DNSProxy
+	dbus         *dbusService
+	calls        chan func()
 }
 
 func Main() {
@@ -51,6 +63,9 @@ func Main() {
 
 	err := runServer(
 		d.log,
+		d.authorize,
+		d.calls,
+		d.startDBus,
 		d.handlePing,
 		d.handleGetConfig,
 		d.handleListProfiles,
@@ -63,10 +78,15 @@ func Main() {
 		d.handleMountFiles,
 		d.handleUnmountFile,
 		d.handleLogs,
+		d.handleListRecordings,
+		d.handleExportRecording,
 		d.handleAskForwarder,
 		d.handleListForwarders,
 		d.handleListBridges,
 		d.handleListProxies,
+		d.handleReload,
+		d.handleSandboxUsage,
+		d.handleSubscribe,
 	)
 	if err != nil {
 		d.log.Error("Error running server: %v", err)
@@ -85,6 +105,12 @@ func initialize() *daemonState {
 		os.Exit(1)
 	}
 	d.config = config
+	policy, err := d.loadPolicy()
+	if err != nil {
+		d.log.Error("Could not load policy (%s): %v", d.config.PolicyPath, err)
+		os.Exit(1)
+	}
+	d.policy = policy
 	ps, err := d.loadProfiles(d.config.ProfileDir)
 	if err != nil {
 		d.log.Fatalf("Failed to load profiles: %v", err)
@@ -99,6 +125,8 @@ func initialize() *daemonState {
 	d.nextDisplay = 100
 
 	d.bridges = network.NewBridges(d.log)
+	d.calls = make(chan func())
+	d.recoverSandboxes()
 
 	sockets := path.Join(config.SandboxPath, "sockets")
 	if err := os.MkdirAll(sockets, 0755); err != nil {
@@ -113,6 +141,10 @@ func initialize() *daemonState {
 
 	os.Clearenv()
 
+	if err := d.startConfigWatcher(); err != nil {
+		d.Warning("Unable to watch for configuration changes: %v", err)
+	}
+
 	go d.processSignals(sigs)
 
 	return d
@@ -147,20 +179,77 @@ func (d *daemonState) processSignals(c <-chan os.Signal) {
 		sig := <-c
 		switch sig {
 		case syscall.SIGHUP:
-			d.log.Notice("Received HUP signal, reloading profiles.")
-
-			ps, err := d.loadProfiles(d.config.ProfileDir)
-			if err != nil {
-				d.log.Error("Failed to reload profiles: %v", err)
-				continue
-			}
-			d.profiles = ps
+			d.log.Notice("Received HUP signal, reloading configuration and profiles.")
+			d.requestReload()
 		case syscall.SIGUSR2:
 			d.handleNetworkReconfigure()
 		}
 	}
 }
 
+// requestReload makes the dispatcher of the server reload the configuration
+// and profiles, so that they are only replaced between two messages
+func (d *daemonState) requestReload() {
+	d.calls <- func() { d.reload() }
+}
+
+// reload loads the configuration file and the profiles again. A profile that
+// fails to load keeps its last good version, and running sandboxes keep the
+// profile they were launched with.
+func (d *daemonState) reload() []ReloadResult {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+	if d.watcher != nil {
+		// The directories to watch may have moved, and fragment
+		// directories been added or removed
+		defer d.watcher.watchDirectories()
+	}
+
+	results := []ReloadResult{}
+	cr := ReloadResult{File: oz.DefaultConfigPath}
+	config, err := d.loadConfig()
+	if err != nil {
+		d.Error("Failed to reload configuration, keeping current one: %v", err)
+		cr.Error = err.Error()
+		cr.Kept = true
+	} else {
+		d.config = config
+	}
+	results = append(results, cr)
+
+	pr := ReloadResult{File: d.config.PolicyPath}
+	policy, err := d.loadPolicy()
+	if err != nil {
+		d.Error("Failed to reload policy, keeping current one: %v", err)
+		pr.Error = err.Error()
+		pr.Kept = true
+	} else {
+		d.policy = policy
+	}
+	results = append(results, pr)
+
+	ps, prs, err := oz.ReloadProfiles(d.config.ProfileDir, d.profiles)
+	if err != nil {
+		d.Error("Failed to reload profiles from %s: %v", d.config.ProfileDir, err)
+		return append(results, ReloadResult{File: d.config.ProfileDir, Error: err.Error(), Kept: true})
+	}
+	for _, pr := range prs {
+		r := ReloadResult{File: pr.File, Profile: pr.Name, Kept: pr.Kept}
+		if pr.Err != nil {
+			r.Error = pr.Err.Error()
+			if pr.Kept {
+				d.Warning("Failed to reload %s, keeping previous version: %v", pr.File, pr.Err)
+			} else {
+				d.Warning("Failed to load %s: %v", pr.File, pr.Err)
+			}
+		}
+		results = append(results, r)
+	}
+	d.profiles = ps
+	d.Debug("%d profiles loaded", len(ps))
+	return results
+}
+
 func (d *daemonState) cacheSystemGroups() error {
 	fg, err := os.Open("/etc/group")
 	if err != nil {
@@ -195,30 +284,47 @@ func (d *daemonState) cacheSystemGroups() error {
 
 func (d *daemonState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	d.Debug("Child process pid=%d exited from daemon with status %d", pid, wstatus.ExitStatus())
+	status := wstatus.ExitStatus()
+	signal := 0
+	if wstatus.Signaled() {
+		signal = int(wstatus.Signal())
+	}
 	for _, sbox := range d.sandboxes {
 		if sbox.init.Process.Pid == pid {
-			sbox.remove(d.log)
-
-			/* Terminate OpenVPN client daemon */
-
-			if sbox.ovpn != nil {
-				pidfilepath := path.Join(d.config.OpenVPNRunPath, sbox.ovpn.runtoken+".pid")
-				pid, err := readOpenVPNPidFromFile(pidfilepath)
-				if err != nil {
-					d.Debug("Failed to retrieve openvpn pid: %v", err)
-				}
-				err = syscall.Kill(pid, syscall.SIGTERM)
-				if err != nil {
-					d.Debug("Failed to send openvpn SIGTERM: %v", err)
-				}
-				removeOpenVPNRunState(d, sbox.ovpn.runtoken)
-				sbox.ovpn = nil
-			}
-
+			sbox.emitEvent(EventChildExited, func(ev *EventMsg) {
+				ev.Pid = pid
+				ev.Status = &status
+				ev.Signal = signal
+			})
+			d.cleanupSandbox(sbox)
 			return
 		}
 	}
 	d.Notice("No sandbox found with oz-init pid = %d", pid)
+	d.emitEvent(&EventMsg{Type: EventChildExited, Pid: pid, Status: &status, Signal: signal})
+}
+
+// cleanupSandbox releases the resources of a sandbox whose init process exited
+func (d *daemonState) cleanupSandbox(sbox *Sandbox) {
+	sbox.remove(d.log)
+
+	/* Terminate OpenVPN client daemon */
+
+	if sbox.ovpn != nil {
+		d.stopOpenVPN(sbox.ovpn.runtoken)
+		sbox.ovpn = nil
+	}
+}
+
+func (d *daemonState) stopOpenVPN(runtoken string) {
+	pidfilepath := path.Join(d.config.OpenVPNRunPath, runtoken+".pid")
+	pid, err := readOpenVPNPidFromFile(pidfilepath)
+	if err != nil {
+		d.Debug("Failed to retrieve openvpn pid: %v", err)
+	} else if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		d.Debug("Failed to send openvpn SIGTERM: %v", err)
+	}
+	removeOpenVPNRunState(d, runtoken)
 }
 
 func removeOpenVPNRunState(d *daemonState, runtoken string) {
@@ -253,15 +359,30 @@ func readOpenVPNPidFromFile(path string) (int, error) {
 	return pid, nil
 }
 
-func runServer(log *logging.Logger, args ...interface{}) error {
+// runServer serves the control socket, started is called with the server
+// before it starts accepting connections.
+func runServer(log *logging.Logger, auth ipc.Authorizer, calls <-chan func(), started func(*ipc.MsgServer), args ...interface{}) error {
 	s, err := ipc.NewServer(bSockName, messageFactory, log, args...)
 	if err != nil {
 		return err
 	}
+	s.SetAuthorizer(auth)
+	go forwardCalls(s, calls)
+	started(s)
 
 	return s.Run()
 }
 
+// forwardCalls runs the functions received on calls on the dispatcher of the
+// server, until it is closed
+func forwardCalls(s *ipc.MsgServer, calls <-chan func()) {
+	for f := range calls {
+		if err := s.Call(f); err != nil {
+			return
+		}
+	}
+}
+
 func (d *daemonState) handlePing(msg *PingMsg, m *ipc.Message) error {
 	d.Debug("received ping with data [%s]", msg.Data)
 	return m.Respond(&PingMsg{msg.Data})
@@ -319,7 +440,7 @@ func (d *daemonState) handleIsRunning(msg *IsRunningMsg, m *ipc.Message) error {
 		return m.Respond(&ErrorMsg{err.Error()})
 	}
 
-	if sbox := d.getRunningSandboxByName(p.Name); sbox != nil {
+	if sbox := d.getRunningSandbox(m.Ucred.Uid, p.Name); sbox != nil {
 		return m.Respond(&OkMsg{})
 	}
 	return m.Respond(&NotOkMsg{})
@@ -340,25 +461,39 @@ func (d *daemonState) handleLaunch(msg *LaunchMsg, m *ipc.Message) error {
 	if err != nil {
 		return m.Respond(&ErrorMsg{err.Error()})
 	}
+	if msg.Wait && msg.Noexec {
+		return m.Respond(&ErrorMsg{"Cannot wait for the program when noexec is set"})
+	}
 
-	if sbox := d.getRunningSandboxByName(p.Name); sbox != nil {
+	if sbox := d.getRunningSandbox(m.Ucred.Uid, p.Name); sbox != nil {
 		if msg.Noexec {
 			errmsg := "Asked to launch program but sandbox is running and noexec is set!"
 			d.Notice(errmsg)
 			return m.Respond(&ErrorMsg{errmsg})
 		} else {
 			d.Info("Found running sandbox for `%s`, running program there", p.Name)
-			sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, d.log)
+			if msg.Wait {
+				go sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, m, d.log)
+				return nil
+			}
+			sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, nil, d.log)
 		}
 	} else {
 		d.Debug("Would launch %s (ephemeral: %b)", p.Name, msg.Ephemeral)
 		rawEnv := msg.Env
 		msg.Env = d.sanitizeEnvironment(p, rawEnv)
-		_, err = d.launch(p, msg, rawEnv, m.Ucred.Uid, m.Ucred.Gid, msg.Ephemeral, d.log)
+		var reply *ipc.Message
+		if msg.Wait {
+			reply = m
+		}
+		_, err = d.launch(p, msg, reply, rawEnv, m.Ucred.Uid, m.Ucred.Gid, msg.Ephemeral, d.log)
 		if err != nil {
 			d.Warning("Launch of %s failed: %v", p.Name, err)
 			return m.Respond(&ErrorMsg{err.Error()})
 		}
+		if msg.Wait {
+			return nil
+		}
 	}
 	return m.Respond(&OkMsg{})
 }
@@ -407,27 +542,18 @@ func (d *daemonState) sanitizeEnvironment(p *oz.Profile, oldEnv []string) []stri
 
 func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) error {
 	if msg.Id == -1 {
-		for _, sb := range d.sandboxes {
+		for _, sb := range d.sandboxesFor(m.Ucred) {
 			if err := sb.init.Process.Signal(os.Interrupt); err != nil {
 				return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
 			}
 			if sb.ovpn != nil {
-				pidfilepath := path.Join(d.config.OpenVPNRunPath, sb.ovpn.runtoken+".pid")
-				pid, err := readOpenVPNPidFromFile(pidfilepath)
-				if err != nil {
-					d.Debug("Failed to retrieve openvpn pid: %v", err)
-				}
-				err = syscall.Kill(pid, syscall.SIGTERM)
-				if err != nil {
-					d.Debug("Failed to send openvpn SIGTERM: %v", err)
-				}
-				removeOpenVPNRunState(d, sb.ovpn.runtoken)
+				d.stopOpenVPN(sb.ovpn.runtoken)
 				sb.ovpn = nil
 
 			}
 		}
 	} else {
-		sbox := d.sandboxById(msg.Id)
+		sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 		if sbox == nil {
 			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 		}
@@ -435,16 +561,7 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 			return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
 		}
 		if sbox.ovpn != nil {
-			pidfilepath := path.Join(d.config.OpenVPNRunPath, sbox.ovpn.runtoken+".pid")
-			pid, err := readOpenVPNPidFromFile(pidfilepath)
-			if err != nil {
-				d.Debug("Failed to retrieve openvpn pid: %v", err)
-			}
-			err = syscall.Kill(pid, syscall.SIGTERM)
-			if err != nil {
-				d.Debug("Failed to send openvpn SIGTERM: %v", err)
-			}
-			removeOpenVPNRunState(d, sbox.ovpn.runtoken)
+			d.stopOpenVPN(sbox.ovpn.runtoken)
 			sbox.ovpn = nil
 		}
 	}
@@ -453,11 +570,11 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 
 func (d *daemonState) handleRelaunchXpraClient(msg *RelaunchXpraClientMsg, m *ipc.Message) error {
 	if msg.Id == -1 {
-		for _, sb := range d.sandboxes {
+		for _, sb := range d.sandboxesFor(m.Ucred) {
 			sb.startXpraClient()
 		}
 	} else {
-		sbox := d.sandboxById(msg.Id)
+		sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 		if sbox == nil {
 			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 		}
@@ -467,7 +584,7 @@ func (d *daemonState) handleRelaunchXpraClient(msg *RelaunchXpraClientMsg, m *ip
 }
 
 func (d *daemonState) handleMountFiles(msg *MountFilesMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
+	sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 	}
@@ -478,7 +595,7 @@ func (d *daemonState) handleMountFiles(msg *MountFilesMsg, m *ipc.Message) error
 }
 
 func (d *daemonState) handleUnmountFile(msg *UnmountFileMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
+	sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 	}
@@ -489,7 +606,7 @@ func (d *daemonState) handleUnmountFile(msg *UnmountFileMsg, m *ipc.Message) err
 }
 
 func (d *daemonState) handleAskForwarder(msg *AskForwarderMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
+	sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 	hasListenerName := false
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
@@ -509,6 +626,10 @@ func (d *daemonState) handleAskForwarder(msg *AskForwarderMsg, m *ipc.Message) e
 	if err != nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to create forwarder: %v", err)})
 	}
+	sbox.emitEvent(EventForwarderCreated, func(ev *EventMsg) {
+		ev.Name = msg.Name
+		ev.Addr = forwarder
+	})
 	return m.Respond(&ForwarderSuccessMsg{Proto: msg.Name, Addr: forwarder})
 }
 
@@ -559,9 +680,10 @@ func (d *daemonState) getProfileByIdxOrName(index int, name string) (*oz.Profile
 	return nil, fmt.Errorf("could not find profile name '%s'", name)
 }
 
-func (d *daemonState) getRunningSandboxByName(name string) *Sandbox {
+// getRunningSandbox returns the sandbox of the given profile launched by uid
+func (d *daemonState) getRunningSandbox(uid uint32, name string) *Sandbox {
 	for _, sb := range d.sandboxes {
-		if sb.profile.Name == name {
+		if sb.cred.Uid == uid && sb.profile.Name == name {
 			return sb
 		}
 	}
@@ -571,14 +693,27 @@ func (d *daemonState) getRunningSandboxByName(name string) *Sandbox {
 
 func (d *daemonState) handleListSandboxes(list *ListSandboxesMsg, msg *ipc.Message) error {
 	r := new(ListSandboxesResp)
-	for _, sb := range d.sandboxes {
-		r.Sandboxes = append(r.Sandboxes, SandboxInfo{Id: sb.id, Address: sb.addr, Mounts: sb.mountedFiles, Profile: sb.profile.Name, InitPid: sb.init.Process.Pid})
-	}
-	return msg.Respond(r)
+	for _, sb := range d.sandboxesFor(msg.Ucred) {
+		r.Sandboxes = append(r.Sandboxes, sb.info())
+	}
+	// Listing the processes of the sandboxes walks the whole of /proc,
+	// which is left out of the dispatcher
+	go func() {
+		for i := range r.Sandboxes {
+			si := &r.Sandboxes[i]
+			children, err := descendantProcesses(si.InitPid)
+			if err != nil {
+				d.Debug("Unable to list processes of sandbox %d: %v", si.Id, err)
+			}
+			si.Children = children
+		}
+		msg.Respond(r)
+	}()
+	return nil
 }
 
 func (d *daemonState) handleListForwarders(msg *ListForwardersMsg, m *ipc.Message) error {
-	sbox := d.sandboxById(msg.Id)
+	sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
 	r := new(ListForwardersResp)
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
@@ -604,6 +739,9 @@ func (d *daemonState) handleListProxies(msg *ListProxiesMsg, m *ipc.Message) err
 }
 
 func (d *daemonState) handleLogs(logs *LogsMsg, msg *ipc.Message) error {
+	if logs.filtered() {
+		return d.handleLogRecords(logs, msg)
+	}
 	for n := d.memBackend.Head(); n != nil; n = n.Next() {
 		s := n.Record.Formatted(0)
 		msg.Respond(&LogData{Lines: []string{s}})
@@ -616,6 +754,35 @@ func (d *daemonState) handleLogs(logs *LogsMsg, msg *ipc.Message) error {
 	return nil
 }
 
+func (d *daemonState) handleSandboxUsage(msg *SandboxUsageMsg, m *ipc.Message) error {
+	sboxes := d.sandboxesFor(m.Ucred)
+	if msg.Id != -1 {
+		sbox := d.sandboxByIdFor(msg.Id, m.Ucred)
+		if sbox == nil {
+			return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+		}
+		sboxes = []*Sandbox{sbox}
+	}
+	r := new(SandboxUsageResp)
+	for _, sb := range sboxes {
+		u, err := sb.usage()
+		if err != nil {
+			if msg.Id != -1 {
+				return m.Respond(&ErrorMsg{err.Error()})
+			}
+			continue
+		}
+		r.Usage = append(r.Usage, *u)
+	}
+	return m.Respond(r)
+}
+
+func (d *daemonState) handleReload(msg *ReloadMsg, m *ipc.Message) error {
+	d.Notice("Reload requested by uid %d", m.Ucred.Uid)
+	return m.Respond(&ReloadResp{Results: d.reload()})
+}
+
 func (d *daemonState) handleNetworkReconfigure() {
 	d.bridges.Reconfigure()
+	d.emitEvent(&EventMsg{Type: EventNetworkReconfigured})
 }
@@ -0,0 +1,273 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/introspect"
+	"github.com/subgraph/oz/ipc"
+)
+
+const (
+	DBusName      = "com.subgraph.Oz"
+	DBusPath      = "/com/subgraph/Oz"
+	DBusInterface = "com.subgraph.Oz"
+)
+
+const dbusIntrospection = `
+<node>
+	<interface name="` + DBusInterface + `">
+		<method name="ListProfiles">
+			<arg name="profiles" direction="out" type="a(iss)"/>
+		</method>
+		<method name="ListSandboxes">
+			<arg name="sandboxes" direction="out" type="a(issib)"/>
+		</method>
+		<method name="Launch">
+			<arg name="profile" direction="in" type="s"/>
+			<arg name="args" direction="in" type="as"/>
+			<arg name="env" direction="in" type="as"/>
+			<arg name="noexec" direction="in" type="b"/>
+			<arg name="ephemeral" direction="in" type="b"/>
+		</method>
+		<method name="Kill">
+			<arg name="id" direction="in" type="i"/>
+		</method>
+		<method name="MountFiles">
+			<arg name="id" direction="in" type="i"/>
+			<arg name="files" direction="in" type="as"/>
+			<arg name="readonly" direction="in" type="b"/>
+		</method>
+		<method name="UnmountFile">
+			<arg name="id" direction="in" type="i"/>
+			<arg name="file" direction="in" type="s"/>
+		</method>
+		<signal name="SandboxLaunched">
+			<arg name="id" type="i"/>
+			<arg name="profile" type="s"/>
+			<arg name="user" type="s"/>
+		</signal>
+		<signal name="SandboxReady">
+			<arg name="id" type="i"/>
+			<arg name="profile" type="s"/>
+			<arg name="user" type="s"/>
+		</signal>
+		<signal name="SandboxRemoved">
+			<arg name="id" type="i"/>
+			<arg name="profile" type="s"/>
+			<arg name="user" type="s"/>
+		</signal>
+	</interface>` + introspect.IntrospectDataString + `</node>`
+
+// Time a method call waits for the response of its handler, long enough for
+// a sandbox to be launched
+const dbusCallTimeout = 2 * time.Minute
+
+// Names of the signals sent for sandbox lifecycle events
+var dbusSignals = map[string]string{
+	EventSandboxLaunched: "SandboxLaunched",
+	EventSandboxReady:    "SandboxReady",
+	EventSandboxRemoved:  "SandboxRemoved",
+}
+
+// dbusService exports the daemon on the system bus. Method calls are passed
+// to the control socket server so that they go through the same
+// authorization and handlers as the messages received on the socket.
+type dbusService struct {
+	daemon *daemonState
+	conn   *dbus.Conn
+	server *ipc.MsgServer
+}
+
+type dbusProfile struct {
+	Index int32
+	Name  string
+	Path  string
+}
+
+type dbusSandbox struct {
+	Id        int32
+	Profile   string
+	User      string
+	InitPid   int32
+	Ephemeral bool
+}
+
+func (d *daemonState) startDBus(server *ipc.MsgServer) {
+	if !d.config.DBusService {
+		return
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		d.Warning("Unable to connect to the D-Bus system bus: %v", err)
+		return
+	}
+	ds := &dbusService{daemon: d, conn: conn, server: server}
+	conn.Export(ds, DBusPath, DBusInterface)
+	conn.Export(introspect.Introspectable(dbusIntrospection), DBusPath, "org.freedesktop.DBus.Introspectable")
+	reply, err := conn.RequestName(DBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		d.Warning("Unable to request the %s name on the D-Bus system bus: %v", DBusName, err)
+		conn.Close()
+		return
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		d.Warning("The %s name is already owned on the D-Bus system bus", DBusName)
+		conn.Close()
+		return
+	}
+	d.dbus = ds
+	d.Info("D-Bus service exported as %s", DBusName)
+}
+
+// emit sends the signal matching a lifecycle event, if there is one
+func (ds *dbusService) emit(ev *EventMsg) {
+	name, ok := dbusSignals[ev.Type]
+	if !ok {
+		return
+	}
+	err := ds.conn.Emit(DBusPath, DBusInterface+"."+name, int32(ev.Id), ev.Profile, ev.User)
+	if err != nil {
+		ds.daemon.Warning("Unable to emit D-Bus signal %s: %v", name, err)
+	}
+}
+
+// credentials looks up the credentials of the sender of a method call with
+// the bus daemon.
+func (ds *dbusService) credentials(sender dbus.Sender) (*syscall.Ucred, error) {
+	var uid, pid uint32
+	bus := ds.conn.BusObject()
+	if err := bus.Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid); err != nil {
+		return nil, err
+	}
+	if err := bus.Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, string(sender)).Store(&pid); err != nil {
+		return nil, err
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Ucred{Pid: int32(pid), Uid: uid, Gid: uint32(gid)}, nil
+}
+
+// deliver passes a message to the handlers on behalf of the sender and
+// returns the response, error responses are turned into D-Bus errors.
+func (ds *dbusService) deliver(sender dbus.Sender, msg interface{}) (interface{}, *dbus.Error) {
+	cred, err := ds.credentials(sender)
+	if err != nil {
+		return nil, dbus.MakeFailedError(fmt.Errorf("unable to look up caller credentials: %v", err))
+	}
+	return ds.deliverAs(cred, msg)
+}
+
+// deliverAs passes a message to the handlers with the given credentials. It
+// fails with a NoReply error if the handler does not respond within
+// dbusCallTimeout.
+func (ds *dbusService) deliverAs(cred *syscall.Ucred, msg interface{}) (interface{}, *dbus.Error) {
+	resp := make(chan interface{}, 1)
+	err := ds.server.Deliver(msg, cred, func(r interface{}) error {
+		select {
+		case resp <- r:
+			return nil
+		default:
+			return errors.New("D-Bus method calls only take a single response")
+		}
+	})
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	var r interface{}
+	select {
+	case r = <-resp:
+	case <-time.After(dbusCallTimeout):
+		return nil, dbus.NewError("org.freedesktop.DBus.Error.NoReply", []interface{}{"No response from the daemon"})
+	}
+	if e, ok := r.(*ErrorMsg); ok {
+		if strings.HasPrefix(e.Msg, "Permission denied") {
+			return nil, dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []interface{}{e.Msg})
+		}
+		return nil, dbus.MakeFailedError(errors.New(e.Msg))
+	}
+	return r, nil
+}
+
+func (ds *dbusService) ListProfiles(sender dbus.Sender) ([]dbusProfile, *dbus.Error) {
+	r, derr := ds.deliver(sender, new(ListProfilesMsg))
+	if derr != nil {
+		return nil, derr
+	}
+	ps := []dbusProfile{}
+	for _, p := range r.(*ListProfilesResp).Profiles {
+		ps = append(ps, dbusProfile{Index: int32(p.Index), Name: p.Name, Path: p.Path})
+	}
+	return ps, nil
+}
+
+func (ds *dbusService) ListSandboxes(sender dbus.Sender) ([]dbusSandbox, *dbus.Error) {
+	r, derr := ds.deliver(sender, new(ListSandboxesMsg))
+	if derr != nil {
+		return nil, derr
+	}
+	sboxes := []dbusSandbox{}
+	for _, sb := range r.(*ListSandboxesResp).Sandboxes {
+		sboxes = append(sboxes, dbusSandbox{
+			Id:        int32(sb.Id),
+			Profile:   sb.Profile,
+			User:      sb.User,
+			InitPid:   int32(sb.InitPid),
+			Ephemeral: sb.Ephemeral,
+		})
+	}
+	return sboxes, nil
+}
+
+func (ds *dbusService) Launch(sender dbus.Sender, profile string, args, env []string, noexec, ephemeral bool) *dbus.Error {
+	cred, err := ds.credentials(sender)
+	if err != nil {
+		return dbus.MakeFailedError(fmt.Errorf("unable to look up caller credentials: %v", err))
+	}
+	msg := &LaunchMsg{
+		Name:      profile,
+		Args:      args,
+		Env:       env,
+		Noexec:    noexec,
+		Ephemeral: ephemeral,
+	}
+	// The caller cannot pass these like the oz client does
+	if u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10)); err == nil {
+		msg.Pwd = u.HomeDir
+		gids, _ := u.GroupIds()
+		for _, g := range gids {
+			if gid, err := strconv.ParseUint(g, 10, 32); err == nil {
+				msg.Gids = append(msg.Gids, uint32(gid))
+			}
+		}
+	}
+	_, derr := ds.deliverAs(cred, msg)
+	return derr
+}
+
+func (ds *dbusService) Kill(sender dbus.Sender, id int32) *dbus.Error {
+	_, derr := ds.deliver(sender, &KillSandboxMsg{Id: int(id)})
+	return derr
+}
+
+func (ds *dbusService) MountFiles(sender dbus.Sender, id int32, files []string, readonly bool) *dbus.Error {
+	_, derr := ds.deliver(sender, &MountFilesMsg{Id: int(id), Files: files, ReadOnly: readonly})
+	return derr
+}
+
+func (ds *dbusService) UnmountFile(sender dbus.Sender, id int32, file string) *dbus.Error {
+	_, derr := ds.deliver(sender, &UnmountFileMsg{Id: int(id), File: file})
+	return derr
+}
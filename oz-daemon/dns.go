@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/op/go-logging"
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/network"
+)
+
+// profileBridgeName returns the name of the bridge the sandboxes of a profile
+// are attached to
+func profileBridgeName(p *oz.Profile) string {
+	if name := p.Networking.Bridge; name != "" {
+		return name
+	}
+	return "default"
+}
+
+// sandboxDNS returns the name servers oz-init lists in the resolv.conf of a
+// new sandbox of the profile, following its dns mode
+func (d *daemonState) sandboxDNS(p *oz.Profile) ([]string, error) {
+	if p.Networking.Nettype != network.TYPE_BRIDGE {
+		return nil, nil
+	}
+	switch p.Networking.DNSMode {
+	case oz.PROFILE_NETWORK_DNS_DHCP:
+		ns := network.DHCPNameservers()
+		if len(ns) == 0 {
+			d.Warning("No DHCP lease with name servers found, sandboxes of %s will not resolve names", p.Name)
+		}
+		return ns, nil
+	case oz.PROFILE_NETWORK_DNS_PROXY:
+		dp, err := d.dnsProxy(profileBridgeName(p))
+		if err != nil {
+			return nil, err
+		}
+		ns := []string{}
+		for _, ip := range dp.IPs() {
+			if ip.To4() != nil || !p.Networking.DisableIPv6 {
+				ns = append(ns, ip.String())
+			}
+		}
+		return ns, nil
+	}
+	return nil, nil
+}
+
+// dnsProxy returns the DNS proxy of a bridge, started on the IPv4 and IPv6
+// addresses of the bridge if it is not running yet or if the bridge has
+// changed address
+func (d *daemonState) dnsProxy(bname string) (*network.DNSProxy, error) {
+	br, err := d.bridges.GetBridge(bname)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{*br.GetIP()}
+	if ip6 := br.GetIP6(); ip6 != nil {
+		ips = append(ips, *ip6)
+	}
+	d.dnsLock.Lock()
+	defer d.dnsLock.Unlock()
+	if dp := d.dnsProxies[bname]; dp != nil {
+		if dp.IPs()[0].Equal(ips[0]) {
+			return dp, nil
+		}
+		dp.Close()
+		delete(d.dnsProxies, bname)
+	}
+	dp, err := network.NewDNSProxy(ips, d.log)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start the DNS proxy of bridge %s: %v", bname, err)
+	}
+	if d.dnsProxies == nil {
+		d.dnsProxies = make(map[string]*network.DNSProxy)
+	}
+	d.dnsProxies[bname] = dp
+	return dp, nil
+}
+
+// registerDNS lets a sandbox in the proxy dns mode resolve names through the
+// DNS proxy of its bridge
+func (sbox *Sandbox) registerDNS() {
+	if sbox.profile.Networking.DNSMode != oz.PROFILE_NETWORK_DNS_PROXY || sbox.iface == nil {
+		return
+	}
+	dp, err := sbox.daemon.dnsProxy(sbox.getBridgeName())
+	if err != nil {
+		sbox.daemon.Warning("Sandbox %s (id=%d) will not resolve names: %v", sbox.profile.Name, sbox.id, err)
+		return
+	}
+	dp.Register(sbox.sandboxIPs(), sbox.dnsQuery)
+}
+
+func (sbox *Sandbox) unregisterDNS() {
+	if sbox.iface == nil {
+		return
+	}
+	d := sbox.daemon
+	d.dnsLock.Lock()
+	defer d.dnsLock.Unlock()
+	if dp := d.dnsProxies[sbox.getBridgeName()]; dp != nil {
+		dp.Unregister(sbox.sandboxIPs())
+	}
+}
+
+// sandboxIPs returns the addresses of the sandbox on its bridge
+func (sbox *Sandbox) sandboxIPs() []net.IP {
+	ips := []net.IP{sbox.iface.GetSandboxIP()}
+	if ip6 := sbox.iface.GetSandboxIP6(); ip6 != nil {
+		ips = append(ips, ip6)
+	}
+	return ips
+}
+
+// dnsQuery applies the domain lists of the profile to a query made by the
+// sandbox through the DNS proxy, and logs it to the sandbox log.
+func (sbox *Sandbox) dnsQuery(name string, qtype uint16) bool {
+	n := sbox.profile.Networking
+	if !network.DNSDomainAllowed(name, n.DNSAllow, n.DNSDeny) {
+		sbox.logRecord(logging.NOTICE, LogSourceDNS, 0, fmt.Sprintf("denied %s %s", network.DNSTypeName(qtype), name))
+		return false
+	}
+	sbox.logRecord(logging.DEBUG, LogSourceDNS, 0, fmt.Sprintf("%s %s", network.DNSTypeName(qtype), name))
+	return true
+}
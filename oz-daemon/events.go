@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/subgraph/oz/ipc"
+)
+
+// eventSubscriber is a connection which asked to receive events, either
+// about a single sandbox or about every sandbox its user may see.
+type eventSubscriber struct {
+	rq    *responseQueue
+	id    int
+	uid   uint32
+	admin bool
+}
+
+// Number of responses queued for a subscriber before it is dropped
+const subscriberQueueLen = 256
+
+// responseQueue sends the responses to a subscription from its own
+// goroutine, so that a subscriber which stops reading cannot block the
+// daemon. A subscriber falling behind by more than subscriberQueueLen
+// responses is disconnected.
+type responseQueue struct {
+	m     *ipc.Message
+	queue chan interface{}
+	dead  chan struct{}
+	once  sync.Once
+}
+
+func newResponseQueue(m *ipc.Message) *responseQueue {
+	rq := &responseQueue{
+		m:     m,
+		queue: make(chan interface{}, subscriberQueueLen),
+		dead:  make(chan struct{}),
+	}
+	go rq.run()
+	return rq
+}
+
+func (rq *responseQueue) run() {
+	for msg := range rq.queue {
+		if err := rq.m.Respond(msg); err != nil {
+			rq.kill()
+			return
+		}
+	}
+}
+
+// send queues a response without blocking. It returns false if the
+// subscriber is gone or has been disconnected for falling behind.
+func (rq *responseQueue) send(msg interface{}) bool {
+	select {
+	case <-rq.dead:
+		return false
+	default:
+	}
+	select {
+	case rq.queue <- msg:
+		return true
+	default:
+		rq.kill()
+		return false
+	}
+}
+
+func (rq *responseQueue) kill() {
+	rq.once.Do(func() {
+		close(rq.dead)
+		rq.m.Disconnect()
+	})
+}
+
+// close ends the subscription once the queued responses are sent. No
+// response may be queued afterwards.
+func (rq *responseQueue) close() {
+	close(rq.queue)
+}
+
+func (es *eventSubscriber) wants(ev *EventMsg) bool {
+	if ev.Id == 0 {
+		return es.id == -1
+	}
+	if es.id != -1 && es.id != ev.Id {
+		return false
+	}
+	return es.admin || es.uid == ev.Uid
+}
+
+// handleSubscribe acknowledges a subscription with OkMsg, the events are
+// then sent as further responses to the same message. Subscriptions to a
+// single sandbox end with another OkMsg once it has been removed.
+func (d *daemonState) handleSubscribe(msg *SubscribeMsg, m *ipc.Message) error {
+	if msg.Id != -1 && d.sandboxByIdFor(msg.Id, m.Ucred) == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	}
+	if err := m.Respond(&OkMsg{}); err != nil {
+		return err
+	}
+	es := &eventSubscriber{
+		rq:    newResponseQueue(m),
+		id:    msg.Id,
+		uid:   m.Ucred.Uid,
+		admin: d.authorizeAdmin(d.lookupCaller(m.Ucred)) == nil,
+	}
+	d.eventLock.Lock()
+	d.subscribers = append(d.subscribers, es)
+	d.eventLock.Unlock()
+	d.Debug("Events subscription from uid %d for sandbox %d", es.uid, es.id)
+	return nil
+}
+
+// emitEvent queues an event for the interested subscribers. Subscribers
+// whose connection went away or which fall behind are dropped, and so are the
+// ones to a single sandbox once it has been removed.
+func (d *daemonState) emitEvent(ev *EventMsg) {
+	ev.Time = time.Now()
+	d.eventLock.Lock()
+	defer d.eventLock.Unlock()
+	subscribers := []*eventSubscriber{}
+	for _, es := range d.subscribers {
+		if es.wants(ev) {
+			if !es.rq.send(ev) {
+				d.Debug("Dropping events subscription from uid %d", es.uid)
+				continue
+			}
+			if ev.Type == EventSandboxRemoved && es.id == ev.Id {
+				es.rq.send(&OkMsg{})
+				es.rq.close()
+				continue
+			}
+		}
+		subscribers = append(subscribers, es)
+	}
+	d.subscribers = subscribers
+	if d.dbus != nil {
+		d.dbus.emit(ev)
+	}
+}
+
+// emitEvent sends an event of the given type about the sandbox, set fills in
+// the fields specific to the event.
+func (sbox *Sandbox) emitEvent(evtype string, set func(*EventMsg)) {
+	ev := &EventMsg{
+		Type:    evtype,
+		Id:      sbox.id,
+		Profile: sbox.profile.Name,
+		User:    sbox.owner(),
+		Uid:     sbox.cred.Uid,
+	}
+	if set != nil {
+		set(ev)
+	}
+	sbox.daemon.emitEvent(ev)
+}
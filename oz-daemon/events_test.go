@@ -0,0 +1,34 @@
+package daemon
+
+import (
+	"testing"
+)
+
+func TestSubscriberWants(t *testing.T) {
+	all := &eventSubscriber{id: -1, uid: 1000}
+	one := &eventSubscriber{id: 1, uid: 1000}
+	admin := &eventSubscriber{id: -1, uid: 1002, admin: true}
+	adminOne := &eventSubscriber{id: 2, uid: 1002, admin: true}
+
+	cases := []struct {
+		es   *eventSubscriber
+		ev   *EventMsg
+		want bool
+	}{
+		{all, &EventMsg{Id: 1, Uid: 1000}, true},
+		{all, &EventMsg{Id: 2, Uid: 1001}, false},
+		{all, &EventMsg{Type: EventChildExited, Pid: 42}, true},
+		{one, &EventMsg{Id: 1, Uid: 1000}, true},
+		{one, &EventMsg{Id: 3, Uid: 1000}, false},
+		{one, &EventMsg{Type: EventChildExited, Pid: 42}, false},
+		{admin, &EventMsg{Id: 2, Uid: 1001}, true},
+		{admin, &EventMsg{Id: 1, Uid: 1000}, true},
+		{adminOne, &EventMsg{Id: 2, Uid: 1001}, true},
+		{adminOne, &EventMsg{Id: 1, Uid: 1000}, false},
+	}
+	for _, tc := range cases {
+		if got := tc.es.wants(tc.ev); got != tc.want {
+			t.Errorf("subscriber %+v wants(%+v) = %v, expected %v", *tc.es, *tc.ev, got, tc.want)
+		}
+	}
+}
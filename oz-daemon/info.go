@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// info describes the sandbox for ListSandboxes, except for its processes
+func (sbox *Sandbox) info() SandboxInfo {
+	si := SandboxInfo{
+		Id:        sbox.id,
+		Address:   sbox.addr,
+		Profile:   sbox.profile.Name,
+		Mounts:    sbox.mountedFiles,
+		Ephemeral: sbox.ephemeral,
+		InitPid:   sbox.init.Process.Pid,
+		User:      sbox.owner(),
+		Uid:       sbox.cred.Uid,
+		Started:   sbox.started,
+		Display:   sbox.display,
+	}
+	if sbox.iface != nil {
+		if ip := sbox.iface.GetSandboxIP(); ip != nil {
+			si.IP = ip.String()
+		}
+		if ip := sbox.iface.GetSandboxIP6(); ip != nil {
+			si.IPv6 = ip.String()
+		}
+	}
+	return si
+}
+
+// descendantProcesses returns the processes descending from pid, found by
+// walking the parent pids in /proc
+func descendantProcesses(pid int) ([]SandboxProcess, error) {
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	commands := make(map[int]string)
+	for _, fi := range fis {
+		p, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", p))
+		if err != nil {
+			// Exited in the meantime
+			continue
+		}
+		stat := string(bs)
+		open := strings.Index(stat, "(")
+		end := strings.LastIndex(stat, ")")
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		parents[p] = ppid
+		commands[p] = stat[open+1 : end]
+	}
+
+	pids := []int{}
+	for p := range parents {
+		pids = append(pids, p)
+	}
+	sort.Ints(pids)
+	procs := []SandboxProcess{}
+	for _, p := range pids {
+		for a := parents[p]; a > 1; a = parents[a] {
+			if a == pid {
+				procs = append(procs, SandboxProcess{Pid: p, Command: commandLine(p, commands[p])})
+				break
+			}
+		}
+	}
+	return procs, nil
+}
+
+// commandLine returns the arguments of a process joined by spaces, or its
+// name for kernel threads and zombies
+func commandLine(pid int, name string) string {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(bs) == 0 {
+		return name
+	}
+	return strings.TrimSpace(strings.Replace(string(bs), "\x00", " ", -1))
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
@@ -19,8 +20,10 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
 	"github.com/subgraph/oz/network"
 	"github.com/subgraph/oz/openvpn"
 	"github.com/subgraph/oz/oz-init"
@@ -50,6 +53,10 @@ type Sandbox struct {
 	forwarders   []ActiveForwarder
 	ovpn         *OpenVPN
 	ephemeral    bool
+	cgroup       string
+	userns       bool
+	started      time.Time
+	logFile      *rotatingFile
 }
 
 type OpenVPN struct {
@@ -116,7 +123,7 @@ func createInitCommand(initPath string, cloneNet bool) *exec.Cmd {
 	return cmd
 }
 
-func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid, gid uint32, ephemeral bool, log *logging.Logger) (*Sandbox, error) {
+func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, reply *ipc.Message, rawEnv []string, uid, gid uint32, ephemeral bool, log *logging.Logger) (*Sandbox, error) {
 	/*
 		u, err := user.LookupId(fmt.Sprintf("%d", uid))
 		if err != nil {
@@ -133,6 +140,14 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	if err != nil {
 		return nil, fmt.Errorf("Failed to look up user with uid=%ld: %v", uid, err)
 	}
+	op, err := oz.ApplyUserOverride(p, u.HomeDir, uid)
+	if err != nil {
+		return nil, fmt.Errorf("Rejected user override for %s:\n%v", p.Name, err)
+	}
+	if op != p {
+		log.Info("Applied user override %s", op.Chain[len(op.Chain)-1])
+		p = op
+	}
 	groups, err := d.sanitizeGroups(p, u.Username, msg.Gids)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to sanitize user groups: %v", err)
@@ -144,16 +159,33 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		d.nextDisplay += 1
 	}
 
+	userns := d.userNamespaceEnabled(p)
+	if userns {
+		if err := checkUserNamespaces(); err != nil {
+			return nil, fmt.Errorf("Unable to launch %s in a user namespace: %v", p.Name, err)
+		}
+	}
+
 	socketPath, err := createSocketPath(path.Join(d.config.SandboxPath, "sockets"), "oz-init-control")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create random socket path: %v", err)
 	}
+	if userns {
+		if socketPath, err = d.prepareUserNamespace(socketPath); err != nil {
+			return nil, fmt.Errorf("Failed to prepare user namespace: %v", err)
+		}
+	}
+	if err := d.createSandboxLogDir(p); err != nil {
+		return nil, fmt.Errorf("Unable to create the log directory: %v", err)
+	}
 	initPath := path.Join(d.config.PrefixPath, "bin", "oz-init")
 	cmd := createInitCommand(initPath, (p.Networking.Nettype != network.TYPE_HOST))
-	pp, err := cmd.StderrPipe()
-	if err != nil {
-		//fs.Cleanup()
-		return nil, fmt.Errorf("error creating stderr pipe for init process: %v", err)
+	if userns {
+		gids := make([]uint32, 0, len(groups))
+		for _, g := range groups {
+			gids = append(gids, g)
+		}
+		setUserNamespace(cmd, d.config.UserNamespaceId, uid, gid, gids)
 	}
 	pi, err := cmd.StdinPipe()
 	if err != nil {
@@ -161,6 +193,19 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		return nil, fmt.Errorf("error creating stdin pipe for init process: %v", err)
 	}
 	cmd.Env = append(cmd.Env, d.envOverrides...)
+	capset, err := oz.CapabilityMask(p.Capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capabilities in profile: %v", err)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("_OZ_CAPBSET=%x", capset))
+	if p.NoNewPrivs {
+		cmd.Env = append(cmd.Env, "_OZ_NO_NEW_PRIVS=1")
+	}
+
+	dns, err := d.sandboxDNS(p)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to setup DNS: %v", err)
+	}
 
 	jdata, err := json.Marshal(ozinit.InitData{
 		Display:   display,
@@ -173,6 +218,8 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		Sockaddr:  socketPath,
 		LaunchEnv: msg.Env,
 		Ephemeral: ephemeral,
+		Id:        d.nextSboxId,
+		DNS:       dns,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to marshal init state: %+v", err)
@@ -180,8 +227,40 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	io.Copy(pi, bytes.NewBuffer(jdata))
 	pi.Close()
 
+	var recordings *os.File
+	if p.RecordShell {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create the shell recording pipe: %v", err)
+		}
+		// Passed as ozinit.RecordingFd
+		cmd.ExtraFiles = []*os.File{w}
+		defer w.Close()
+		recordings = r
+	}
+
+	pp, pw, err := d.createReports(d.nextSboxId)
+	if err != nil {
+		if recordings != nil {
+			recordings.Close()
+		}
+		return nil, fmt.Errorf("error creating report FIFO for init process: %v", err)
+	}
+	// Passed as the stderr of oz-init
+	cmd.Stderr = pw
+	defer pw.Close()
+
 	if err := cmd.Start(); err != nil {
 		//fs.Cleanup()
+		pp.Close()
+		os.Remove(d.reportsPath(d.nextSboxId))
+		if recordings != nil {
+			recordings.Close()
+		}
+		if userns {
+			os.Remove(path.Dir(socketPath))
+			return nil, fmt.Errorf("Unable to start process: %v", userNamespaceStartError(err))
+		}
 		return nil, fmt.Errorf("Unable to start process: %+v", err)
 	}
 	//rootfs := path.Join(d.config.SandboxPath, "rootfs")
@@ -199,47 +278,45 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		stderr:    pp,
 		rawEnv:    rawEnv,
 		ephemeral: ephemeral,
+		userns:    userns,
+		started:   time.Now(),
+	}
+	if recordings != nil {
+		go sbox.storeRecordings(recordings)
+	}
+
+	if err := sbox.setupCgroup(); err != nil {
+		if p.Resources != (oz.ResourcesConf{}) {
+			cmd.Process.Kill()
+			sbox.removeCgroup()
+			return nil, fmt.Errorf("Unable to apply resource limits: %v", err)
+		}
+		log.Warning("Unable to create cgroup for %s: %v", p.Name, err)
 	}
 
+	sbox.openLog()
 	sbox.ready.Add(1)
 	sbox.waiting.Add(1)
 	go sbox.logMessages()
 
 	sbox.waiting.Wait()
 
-        //pname := fmt.Sprintf("%s (%d)", sbox.profile.Name, sbox.id)
-        log.Noticef("Registering %s (%d) init pid %d with fw-daemon", sbox.profile.Name, sbox.id, sbox.init.Process.Pid)
-        err = registerSandboxPid(sbox.init.Process.Pid, sbox.profile.Name, sbox.id)
-
-        if err != nil {
- 	       log.Error("Error registering sandbox init pid with fw-daemon: ", err)
-        }
-
+	sbox.daemon.Notice("Registering %s (%d) init pid %d with fw-daemon", sbox.profile.Name, sbox.id, sbox.init.Process.Pid)
+	if err := registerSandboxPid(sbox.init.Process.Pid, sbox.profile.Name, sbox.id); err != nil {
+		sbox.daemon.Warning("Error registering sandbox init pid with fw-daemon: %v", err)
+	}
 
 	if p.Networking.Nettype == network.TYPE_BRIDGE {
 		if err := sbox.configureBridgedIface(); err != nil {
 			cmd.Process.Kill()
 			return nil, fmt.Errorf("Unable to setup bridged networking: %+v", err)
 		}
-
-		//pname := fmt.Sprintf("%s (%d)", sbox.profile.Name, sbox.id)
-//		err := registerSandboxPid(sbox.init.Process.Pid, sbox.profile.Name, sbox.id)
-//		log.Notice("Registering init pid with fw-daemon..")
-
-//		if err != nil {
-//			log.Error("Error registering sandbox init pid with fw-daemon: ", err)
-//		}
-		if len(p.Firewall) == 0 {
-			log.Notice("XXX: no firewall rules found in profile... skipping.")
-		} else {
-			log.Notice("XXX: setup virtual bridge device: ", sbox.iface.GetSandboxIP().String())
-
-			for r := 0; r < len(p.Firewall); r++ {
-				log.Noticef("XXX: whitelist = %v, dsthost = %v, dstport = %v\n", p.Firewall[r].Whitelist, p.Firewall[r].DstHost, p.Firewall[r].DstPort)
-				success, err := setupFWRule(true, p.Firewall[r].Whitelist, sbox.iface.GetSandboxIP().String(), p.Firewall[r].DstHost, uint16(p.Firewall[r].DstPort), sbox.init.Process.Pid)
-				log.Noticef("XXX: success = %v, err = %v\n", success, err)
-			}
-
+		sbox.registerDNS()
+		if err := sbox.setupFirewall(); err != nil {
+			sbox.unregisterDNS()
+			sbox.iface.Delete()
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("Unable to setup firewall: %+v", err)
 		}
 		if p.Networking.VPNConf.VpnType == "openvpn" {
 			var ovpn OpenVPN
@@ -276,7 +353,7 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		go func() {
 			sbox.ready.Wait()
 			wgNet.Wait()
-			go sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, log)
+			go sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, reply, log)
 		}()
 	}
 
@@ -288,6 +365,11 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	}
 	d.nextSboxId += 1
 	d.sandboxes = append(d.sandboxes, sbox)
+	sbox.saveState()
+	sbox.emitEvent(EventSandboxLaunched, func(ev *EventMsg) {
+		ev.Pid = sbox.init.Process.Pid
+		ev.Path = msg.Path
+	})
 	return sbox, nil
 }
 
@@ -337,7 +419,21 @@ func (sbox *Sandbox) startOpenVPN(runtoken string) (c *exec.Cmd, err error) {
 		sbox.daemon.log.Warning("OpenVPN credential locations not specified for %s (id=%d)", sbox.profile.Name, sbox.id)
 		return nil, err
 	}
-	return openvpn.StartOpenVPN(sbox.daemon.config, conf, bip, rtable, bname, authpath, runtoken)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := openvpn.StartOpenVPN(sbox.daemon.config, conf, bip, rtable, bname, authpath, runtoken, pw)
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	go func() {
+		sbox.logPipeOutput(pr, LogSourceOpenVPN, cmd.Process.Pid)
+		pr.Close()
+	}()
+	return cmd, nil
 }
 
 func (sbox *Sandbox) configureBridgedIface() error {
@@ -349,10 +445,14 @@ func (sbox *Sandbox) configureBridgedIface() error {
 	if err != nil {
 		return err
 	}
-	veth, err := br.NewVeth(sbox.id, sbox.init.Process.Pid)
+	br.ReserveStatic(sbox.daemon.staticIPBytes(bname))
+	veth, err := br.NewVeth(sbox.id, sbox.init.Process.Pid, sbox.profile.Name, sbox.profile.Networking.IpByte)
 	if err != nil {
 		return err
 	}
+	if sbox.profile.Networking.DisableIPv6 {
+		veth.DisableIPv6()
+	}
 	if err := veth.Setup(); err != nil {
 		veth.Delete()
 		return err
@@ -361,20 +461,83 @@ func (sbox *Sandbox) configureBridgedIface() error {
 	return nil
 }
 
-func (sbox *Sandbox) getBridgeName() string {
-	if name := sbox.profile.Networking.Bridge; name != "" {
-		return name
+// setupFirewall applies the firewall rules and policy of the profile to the
+// traffic of the sandbox. In the proxy dns mode, the sandbox may only send
+// DNS queries to the proxy, which applies the domain lists of the profile.
+func (sbox *Sandbox) setupFirewall() error {
+	p := sbox.profile
+	proxy := p.Networking.DNSMode == oz.PROFILE_NETWORK_DNS_PROXY
+	if len(p.Firewall) == 0 && p.FirewallPolicy != oz.PROFILE_FIREWALL_DENY && !proxy {
+		return nil
+	}
+	rules := []network.FirewallRule{}
+	for _, r := range p.Firewall {
+		fr := network.FirewallRule{
+			Allow:   r.Whitelist,
+			Proto:   string(r.Proto),
+			Port:    r.DstPort,
+			PortEnd: r.DstPortEnd,
+		}
+		if dst, ok := network.ParseFirewallHost(r.DstHost); ok {
+			fr.Dst = dst
+		} else {
+			fr.Host = r.DstHost
+		}
+		rules = append(rules, fr)
 	}
-	return "default"
+	sbox.daemon.Info("Applying %d firewall rules with policy %s to sandbox %s (id=%d)", len(rules), p.FirewallPolicy, p.Name, sbox.id)
+	return sbox.iface.SetFirewall(rules, p.FirewallPolicy == oz.PROFILE_FIREWALL_DENY, proxy)
 }
 
-func (sbox *Sandbox) launchProgram(binpath, cpath, pwd string, args []string, log *logging.Logger) {
+// staticIPBytes returns the last bytes of the static addresses of the
+// profiles attached to a bridge, along with their names. Profiles sharing
+// the same address are reported.
+func (d *daemonState) staticIPBytes(bname string) map[uint]string {
+	bytes := make(map[uint]string)
+	for _, p := range d.profiles {
+		b := p.Networking.IpByte
+		if b == 0 || p.Networking.Nettype != network.TYPE_BRIDGE || profileBridgeName(p) != bname {
+			continue
+		}
+		if other, ok := bytes[b]; ok {
+			d.Warning("Profiles %s and %s share the ip_byte %d on bridge %s, only one of them can run at a time", other, p.Name, b, bname)
+			continue
+		}
+		bytes[b] = p.Name
+	}
+	return bytes
+}
+
+func (sbox *Sandbox) getBridgeName() string {
+	return profileBridgeName(sbox.profile)
+}
+
+// launchProgram runs a program in the sandbox. If reply is set, the program
+// is waited for and its exit status sent as the answer to reply.
+func (sbox *Sandbox) launchProgram(binpath, cpath, pwd string, args []string, reply *ipc.Message, log *logging.Logger) {
 	if sbox.profile.AllowFiles {
 		sbox.whitelistArgumentFiles(binpath, pwd, args, log)
 	}
-	err := ozinit.RunProgram(sbox.addr, cpath, pwd, args)
-	if err != nil {
+	pid, exited, err := ozinit.RunProgram(sbox.addr, cpath, pwd, args, reply != nil)
+	if err == nil {
+		sbox.emitEvent(EventProgramStarted, func(ev *EventMsg) {
+			ev.Pid = pid
+			ev.Path = cpath
+			ev.Args = args
+		})
+		if reply != nil {
+			pe, ok := <-exited
+			if ok {
+				reply.Respond(&ProgramExitedMsg{Pid: pe.Pid, Status: pe.Status, Signal: pe.Signal})
+			} else {
+				reply.Respond(&ErrorMsg{"sandbox stopped before the program exited"})
+			}
+		}
+	} else {
 		log.Error("run program command failed: %v", err)
+		if reply != nil {
+			reply.Respond(&ErrorMsg{err.Error()})
+		}
 		pid := sbox.init.Process.Pid
 		err = syscall.Kill(pid, syscall.SIGTERM)
 
@@ -499,6 +662,10 @@ func (sbox *Sandbox) MountFiles(files []string, readonly bool, binpath string, l
 			sbox.mountedFiles = append(sbox.mountedFiles, mfile)
 		}
 	}
+	sbox.saveState()
+	sbox.emitEvent(EventFileMounted, func(ev *EventMsg) {
+		ev.Files = files
+	})
 	log.Info("%s", string(pout))
 	return nil
 }
@@ -520,6 +687,10 @@ func (sbox *Sandbox) UnmountFile(file, binpath string, log *logging.Logger) erro
 			sbox.mountedFiles = append(sbox.mountedFiles[:i], sbox.mountedFiles[i+1:]...)
 		}
 	}
+	sbox.saveState()
+	sbox.emitEvent(EventFileUnmounted, func(ev *EventMsg) {
+		ev.Files = []string{file}
+	})
 	log.Info("%s", string(pout))
 	return nil
 }
@@ -552,6 +723,7 @@ func (sbox *Sandbox) remove(log *logging.Logger) {
 	for _, sb := range sbox.daemon.sandboxes {
 		if sb == sbox {
 			if sb.iface != nil {
+				sb.unregisterDNS()
 				err := sb.iface.RemoveFWRules()
 
 				if err != nil {
@@ -563,6 +735,12 @@ func (sbox *Sandbox) remove(log *logging.Logger) {
 			}
 			//		sb.fs.Cleanup()
 			os.Remove(sb.addr)
+			if sb.userns {
+				os.Remove(path.Dir(sb.addr))
+			}
+			sb.removeCgroup()
+			sb.removeState()
+			sb.emitEvent(EventSandboxRemoved, nil)
 		} else {
 			sboxes = append(sboxes, sb)
 		}
@@ -571,7 +749,7 @@ func (sbox *Sandbox) remove(log *logging.Logger) {
 }
 
 func (sbox *Sandbox) logMessages() {
-	scanner := bufio.NewScanner(sbox.stderr)
+	scanner := ozinit.NewLineScanner(sbox.stderr, ozinit.MaxReportLine)
 	seenOk := false
 	seenWaiting := false
 	for scanner.Scan() {
@@ -584,43 +762,108 @@ func (sbox *Sandbox) logMessages() {
 			sbox.daemon.log.Info("oz-init (%s) is ready", sbox.profile.Name)
 			seenOk = true
 			sbox.ready.Done()
+			sbox.emitEvent(EventSandboxReady, nil)
+		} else if strings.HasPrefix(line, "EXITED ") {
+			sbox.handleProgramExit(line[len("EXITED "):])
+		} else if strings.HasPrefix(line, "OUTPUT ") {
+			sbox.logProgramOutput(line[len("OUTPUT "):])
 		} else if len(line) > 1 {
 			sbox.logLine(line)
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		// oz-init blocks once the FIFO is full if nothing drains it
+		sbox.daemon.log.Warning("[%s] Error reading oz-init output: %v", sbox.profile.Name, err)
+		io.Copy(ioutil.Discard, sbox.stderr)
+	}
 	sbox.stderr.Close()
+	if sbox.logFile != nil {
+		sbox.logFile.Close()
+	}
+}
+
+// handleProgramExit logs the exit of a process started by oz-init, reported
+// as an EXITED line followed by a ProgramExitedMsg encoded as JSON.
+func (sbox *Sandbox) handleProgramExit(data string) {
+	pe := new(ozinit.ProgramExitedMsg)
+	if err := json.Unmarshal([]byte(data), pe); err != nil {
+		sbox.daemon.log.Warning("[%s] Unable to parse child exit report: %v", sbox.profile.Name, err)
+		return
+	}
+	if pe.Signal != 0 {
+		sbox.daemon.log.Info("[%s] Process %s (pid %d) killed by signal %d", sbox.profile.Name, pe.Path, pe.Pid, pe.Signal)
+	} else {
+		sbox.daemon.log.Info("[%s] Process %s (pid %d) exited with status %d", sbox.profile.Name, pe.Path, pe.Pid, pe.Status)
+	}
+	sbox.emitEvent(EventChildExited, func(ev *EventMsg) {
+		ev.Pid = pe.Pid
+		ev.Path = pe.Path
+		ev.Status = &pe.Status
+		ev.Signal = pe.Signal
+	})
 }
 
 func (sbox *Sandbox) logLine(line string) {
 	if len(line) < 2 {
 		return
 	}
-	f := sbox.getLogFunc(line[0])
-	msg := line[2:]
-	if f != nil {
-		f("[%s] %s", sbox.profile.Name, msg)
+	if level, ok := levelFromPrefix(line[0]); ok {
+		sbox.logRecord(level, LogSourceInit, sbox.init.Process.Pid, line[2:])
 	} else {
-		sbox.daemon.log.Info("[%s] %s", sbox.profile.Name, line)
+		sbox.logRecord(logging.INFO, LogSourceInit, sbox.init.Process.Pid, line)
 	}
 }
 
-func (sbox *Sandbox) getLogFunc(c byte) func(string, ...interface{}) {
-	log := sbox.daemon.log
+// logProgramOutput logs a line output by a program launched by oz-init,
+// reported as an OUTPUT line followed by a ProgramOutput encoded as JSON.
+func (sbox *Sandbox) logProgramOutput(data string) {
+	po := new(ozinit.ProgramOutput)
+	if err := json.Unmarshal([]byte(data), po); err != nil {
+		sbox.daemon.log.Warning("[%s] Unable to parse program output: %v", sbox.profile.Name, err)
+		return
+	}
+	source := LogSourceStdout
+	if po.Stream == "stderr" {
+		source = LogSourceStderr
+	}
+	sbox.logRecord(logging.DEBUG, source, po.Pid, po.Line)
+}
+
+// levelFromPrefix returns the level of a log line of oz-init from its single
+// character prefix
+func levelFromPrefix(c byte) (logging.Level, bool) {
 	switch c {
 	case 'D':
-		return log.Debug
+		return logging.DEBUG, true
 	case 'I':
-		return log.Info
+		return logging.INFO, true
 	case 'N':
-		return log.Notice
+		return logging.NOTICE, true
 	case 'W':
-		return log.Warning
+		return logging.WARNING, true
 	case 'E':
-		return log.Error
+		return logging.ERROR, true
 	case 'C':
+		return logging.CRITICAL, true
+	}
+	return 0, false
+}
+
+func (sbox *Sandbox) getLogFunc(level logging.Level) func(string, ...interface{}) {
+	log := sbox.daemon.log
+	switch level {
+	case logging.DEBUG:
+		return log.Debug
+	case logging.NOTICE:
+		return log.Notice
+	case logging.WARNING:
+		return log.Warning
+	case logging.ERROR:
+		return log.Error
+	case logging.CRITICAL:
 		return log.Critical
 	}
-	return nil
+	return log.Info
 }
 
 func (sbox *Sandbox) startXpraClient() {
@@ -642,109 +885,69 @@ func (sbox *Sandbox) startXpraClient() {
 	sbox.xpra.Process.Env = append(sbox.rawEnv, sbox.xpra.Process.Env...)
 
 	//sbox.daemon.log.Debug("%s %s", strings.Join(sbox.xpra.Process.Env, " "), strings.Join(sbox.xpra.Process.Args, " "))
+	var pipes []io.Reader
 	if sbox.daemon.config.LogXpra {
-		sbox.setupXpraLogging()
+		pipes = sbox.setupXpraLogging()
 	}
 	if err := sbox.xpra.Process.Start(); err != nil {
 		sbox.daemon.Warning("Failed to start xpra client: %v", err)
+		return
+	}
+	for _, p := range pipes {
+		go sbox.logPipeOutput(p, LogSourceXpraClient, sbox.xpra.Process.Process.Pid)
 	}
 }
 
-func (sbox *Sandbox) setupXpraLogging() {
+func (sbox *Sandbox) setupXpraLogging() []io.Reader {
 	stdout, err := sbox.xpra.Process.StdoutPipe()
 	if err != nil {
 		sbox.daemon.Warning("Failed to create xpra stdout pipe: %v", err)
-		return
+		return nil
 	}
 	stderr, err := sbox.xpra.Process.StderrPipe()
 	if err != nil {
 		stdout.Close()
 		sbox.daemon.Warning("Failed to create xpra stderr pipe: %v", err)
+		return nil
 	}
-	go sbox.logPipeOutput(stdout, "xpra-client-stdout")
-	go sbox.logPipeOutput(stderr, "xpra-client-stderr")
+	return []io.Reader{stdout, stderr}
 }
 
-func (sbox *Sandbox) logPipeOutput(p io.Reader, label string) {
+func (sbox *Sandbox) logPipeOutput(p io.Reader, source string, pid int) {
 	scanner := bufio.NewScanner(p)
 	for scanner.Scan() {
-		line := scanner.Text()
-		sbox.daemon.log.Info("[%s] (%s) %s", sbox.profile.Name, label, line)
+		sbox.logRecord(logging.INFO, source, pid, scanner.Text())
 	}
 }
 
 const ReceiverSocketPath = "/var/run/fw-daemon/fwoz.sock"
 
-func registerSandboxPid(pid int, name string, id int) (error) {
-	c, err := net.Dial("unix", ReceiverSocketPath)
+// registerSandboxPid tells fw-daemon which sandbox the init process with pid
+// belongs to, so that it can name the sandbox in its prompts. It is best
+// effort, fw-daemon may not be running.
+func registerSandboxPid(pid int, name string, id int) error {
+	c, err := net.DialTimeout("unix", ReceiverSocketPath, 2*time.Second)
 	if err != nil {
 		return err
 	}
-
 	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
 
 	reqstr := "register-init " + strconv.Itoa(pid) + " " + name + " " + strconv.Itoa(id) + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-
-		if string(buf[0:2]) == "OK" {
-			return nil
-		}
-		if n > 2 {
-			return fmt.Errorf("Unknown response received from fw-daemon: %s", string(buf[0:n]))
-		} else if err != nil && err != io.EOF {
-			return err
-		}
-	}
-	return nil
-}
-
-func setupFWRule(add, whitelist bool, src, dst string, port uint16, pid int) (bool, error) {
-	c, err := net.Dial("unix", ReceiverSocketPath)
-	if err != nil {
-		return false, err
-	}
-
-	defer c.Close()
-
-	reqstr := ""
-
-	if add {
-		reqstr += "add "
-	} else {
-		reqstr += "remove "
+	if _, err := c.Write([]byte(reqstr)); err != nil {
+		return err
 	}
 
-	if whitelist {
-		reqstr += "whitelist"
-	} else {
-		reqstr += "blacklist"
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf[:])
+	if n >= 2 && string(buf[0:2]) == "OK" {
+		return nil
 	}
-
-	pstr := strconv.Itoa(int(port))
-
-	if port == 0 {
-		pstr = "*"
+	if n > 0 {
+		return fmt.Errorf("Unknown response received from fw-daemon: %s", string(buf[0:n]))
 	}
-
-	reqstr += " " + src + " " + dst + " " + pstr + " " + strconv.Itoa(pid) + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-		if err != nil {
-			return false, err
-		}
-		fmt.Println(string(buf[0:n]))
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("No response received from fw-daemon")
 	}
-
-
-	fmt.Println("Done.")
-	return true, nil
+	return err
 }
@@ -1,6 +1,10 @@
 package daemon
 
-import "github.com/subgraph/oz/ipc"
+import (
+	"time"
+
+	"github.com/subgraph/oz/ipc"
+)
 
 const SocketName = "@oz-control"
 
@@ -29,9 +33,9 @@ type ListProfilesMsg struct {
 }
 
 type Profile struct {
-	Index int
-	Name  string
-	Path  string
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
 }
 
 type ListProfilesResp struct {
@@ -78,6 +82,15 @@ type LaunchMsg struct {
 	Env       []string
 	Noexec    bool
 	Ephemeral bool
+	Wait      bool
+}
+
+// ProgramExitedMsg answers a LaunchMsg with Wait set once the program exits.
+// Status is -1 and Signal is set if it was killed by a signal.
+type ProgramExitedMsg struct {
+	Pid    int "ProgramExited"
+	Status int
+	Signal int
 }
 
 type ListSandboxesMsg struct {
@@ -85,12 +98,25 @@ type ListSandboxesMsg struct {
 }
 
 type SandboxInfo struct {
-	Id        int
-	Address   string
-	Profile   string
-	Mounts    []string
-	Ephemeral bool
-	InitPid int
+	Id        int              `json:"id"`
+	Address   string           `json:"address"`
+	Profile   string           `json:"profile"`
+	Mounts    []string         `json:"mounts"`
+	Ephemeral bool             `json:"ephemeral"`
+	InitPid   int              `json:"init_pid"`
+	User      string           `json:"user"`
+	Uid       uint32           `json:"uid"`
+	Started   time.Time        `json:"started"`
+	IP        string           `json:"ip"`
+	IPv6      string           `json:"ipv6"`
+	Display   int              `json:"display"`
+	Children  []SandboxProcess `json:"children"`
+}
+
+// A process running in a sandbox besides its init
+type SandboxProcess struct {
+	Pid     int    `json:"pid"`
+	Command string `json:"command"`
 }
 
 type ListSandboxesResp struct {
@@ -116,9 +142,48 @@ type UnmountFileMsg struct {
 	File string
 }
 
+// LogsMsg asks for the daemon logs. When any of Sandbox, Profile, Level,
+// Since or Until is set, it asks instead for the structured records of the
+// sandbox log files matching all of them, sent as LogRecords. Level is the
+// least severe level included.
 type LogsMsg struct {
-	Count  int "Logs"
-	Follow bool
+	Count   int "Logs"
+	Follow  bool
+	Sandbox int
+	Profile string
+	Level   string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (m *LogsMsg) filtered() bool {
+	return m.Sandbox != 0 || m.Profile != "" || m.Level != "" || !m.Since.IsZero() || !m.Until.IsZero()
+}
+
+// Sources of the structured log records of a sandbox
+const (
+	LogSourceInit       = "init"
+	LogSourceStdout     = "app-stdout"
+	LogSourceStderr     = "app-stderr"
+	LogSourceXpraClient = "xpra-client"
+	LogSourceOpenVPN    = "openvpn"
+	LogSourceDNS        = "dns"
+)
+
+// LogRecord is a line output by one of the processes of a sandbox, as stored
+// in the log file of the sandbox
+type LogRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Sandbox int       `json:"sandbox"`
+	Profile string    `json:"profile"`
+	Pid     int       `json:"pid,omitempty"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+type LogRecords struct {
+	Records []LogRecord "LogRecords"
 }
 
 type LogData struct {
@@ -145,9 +210,9 @@ type AskForwarderMsg struct {
 }
 
 type Forwarder struct {
-	Name   string "Forwarder"
-	Desc   string
-	Target string
+	Name   string `json:"name"`
+	Desc   string `json:"desc"`
+	Target string `json:"target"`
 }
 
 type ForwarderSuccessMsg struct {
@@ -156,6 +221,104 @@ type ForwarderSuccessMsg struct {
 	Port  string
 }
 
+type SandboxUsageMsg struct {
+	Id int "SandboxUsage"
+}
+
+// Resource usage of a sandbox as reported by its cgroup, a zero maximum means no limit
+type ResourceUsage struct {
+	Id            int    `json:"id"`
+	Profile       string `json:"profile"`
+	MemoryCurrent uint64 `json:"memory_current"`
+	MemoryMax     uint64 `json:"memory_max"`
+	CPUUsec       uint64 `json:"cpu_usec"`
+	PidsCurrent   uint64 `json:"pids_current"`
+	PidsMax       uint64 `json:"pids_max"`
+	IOReadBytes   uint64 `json:"io_read_bytes"`
+	IOWriteBytes  uint64 `json:"io_write_bytes"`
+}
+
+type SandboxUsageResp struct {
+	Usage []ResourceUsage "SandboxUsageResp"
+}
+
+type ReloadMsg struct {
+	_ string "Reload"
+}
+
+type ReloadResult struct {
+	File    string `json:"file"`
+	Profile string `json:"profile"`
+	Error   string `json:"error"`
+	Kept    bool   `json:"kept"`
+}
+
+type ReloadResp struct {
+	Results []ReloadResult "ReloadResp"
+}
+
+type ListRecordingsMsg struct {
+	Profile string "ListRecordings"
+}
+
+type Recording struct {
+	Profile string    `json:"profile"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+}
+
+type ListRecordingsResp struct {
+	Recordings []Recording "ListRecordingsResp"
+}
+
+// ExportRecordingMsg is answered with OkMsg along with a file descriptor open
+// on the recording.
+type ExportRecordingMsg struct {
+	Profile string "ExportRecording"
+	Name    string
+}
+
+type SubscribeMsg struct {
+	Id int "Subscribe"
+}
+
+// Types of the events streamed to subscribers
+const (
+	EventSandboxLaunched     = "sandbox-launched"
+	EventSandboxReady        = "sandbox-ready"
+	EventProgramStarted      = "program-started"
+	EventChildExited         = "child-exited"
+	EventFileMounted         = "file-mounted"
+	EventFileUnmounted       = "file-unmounted"
+	EventForwarderCreated    = "forwarder-created"
+	EventNetworkReconfigured = "network-reconfigured"
+	EventSandboxRemoved      = "sandbox-removed"
+)
+
+// An event about a sandbox, Id is 0 for events which concern the daemon as a
+// whole. Fields which do not apply to the event type are left empty.
+type EventMsg struct {
+	Type    string "Event"
+	Time    time.Time
+	Id      int      `json:",omitempty"`
+	Profile string   `json:",omitempty"`
+	User    string   `json:",omitempty"`
+	Uid     uint32   `json:"-"`
+	Pid     int      `json:",omitempty"`
+	Status  *int     `json:",omitempty"`
+	Signal  int      `json:",omitempty"`
+	Path    string   `json:",omitempty"`
+	Args    []string `json:",omitempty"`
+	Files   []string `json:",omitempty"`
+	Name    string   `json:",omitempty"`
+	Addr    string   `json:",omitempty"`
+}
+
+// ProtocolVersion of the daemon control socket, only changed by incompatible
+// changes to the messages
+const ProtocolVersion = 1
+
 var messageFactory = ipc.NewMsgFactory(
 	new(PingMsg),
 	new(OkMsg),
@@ -165,6 +328,7 @@ var messageFactory = ipc.NewMsgFactory(
 	new(ListProfilesMsg),
 	new(ListProfilesResp),
 	new(LaunchMsg),
+	new(ProgramExitedMsg),
 	new(IsRunningMsg),
 	new(GetProfileMsg),
 	new(GetProfileResp),
@@ -176,6 +340,10 @@ var messageFactory = ipc.NewMsgFactory(
 	new(UnmountFileMsg),
 	new(LogsMsg),
 	new(LogData),
+	new(LogRecords),
+	new(ListRecordingsMsg),
+	new(ListRecordingsResp),
+	new(ExportRecordingMsg),
 	new(AskForwarderMsg),
 	new(ForwarderSuccessMsg),
 	new(ListForwardersMsg),
@@ -184,4 +352,10 @@ var messageFactory = ipc.NewMsgFactory(
 	new(ListBridgesResp),
 	new(ListProxiesMsg),
 	new(ListProxiesResp),
-)
+	new(SandboxUsageMsg),
+	new(SandboxUsageResp),
+	new(ReloadMsg),
+	new(ReloadResp),
+	new(SubscribeMsg),
+	new(EventMsg),
+).WithProtocol(ProtocolVersion)
@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/oz-init"
+)
+
+// Extension of the asciicast files written by oz-init for recorded shells
+const recordingExt = ".cast"
+
+// createSandboxLogDir creates the log directory of a profile. Only the
+// daemon writes there, shell recordings included.
+func (d *daemonState) createSandboxLogDir(p *oz.Profile) error {
+	dir := d.config.SandboxLogDir(p)
+	if err := os.MkdirAll(path.Dir(dir), 0711); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// storeRecordings writes the lines of the shell recordings sent by oz-init
+// on r to the log directory of the profile. Each recording goes to a new file
+// created by the daemon, so that the sandbox cannot tamper with the others.
+// The pipe is closed if a recording cannot be written, which hangs up the
+// shells of the sandbox rather than leaving them unrecorded.
+func (sbox *Sandbox) storeRecordings(r *os.File) {
+	defer r.Close()
+	dir := sbox.daemon.config.SandboxLogDir(sbox.profile)
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	sc := ozinit.NewLineScanner(r, ozinit.MaxReportLine)
+	for sc.Scan() {
+		var rl ozinit.RecordingLine
+		if err := json.Unmarshal(sc.Bytes(), &rl); err != nil {
+			sbox.daemon.Warning("[%s] Invalid shell recording line: %v", sbox.profile.Name, err)
+			return
+		}
+		f := files[rl.Name]
+		if rl.Close {
+			if f != nil {
+				f.Close()
+				delete(files, rl.Name)
+			}
+			continue
+		}
+		if f == nil {
+			if !isPlainName(rl.Name) || !strings.HasPrefix(rl.Name, "shell-") || !strings.HasSuffix(rl.Name, recordingExt) {
+				sbox.daemon.Warning("[%s] Invalid shell recording name `%s`", sbox.profile.Name, rl.Name)
+				return
+			}
+			var err error
+			f, err = os.OpenFile(path.Join(dir, rl.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				sbox.daemon.Error("[%s] Unable to create shell recording: %v", sbox.profile.Name, err)
+				return
+			}
+			files[rl.Name] = f
+		}
+		if _, err := f.Write(append([]byte(rl.Line), '\n')); err != nil {
+			sbox.daemon.Error("[%s] Unable to write shell recording %s: %v", sbox.profile.Name, rl.Name, err)
+			return
+		}
+	}
+}
+
+func (d *daemonState) handleListRecordings(msg *ListRecordingsMsg, m *ipc.Message) error {
+	if msg.Profile != "" && !isPlainName(msg.Profile) {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("invalid profile name `%s`", msg.Profile)})
+	}
+	recs := []Recording{}
+	for p, dir := range d.logDirs(msg.Profile) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return m.Respond(&ErrorMsg{err.Error()})
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), recordingExt) {
+				recs = append(recs, Recording{Profile: p, Name: fi.Name(), Size: fi.Size(), Time: fi.ModTime()})
+			}
+		}
+	}
+	sort.Sort(recordingsByTime(recs))
+	return m.Respond(&ListRecordingsResp{Recordings: recs})
+}
+
+func (d *daemonState) handleExportRecording(msg *ExportRecordingMsg, m *ipc.Message) error {
+	if !isPlainName(msg.Profile) || !isPlainName(msg.Name) || !strings.HasSuffix(msg.Name, recordingExt) {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("invalid recording `%s/%s`", msg.Profile, msg.Name)})
+	}
+	f, err := os.Open(path.Join(d.logDirs(msg.Profile)[msg.Profile], msg.Name))
+	if err != nil {
+		return m.Respond(&ErrorMsg{err.Error()})
+	}
+	defer f.Close()
+	d.Info("Exporting shell recording %s/%s to uid %d", msg.Profile, msg.Name, m.Ucred.Uid)
+	return m.Respond(&OkMsg{}, int(f.Fd()))
+}
+
+type recordingsByTime []Recording
+
+func (r recordingsByTime) Len() int           { return len(r) }
+func (r recordingsByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r recordingsByTime) Less(i, j int) bool { return r[i].Time.Before(r[j].Time) }
+
+// isPlainName returns true if name can be used as a single path element
+func isPlainName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
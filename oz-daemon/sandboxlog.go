@@ -0,0 +1,355 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+)
+
+// Prefix of the log files of the sandboxes in the log directories
+const sandboxLogPrefix = "sandbox-"
+
+var errLogClosed = errors.New("log file is closed")
+
+// rotatingFile is a log file renamed with a numbered suffix once it reaches
+// its maximum size, keeping a limited number of the previous files.
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
+
+func openRotatingFile(fpath string, maxSize int64, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: fpath, maxSize: maxSize, keep: keep}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(bs []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.f == nil {
+		return 0, errLogClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(bs)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(bs)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+	for i := rf.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.keep > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// openLog creates the log file of the sandbox in the log directory of its
+// profile, named after its start time and id since ids are reused after the
+// daemon restarts.
+func (sbox *Sandbox) openLog() {
+	c := sbox.daemon.config
+	var maxSize uint64
+	if c.LogMaxSize != "" {
+		var err error
+		if maxSize, err = oz.ParseMemorySize(c.LogMaxSize); err != nil {
+			sbox.daemon.Warning("Invalid log_max_size `%s`, sandbox logs are not rotated: %v", c.LogMaxSize, err)
+		}
+	}
+	name := fmt.Sprintf("%s%s-%d.log", sandboxLogPrefix, sbox.started.Format("20060102-150405"), sbox.id)
+	rf, err := openRotatingFile(path.Join(c.SandboxLogDir(sbox.profile), name), int64(maxSize), c.LogMaxFiles)
+	if err != nil {
+		sbox.daemon.Warning("Unable to open the log file of sandbox %d: %v", sbox.id, err)
+		return
+	}
+	sbox.logFile = rf
+	sbox.daemon.pruneLogs(c.SandboxLogDir(sbox.profile))
+}
+
+// pruneLogs removes the log files of the oldest sandboxes of a log directory
+// but the last log_max_sandboxes ones, along with their rotated files. The
+// log files of running sandboxes are kept.
+func (d *daemonState) pruneLogs(dir string) {
+	if d.config.LogMaxSandboxes <= 0 {
+		return
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	running := make(map[string]bool)
+	for _, sbox := range d.sandboxes {
+		if sbox.logFile != nil {
+			running[path.Base(sbox.logFile.path)] = true
+		}
+	}
+	files := make(map[string][]string)
+	logs := []string{}
+	for _, fi := range fis {
+		i := strings.Index(fi.Name(), ".log")
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), sandboxLogPrefix) || i == -1 {
+			continue
+		}
+		base := fi.Name()[:i+len(".log")]
+		if files[base] == nil {
+			logs = append(logs, base)
+		}
+		files[base] = append(files[base], fi.Name())
+	}
+	// Names start with the start time of the sandbox
+	sort.Strings(logs)
+	for i := 0; i < len(logs)-d.config.LogMaxSandboxes; i++ {
+		base := logs[i]
+		if running[base] {
+			continue
+		}
+		for _, name := range files[base] {
+			if err := os.Remove(path.Join(dir, name)); err != nil {
+				d.Warning("Unable to remove old sandbox log %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// logRecord logs a line output by a process of the sandbox to the daemon log,
+// and as a structured record to the log file of the sandbox and to the
+// followers of the structured logs.
+func (sbox *Sandbox) logRecord(level logging.Level, source string, pid int, msg string) {
+	f := sbox.getLogFunc(level)
+	if source == LogSourceInit {
+		f("[%s] %s", sbox.profile.Name, msg)
+	} else {
+		f("[%s] (%s) %s", sbox.profile.Name, source, msg)
+	}
+	rec := &LogRecord{
+		Time:    time.Now(),
+		Level:   level.String(),
+		Sandbox: sbox.id,
+		Profile: sbox.profile.Name,
+		Pid:     pid,
+		Source:  source,
+		Message: msg,
+	}
+	if sbox.logFile != nil {
+		if bs, err := json.Marshal(rec); err == nil {
+			sbox.logFile.Write(append(bs, '\n'))
+		}
+	}
+	sbox.daemon.followLogRecord(rec)
+}
+
+// logFilter selects the structured records matching every criteria set in a
+// LogsMsg
+type logFilter struct {
+	msg   *LogsMsg
+	level logging.Level
+}
+
+func newLogFilter(msg *LogsMsg) (*logFilter, error) {
+	lf := &logFilter{msg: msg, level: logging.DEBUG}
+	if msg.Level != "" {
+		level, err := logging.LogLevel(msg.Level)
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level `%s`", msg.Level)
+		}
+		lf.level = level
+	}
+	return lf, nil
+}
+
+func (lf *logFilter) matches(rec *LogRecord) bool {
+	if lf.msg.Sandbox != 0 && rec.Sandbox != lf.msg.Sandbox {
+		return false
+	}
+	if lf.msg.Profile != "" && rec.Profile != lf.msg.Profile {
+		return false
+	}
+	if level, err := logging.LogLevel(rec.Level); err == nil && level > lf.level {
+		return false
+	}
+	if !lf.msg.Since.IsZero() && rec.Time.Before(lf.msg.Since) {
+		return false
+	}
+	if !lf.msg.Until.IsZero() && rec.Time.After(lf.msg.Until) {
+		return false
+	}
+	return true
+}
+
+type recordFollower struct {
+	rq     *responseQueue
+	filter *logFilter
+}
+
+// followLogRecord queues a record for the followers it matches. Followers
+// whose connection went away or which fall behind are dropped.
+func (d *daemonState) followLogRecord(rec *LogRecord) {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+	followers := []*recordFollower{}
+	for _, rf := range d.logFollowers {
+		if rf.filter.matches(rec) && !rf.rq.send(&LogRecords{Records: []LogRecord{*rec}}) {
+			continue
+		}
+		followers = append(followers, rf)
+	}
+	d.logFollowers = followers
+}
+
+// Number of records sent in a single LogRecords message
+const logRecordsBatch = 100
+
+// handleLogRecords acknowledges a filtered LogsMsg with OkMsg, then sends
+// the matching structured records of the sandbox log files, oldest first,
+// and another OkMsg unless the new records are followed.
+func (d *daemonState) handleLogRecords(msg *LogsMsg, m *ipc.Message) error {
+	filter, err := newLogFilter(msg)
+	if err != nil {
+		return m.Respond(&ErrorMsg{err.Error()})
+	}
+	if err := m.Respond(&OkMsg{}); err != nil {
+		return err
+	}
+	recs := []LogRecord{}
+	for _, dir := range d.logDirs(msg.Profile) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				d.Warning("Unable to read log directory %s: %v", dir, err)
+			}
+			continue
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), sandboxLogPrefix) || !strings.Contains(fi.Name(), ".log") {
+				continue
+			}
+			if !msg.Since.IsZero() && fi.ModTime().Before(msg.Since) {
+				continue
+			}
+			recs = readLogRecords(path.Join(dir, fi.Name()), filter, recs)
+		}
+	}
+	sort.Stable(recordsByTime(recs))
+	for len(recs) > 0 {
+		n := len(recs)
+		if n > logRecordsBatch {
+			n = logRecordsBatch
+		}
+		if err := m.Respond(&LogRecords{Records: recs[:n]}); err != nil {
+			return err
+		}
+		recs = recs[n:]
+	}
+	if msg.Follow {
+		d.logLock.Lock()
+		d.logFollowers = append(d.logFollowers, &recordFollower{rq: newResponseQueue(m), filter: filter})
+		d.logLock.Unlock()
+		return nil
+	}
+	return m.Respond(&OkMsg{})
+}
+
+func readLogRecords(fpath string, filter *logFilter, recs []LogRecord) []LogRecord {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return recs
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if filter.matches(&rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// logDirs returns the log directories of the profiles by profile name, or
+// only the one of the given profile. Directories under the log path left by
+// profiles which no longer exist are included.
+func (d *daemonState) logDirs(profile string) map[string]string {
+	dirs := make(map[string]string)
+	for _, p := range d.profiles {
+		if profile == "" || p.Name == profile {
+			dirs[p.Name] = d.config.SandboxLogDir(p)
+		}
+	}
+	if profile != "" {
+		if _, ok := dirs[profile]; !ok && isPlainName(profile) {
+			dirs[profile] = path.Join(d.config.LogPath, profile)
+		}
+		return dirs
+	}
+	fis, _ := ioutil.ReadDir(d.config.LogPath)
+	for _, fi := range fis {
+		if _, ok := dirs[fi.Name()]; !ok && fi.IsDir() {
+			dirs[fi.Name()] = path.Join(d.config.LogPath, fi.Name())
+		}
+	}
+	return dirs
+}
+
+type recordsByTime []LogRecord
+
+func (r recordsByTime) Len() int           { return len(r) }
+func (r recordsByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r recordsByTime) Less(i, j int) bool { return r[i].Time.Before(r[j].Time) }
@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/subgraph/oz"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "sandbox.log")
+	rf, err := openRotatingFile(fpath, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"12345\n", "abcdef\n", "xyz\n", "last\n", "overflow12\n"} {
+		if _, err := rf.Write([]byte(l)); err != nil {
+			t.Fatalf("error writing %q: %v", l, err)
+		}
+	}
+	rf.Close()
+	if _, err := rf.Write([]byte("closed\n")); err != errLogClosed {
+		t.Errorf("write to closed log returned %v", err)
+	}
+
+	want := map[string]string{
+		"sandbox.log":   "overflow12\n",
+		"sandbox.log.1": "xyz\nlast\n",
+		"sandbox.log.2": "abcdef\n",
+	}
+	fis, _ := ioutil.ReadDir(dir)
+	if len(fis) != len(want) {
+		t.Errorf("%d files left after rotation, expected %d", len(fis), len(want))
+	}
+	for name, data := range want {
+		bs, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Errorf("unable to read %s: %v", name, err)
+		} else if string(bs) != data {
+			t.Errorf("%s holds %q, expected %q", name, bs, data)
+		}
+	}
+}
+
+func TestPruneLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := []string{
+		"sandbox-20260101-000000-1.log",
+		"sandbox-20260101-000000-1.log.1",
+		"sandbox-20260102-000000-2.log",
+		"sandbox-20260102-000000-2.log.1",
+		"sandbox-20260103-000000-3.log",
+		"sandbox-20260104-000000-1.log",
+		"notes.txt",
+	}
+	for _, n := range names {
+		if err := ioutil.WriteFile(path.Join(dir, n), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &daemonState{
+		config: &oz.Config{LogMaxSandboxes: 2},
+		sandboxes: []*Sandbox{
+			{logFile: &rotatingFile{path: path.Join(dir, "sandbox-20260101-000000-1.log")}},
+		},
+	}
+	d.pruneLogs(dir)
+
+	// The oldest log is kept while its sandbox runs
+	want := []string{
+		"notes.txt",
+		"sandbox-20260101-000000-1.log",
+		"sandbox-20260101-000000-1.log.1",
+		"sandbox-20260103-000000-3.log",
+		"sandbox-20260104-000000-1.log",
+	}
+	got := []string{}
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pruneLogs() left %v, expected %v", got, want)
+	}
+}
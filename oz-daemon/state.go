@@ -0,0 +1,346 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/fs"
+	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/oz-init"
+
+	"github.com/milosgajdos83/tenus"
+)
+
+// How often sandboxes adopted from a previous instance of the daemon are
+// checked for exit, since they are no longer our children and cannot be reaped
+const adoptedPollInterval = 2 * time.Second
+
+// sandboxState is the record of a running sandbox kept in the state directory
+// so that it can be found again if the daemon is restarted
+type sandboxState struct {
+	Id           int
+	Profile      oz.Profile
+	InitPid      int
+	InitStart    uint64
+	Addr         string
+	Display      int
+	Uid          uint32
+	Gid          uint32
+	Gids         []uint32
+	Bridge       string
+	Veth         string
+	VethPeer     string
+	SandboxIP    string
+	SandboxIP6   string
+	OVPNRunToken string
+	Cgroup       string
+	UserNs       bool
+	MountedFiles []string
+	Ephemeral    bool
+	RawEnv       []string
+	Started      time.Time
+}
+
+func (sbox *Sandbox) statePath() string {
+	return path.Join(sbox.daemon.config.StatePath, fmt.Sprintf("%d.json", sbox.id))
+}
+
+// reportsPath is the FIFO passed as stderr to the init process of sandbox
+// id, on which it reports to the daemon
+func (d *daemonState) reportsPath(id int) string {
+	return path.Join(d.config.StatePath, fmt.Sprintf("%d.fifo", id))
+}
+
+// createReports creates the FIFO on which the init process of sandbox id
+// reports to the daemon, and returns its read end along with the write end
+// to pass to the init process. Unlike a pipe it can be opened again by the
+// next instance of the daemon if this one exits.
+func (d *daemonState) createReports(id int) (*os.File, *os.File, error) {
+	if err := os.MkdirAll(d.config.StatePath, 0700); err != nil {
+		return nil, nil, err
+	}
+	fpath := d.reportsPath(id)
+	os.Remove(fpath)
+	if err := syscall.Mkfifo(fpath, 0600); err != nil {
+		return nil, nil, err
+	}
+	r, err := openReports(fpath)
+	if err != nil {
+		os.Remove(fpath)
+		return nil, nil, err
+	}
+	w, err := os.OpenFile(fpath, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		os.Remove(fpath)
+		return nil, nil, err
+	}
+	return r, w, nil
+}
+
+// openReports opens the read end of a report FIFO. It does not wait for a
+// writer, and reading it ends once the init process has exited.
+func openReports(fpath string) (*os.File, error) {
+	return os.OpenFile(fpath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+}
+
+// saveState writes the record of the sandbox to the state directory
+func (sbox *Sandbox) saveState() {
+	st := sandboxState{
+		Id:           sbox.id,
+		Profile:      *sbox.profile,
+		InitPid:      sbox.init.Process.Pid,
+		Addr:         sbox.addr,
+		Display:      sbox.display,
+		Uid:          sbox.cred.Uid,
+		Gid:          sbox.cred.Gid,
+		Gids:         sbox.cred.Groups,
+		MountedFiles: sbox.mountedFiles,
+		Ephemeral:    sbox.ephemeral,
+		RawEnv:       sbox.rawEnv,
+		Cgroup:       sbox.cgroup,
+		UserNs:       sbox.userns,
+		Started:      sbox.started,
+	}
+	st.InitStart, _ = processStartTime(st.InitPid)
+	if sbox.iface != nil {
+		st.Bridge = sbox.getBridgeName()
+		st.Veth = sbox.iface.NetInterface().Name
+		st.VethPeer = sbox.iface.PeerNetInterface().Name
+		if ip := sbox.iface.GetSandboxIP(); ip != nil {
+			st.SandboxIP = ip.String()
+		}
+		if ip := sbox.iface.GetSandboxIP6(); ip != nil {
+			st.SandboxIP6 = ip.String()
+		}
+	}
+	if sbox.ovpn != nil {
+		st.OVPNRunToken = sbox.ovpn.runtoken
+	}
+
+	jdata, err := json.Marshal(st)
+	if err != nil {
+		sbox.daemon.Warning("Unable to marshal state of sandbox %s (id=%d): %v", sbox.profile.Name, sbox.id, err)
+		return
+	}
+	if err := os.MkdirAll(sbox.daemon.config.StatePath, 0700); err != nil {
+		sbox.daemon.Warning("Unable to create state directory: %v", err)
+		return
+	}
+	spath := sbox.statePath()
+	if err := ioutil.WriteFile(spath+".tmp", jdata, 0600); err != nil {
+		sbox.daemon.Warning("Unable to write state of sandbox %s (id=%d): %v", sbox.profile.Name, sbox.id, err)
+		return
+	}
+	if err := os.Rename(spath+".tmp", spath); err != nil {
+		sbox.daemon.Warning("Unable to write state of sandbox %s (id=%d): %v", sbox.profile.Name, sbox.id, err)
+	}
+}
+
+func (sbox *Sandbox) removeState() {
+	if err := os.Remove(sbox.statePath()); err != nil && !os.IsNotExist(err) {
+		sbox.daemon.Warning("Unable to remove state of sandbox %s (id=%d): %v", sbox.profile.Name, sbox.id, err)
+	}
+	os.Remove(sbox.daemon.reportsPath(sbox.id))
+}
+
+// processStartTime returns the start time of a process in clock ticks since
+// boot, which together with the pid uniquely identifies the process
+func processStartTime(pid int) (uint64, error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, fields are counted from its end
+	stat := string(bs)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// recoverSandboxes reads the records left in the state directory by a previous
+// instance of the daemon. Sandboxes which are still running are adopted, and
+// whatever was left behind by the others is cleaned up.
+func (d *daemonState) recoverSandboxes() {
+	fis, err := ioutil.ReadDir(d.config.StatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.Warning("Unable to read sandbox state directory: %v", err)
+		}
+		return
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		spath := path.Join(d.config.StatePath, fi.Name())
+		bs, err := ioutil.ReadFile(spath)
+		if err != nil {
+			d.Warning("Unable to read sandbox state %s: %v", spath, err)
+			continue
+		}
+		st := new(sandboxState)
+		if err := json.Unmarshal(bs, st); err != nil {
+			d.Warning("Unable to parse sandbox state %s, removing it: %v", spath, err)
+			os.Remove(spath)
+			continue
+		}
+		if st.Id >= d.nextSboxId {
+			d.nextSboxId = st.Id + 1
+		}
+		if !st.isAlive() {
+			d.Notice("Sandbox %s (id=%d) is gone, cleaning up", st.Profile.Name, st.Id)
+			d.cleanupSandboxState(st)
+			os.Remove(spath)
+			os.Remove(d.reportsPath(st.Id))
+			continue
+		}
+		sbox, err := d.adoptSandbox(st)
+		if err != nil {
+			d.Warning("Unable to adopt sandbox %s (id=%d): %v", st.Profile.Name, st.Id, err)
+			continue
+		}
+		if st.Display >= d.nextDisplay {
+			d.nextDisplay = st.Display + 1
+		}
+		d.Notice("Adopted running sandbox %s (id=%d, init pid %d)", st.Profile.Name, st.Id, st.InitPid)
+		sbox.saveState()
+		sbox.openLog()
+		if sbox.stderr != nil {
+			go sbox.logMessages()
+		}
+		if sbox.profile.XServer.Enabled {
+			// The client of the previous instance has the daemon
+			// as parent and may be gone, a new one replaces it on
+			// the xpra server otherwise
+			go sbox.startXpraClient()
+		}
+		go d.watchAdoptedSandbox(sbox)
+	}
+}
+
+// isAlive checks that the init process of the sandbox is the one recorded and
+// that it still answers on its control socket
+func (st *sandboxState) isAlive() bool {
+	start, err := processStartTime(st.InitPid)
+	if err != nil || start != st.InitStart {
+		return false
+	}
+	return ozinit.Ping(st.Addr) == nil
+}
+
+func (d *daemonState) adoptSandbox(st *sandboxState) (*Sandbox, error) {
+	proc, err := os.FindProcess(st.InitPid)
+	if err != nil {
+		return nil, err
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(st.Uid), 10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user with uid=%d: %v", st.Uid, err)
+	}
+	p := st.Profile
+	sbox := &Sandbox{
+		daemon:       d,
+		id:           st.Id,
+		display:      st.Display,
+		profile:      &p,
+		init:         &exec.Cmd{Process: proc},
+		cred:         &syscall.Credential{Uid: st.Uid, Gid: st.Gid, Groups: st.Gids},
+		user:         u,
+		fs:           fs.NewFilesystem(d.config, d.log, u, &p),
+		addr:         st.Addr,
+		rawEnv:       st.RawEnv,
+		mountedFiles: st.MountedFiles,
+		ephemeral:    st.Ephemeral,
+		cgroup:       st.Cgroup,
+		userns:       st.UserNs,
+		started:      st.Started,
+	}
+	if st.Veth != "" {
+		br, err := d.bridges.GetBridge(st.Bridge)
+		if err != nil {
+			return nil, err
+		}
+		veth, err := br.AdoptVeth(st.Id, st.InitPid, st.Veth, st.VethPeer, net.ParseIP(st.SandboxIP), net.ParseIP(st.SandboxIP6), st.Profile.Name)
+		if err != nil {
+			d.Warning("Sandbox %s (id=%d) will have no network: %v", st.Profile.Name, st.Id, err)
+		} else {
+			sbox.iface = veth
+			sbox.registerDNS()
+			if err := sbox.setupFirewall(); err != nil {
+				d.Warning("Unable to apply the firewall rules of sandbox %s (id=%d): %v", st.Profile.Name, st.Id, err)
+			}
+		}
+	}
+	if st.OVPNRunToken != "" {
+		sbox.ovpn = &OpenVPN{runtoken: st.OVPNRunToken}
+	}
+	if reports, err := openReports(d.reportsPath(st.Id)); err != nil {
+		d.Warning("Messages of sandbox %s (id=%d) will not be logged: %v", st.Profile.Name, st.Id, err)
+	} else {
+		sbox.stderr = reports
+	}
+	d.sandboxes = append(d.sandboxes, sbox)
+	return sbox, nil
+}
+
+// watchAdoptedSandbox waits for the exit of the init process of a sandbox
+// adopted on startup and then has the dispatcher clean up after it, as
+// handleChildExit does for our own children
+func (d *daemonState) watchAdoptedSandbox(sbox *Sandbox) {
+	pid := sbox.init.Process.Pid
+	start, _ := processStartTime(pid)
+	for {
+		time.Sleep(adoptedPollInterval)
+		if s, err := processStartTime(pid); err != nil || s != start {
+			break
+		}
+	}
+	d.calls <- func() {
+		d.Debug("Adopted sandbox %s (id=%d) init pid %d exited", sbox.profile.Name, sbox.id, pid)
+		sbox.emitEvent(EventChildExited, func(ev *EventMsg) {
+			ev.Pid = pid
+		})
+		d.cleanupSandbox(sbox)
+	}
+}
+
+// cleanupSandboxState releases the resources recorded for a sandbox which
+// exited while the daemon was not running
+func (d *daemonState) cleanupSandboxState(st *sandboxState) {
+	if st.SandboxIP != "" {
+		if err := network.RemoveFWRulesForIP(net.ParseIP(st.SandboxIP)); err != nil {
+			d.Debug("Could not remove firewall rules for %s: %v", st.SandboxIP, err)
+		}
+	}
+	if st.Veth != "" {
+		if err := tenus.DeleteLink(st.Veth); err != nil {
+			d.Debug("Could not delete veth %s: %v", st.Veth, err)
+		}
+	}
+	if st.OVPNRunToken != "" {
+		d.stopOpenVPN(st.OVPNRunToken)
+	}
+	if st.Cgroup != "" {
+		if err := removeCgroupDir(st.Cgroup); err != nil {
+			d.Debug("Could not remove cgroup %s: %v", st.Cgroup, err)
+		}
+	}
+	os.Remove(st.Addr)
+	if st.UserNs {
+		os.Remove(path.Dir(st.Addr))
+	}
+}
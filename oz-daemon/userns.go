@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/subgraph/oz"
+)
+
+// userNamespaceEnabled returns true if sandboxes of profile p run in a user namespace
+func (d *daemonState) userNamespaceEnabled(p *oz.Profile) bool {
+	return d.config.UserNamespaces || p.UserNamespace
+}
+
+// checkUserNamespaces reports why user namespaces cannot be created on this system, if so
+func checkUserNamespaces() error {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return errors.New("the kernel was built without user namespace support")
+	}
+	if readSysctl("user/max_user_namespaces") == "0" {
+		return errors.New("user namespaces are disabled (user.max_user_namespaces = 0)")
+	}
+	return nil
+}
+
+// userNamespaceStartError explains a failure to clone the init process in a user namespace
+func userNamespaceStartError(err error) error {
+	msg := "unable to create user namespace: " + err.Error()
+	if readSysctl("kernel/unprivileged_userns_clone") == "0" {
+		msg += " (kernel.unprivileged_userns_clone is disabled)"
+	}
+	return errors.New(msg)
+}
+
+func readSysctl(name string) string {
+	bs, err := ioutil.ReadFile(path.Join("/proc/sys", name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bs))
+}
+
+// setUserNamespace makes cmd clone a new user namespace where root is mapped to
+// the unprivileged id configured for the daemon. The user and its groups keep
+// their ids so that files shared with the sandbox have the same owners.
+func setUserNamespace(cmd *exec.Cmd, rootId, uid, gid uint32, groups []uint32) {
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	cmd.SysProcAttr.UidMappings = userNamespaceMappings(rootId, []uint32{uid})
+	cmd.SysProcAttr.GidMappings = userNamespaceMappings(rootId, append([]uint32{gid}, groups...))
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+}
+
+func userNamespaceMappings(rootId uint32, ids []uint32) []syscall.SysProcIDMap {
+	maps := []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(rootId), Size: 1}}
+	seen := map[uint32]bool{0: true, rootId: true}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		maps = append(maps, syscall.SysProcIDMap{ContainerID: int(id), HostID: int(id), Size: 1})
+	}
+	return maps
+}
+
+// prepareUserNamespace creates what oz-init needs to write to on the host before
+// it is inside the sandbox, since root in the namespace is not allowed to write
+// to directories owned by the real root. It returns the address of the control
+// socket, placed in a directory of its own owned by the namespace root.
+func (d *daemonState) prepareUserNamespace(socketPath string) (string, error) {
+	if err := os.MkdirAll(path.Join(d.config.SandboxPath, "rootfs"), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(socketPath, 0711); err != nil {
+		return "", err
+	}
+	id := int(d.config.UserNamespaceId)
+	if err := os.Chown(socketPath, id, id); err != nil {
+		os.Remove(socketPath)
+		return "", err
+	}
+	return path.Join(socketPath, "control"), nil
+}
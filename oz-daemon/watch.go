@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/subgraph/oz"
+
+	"golang.org/x/sys/unix"
+)
+
+// Editors often write a file in several steps, so changes are collected for
+// a short while before the configuration and profiles are reloaded
+const reloadDelay = 500 * time.Millisecond
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_CREATE | unix.IN_DELETE
+
+type configWatcher struct {
+	daemon     *daemonState
+	fd         int
+	lock       sync.Mutex
+	watches    map[int]string
+	policyPath string // Paths of the configuration being watched, kept
+	profileDir string // here since it is replaced by the dispatcher
+	timer      *time.Timer
+}
+
+func (d *daemonState) startConfigWatcher() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &configWatcher{
+		daemon:  d,
+		fd:      fd,
+		watches: make(map[int]string),
+	}
+	w.watchDirectories()
+	d.watcher = w
+	go w.readLoop()
+	return nil
+}
+
+// watchDirectories updates the watches to cover the directory of the
+// configuration file, the one of the policy file, the profile directory and
+// its subdirectories. Directories which are still watched keep their watch,
+// so that no change is missed while the watches are updated.
+func (w *configWatcher) watchDirectories() {
+	pdir := w.daemon.config.ProfileDir
+	dirs := []string{path.Dir(oz.DefaultConfigPath), path.Dir(w.daemon.config.PolicyPath), pdir}
+	fis, err := ioutil.ReadDir(pdir)
+	if err != nil {
+		w.daemon.Warning("Unable to list profile directory %s: %v", pdir, err)
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			dirs = append(dirs, path.Join(pdir, fi.Name()))
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.policyPath = w.daemon.config.PolicyPath
+	w.profileDir = pdir
+	watches := make(map[int]string)
+	for _, dir := range dirs {
+		// An existing watch on the directory is returned again
+		wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			w.daemon.Warning("Unable to watch %s for changes: %v", dir, err)
+			continue
+		}
+		watches[wd] = dir
+	}
+	for wd := range w.watches {
+		if _, ok := watches[wd]; !ok {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+	w.watches = watches
+}
+
+func (w *configWatcher) readLoop() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			w.daemon.Error("Error reading inotify events, profiles will no longer be reloaded automatically: %v", err)
+			return
+		}
+		changed := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nstart := off + unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nstart:nstart+int(ev.Len)], "\x00"))
+			off = nstart + int(ev.Len)
+			if w.isRelevant(int(ev.Wd), ev.Mask, name) {
+				changed = true
+			}
+		}
+		if changed {
+			w.scheduleReload()
+		}
+	}
+}
+
+func (w *configWatcher) isRelevant(wd int, mask uint32, name string) bool {
+	w.lock.Lock()
+	dir, ok := w.watches[wd]
+	policyPath, profileDir := w.policyPath, w.profileDir
+	w.lock.Unlock()
+	if !ok || name == "" {
+		return false
+	}
+	fpath := path.Join(dir, name)
+	switch {
+	case fpath == oz.DefaultConfigPath, fpath == policyPath:
+		return true
+	case !strings.HasPrefix(fpath, profileDir):
+		return false
+	case mask&unix.IN_ISDIR != 0:
+		// A fragment directory was added or removed
+		return true
+	}
+	return strings.HasSuffix(name, ".json")
+}
+
+func (w *configWatcher) scheduleReload() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(reloadDelay, func() {
+		w.daemon.Notice("Change detected in configuration or profiles, reloading.")
+		w.daemon.requestReload()
+	})
+}
@@ -3,6 +3,8 @@ package ozinit
 import (
 	"errors"
 	"fmt"
+	"os"
+
 	"github.com/subgraph/oz/ipc"
 )
 
@@ -21,7 +23,10 @@ func clientSend(addr string, msg interface{}) (*ipc.Message, error) {
 		return nil, err
 	}
 
-	resp := <-rr.Chan()
+	resp, ok := <-rr.Chan()
+	if !ok {
+		return nil, errors.New("connection closed by oz-init")
+	}
 	rr.Done()
 	return resp, nil
 }
@@ -41,26 +46,53 @@ func Ping(addr string) error {
 	}
 }
 
-func RunProgram(addr, cpath, pwd string, args []string) error {
+// RunProgram starts a program in the sandbox and returns its pid. When wait
+// is set, the exit of the program is sent on the returned channel, which is
+// closed without a value if the connection to oz-init is lost first.
+func RunProgram(addr, cpath, pwd string, args []string, wait bool) (int, <-chan *ProgramExitedMsg, error) {
 	c, err := clientConnect(addr)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	rr, err := c.ExchangeMsg(&RunProgramMsg{Path: cpath, Args: args, Pwd: pwd})
-	resp := <-rr.Chan()
-	rr.Done()
-	c.Close()
+	rr, err := c.ExchangeMsg(&RunProgramMsg{Path: cpath, Args: args, Pwd: pwd, Wait: wait})
 	if err != nil {
-		return err
+		c.Close()
+		return 0, nil, err
+	}
+	resp, ok := <-rr.Chan()
+	if !ok {
+		rr.Done()
+		c.Close()
+		return 0, nil, errors.New("connection closed by oz-init")
 	}
+	var pid int
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
-		return errors.New(body.Msg)
-	case *OkMsg:
-		return nil
+		err = errors.New(body.Msg)
+	case *ProgramStartedMsg:
+		pid = body.Pid
 	default:
-		return fmt.Errorf("Unexpected message type received: %+v", body)
+		err = fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+	if err != nil || !wait {
+		rr.Done()
+		c.Close()
+		return pid, nil, err
 	}
+	exited := make(chan *ProgramExitedMsg, 1)
+	go func() {
+		defer close(exited)
+		// The connection is already closed if oz-init went away first
+		defer c.Close()
+		defer rr.Done()
+		for resp := range rr.Chan() {
+			if pe, ok := resp.Body.(*ProgramExitedMsg); ok {
+				exited <- pe
+				return
+			}
+		}
+	}()
+	return pid, exited, nil
 }
 
 func RunShell(addr, term string) (int, error) {
@@ -69,12 +101,16 @@ func RunShell(addr, term string) (int, error) {
 		return 0, err
 	}
 	rr, err := c.ExchangeMsg(&RunShellMsg{Term: term})
-	resp := <-rr.Chan()
-	rr.Done()
-	c.Close()
 	if err != nil {
+		c.Close()
 		return 0, err
 	}
+	resp, ok := <-rr.Chan()
+	rr.Done()
+	c.Close()
+	if !ok {
+		return 0, errors.New("connection closed by oz-init")
+	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
 		return 0, errors.New(body.Msg)
@@ -97,7 +133,10 @@ func SetupForwarder(addr, proto, daddr string, fd uintptr) error {
 	if err != nil {
 		return fmt.Errorf("Error %v: %+v", err, rr)
 	}
-	resp := <-rr.Chan()
+	resp, ok := <-rr.Chan()
+	if !ok {
+		return errors.New("connection closed by oz-init")
+	}
 	switch body := resp.Body.(type) {
 	case *ErrorMsg:
 		return errors.New(body.Msg)
@@ -108,3 +147,31 @@ func SetupForwarder(addr, proto, daddr string, fd uintptr) error {
 	}
 
 }
+
+// Exec runs a command in the sandbox with the standard streams of the caller
+// and returns its exit status once it exits.
+func Exec(addr, pwd string, args []string) (int, error) {
+	c, err := clientConnect(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	fds := []int{int(os.Stdin.Fd()), int(os.Stdout.Fd()), int(os.Stderr.Fd())}
+	rr, err := c.ExchangeMsg(&ExecMsg{Args: args, Pwd: pwd}, fds...)
+	if err != nil {
+		return 0, err
+	}
+	resp, ok := <-rr.Chan()
+	rr.Done()
+	if !ok {
+		return 0, errors.New("connection closed by oz-init")
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return 0, errors.New(body.Msg)
+	case *ExecResultMsg:
+		return body.Status, nil
+	default:
+		return 0, fmt.Errorf("Unexpected message type received: %+v", body)
+	}
+}
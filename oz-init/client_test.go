@@ -0,0 +1,83 @@
+package ozinit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/subgraph/oz/ipc"
+)
+
+const testSocket = "@oz-init-client-test"
+
+// fakeInit answers the handshake and the first RunProgramMsg received on the
+// listener, then goes away as oz-init does when the sandbox stops.
+func fakeInit(t *testing.T, l *net.UnixListener) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		t.Error("error accepting test connection:", err)
+		return
+	}
+	defer conn.Close()
+	for {
+		var szbuf [4]byte
+		if _, err := io.ReadFull(conn, szbuf[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(szbuf[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var base ipc.BaseMsg
+		if err := json.Unmarshal(buf, &base); err != nil {
+			t.Error("error decoding test message:", err)
+			return
+		}
+		switch base.Type {
+		case "Hello":
+			writeTestMsg(t, conn, base.MsgID, "Hello", &ipc.HelloMsg{Version: ProtocolVersion, Features: []string{"RunProgram"}})
+		case "RunProgram":
+			writeTestMsg(t, conn, base.MsgID, "ProgramStarted", &ProgramStartedMsg{Pid: 42})
+			return
+		}
+	}
+}
+
+func writeTestMsg(t *testing.T, conn *net.UnixConn, id int, msgType string, body interface{}) {
+	bb, _ := json.Marshal(body)
+	raw, _ := json.Marshal(&ipc.BaseMsg{Type: msgType, MsgID: id, Body: bb})
+	buf := make([]byte, len(raw)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(raw)))
+	copy(buf[4:], raw)
+	if _, err := conn.Write(buf); err != nil {
+		t.Error("error writing test message:", err)
+	}
+}
+
+func TestRunProgramInitExits(t *testing.T) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: testSocket, Net: "unix"})
+	if err != nil {
+		t.Fatal("error setting up test listener:", err)
+	}
+	defer l.Close()
+	go fakeInit(t, l)
+
+	pid, exited, err := RunProgram(testSocket, "/bin/true", "/", nil, true)
+	if err != nil {
+		t.Fatal("RunProgram failed:", err)
+	}
+	if pid != 42 {
+		t.Errorf("RunProgram returned pid %d, expected 42", pid)
+	}
+	select {
+	case pe, ok := <-exited:
+		if ok {
+			t.Errorf("exit %+v reported though oz-init went away", pe)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("exit channel not closed when oz-init went away")
+	}
+}
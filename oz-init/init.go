@@ -19,11 +19,12 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	//"time"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/fs"
 	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/landlock"
 	"github.com/subgraph/oz/network"
 	"github.com/subgraph/oz/xpra"
 
@@ -32,8 +33,9 @@ import (
 )
 
 type procState struct {
-	cmd   *exec.Cmd
-	track bool
+	cmd    *exec.Cmd
+	track  bool
+	onExit func(*ProgramExitedMsg)
 }
 
 type initState struct {
@@ -55,7 +57,14 @@ type initState struct {
 	xpraReady         sync.WaitGroup
 	dbusUuid          string
 	shutdownRequested bool
+	graceCancel       chan struct{}
 	ephemeral         bool
+	landlockRules     []landlock.Rule
+	id                int
+	recordings        *os.File
+	recordLock        sync.Mutex
+	dns               []string
+	privs             *privileges
 }
 
 type InitData struct {
@@ -69,6 +78,8 @@ type InitData struct {
 	User      user.User
 	Display   int
 	Ephemeral bool
+	Id        int
+	DNS       []string
 }
 
 const (
@@ -79,7 +90,7 @@ var dbusValidVar = regexp.MustCompile(DBUS_VAR_REGEXP)
 
 // By convention oz-init writes log messages to stderr with a single character
 // prefix indicating the logging level.  These messages are read one line at a time
-// over a pipe by oz-daemon and translated into appropriate log events.
+// over a FIFO by oz-daemon and translated into appropriate log events.
 func createLogger() *logging.Logger {
 	l := logging.MustGetLogger("oz-init")
 	be := logging.NewLogBackend(os.Stderr, "", 0)
@@ -90,6 +101,9 @@ func createLogger() *logging.Logger {
 }
 
 func Main() {
+	// The FIFO on stderr has no reader while oz-daemon restarts, writing
+	// to it must fail rather than kill oz-init with SIGPIPE
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
 	parseArgs().waitForParentReady().runInit()
 }
 
@@ -106,6 +120,12 @@ func parseArgs() *initState {
 		os.Exit(1)
 	}
 
+	privs, err := readPrivileges()
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+
 	initData := new(InitData)
 	if err := json.NewDecoder(os.Stdin).Decode(&initData); err != nil {
 		log.Error("unable to decode init data: %v", err)
@@ -126,7 +146,7 @@ func parseArgs() *initState {
 		env = append(env, "DISPLAY=:"+strconv.Itoa(initData.Display))
 	}
 
-	return &initState{
+	st := &initState{
 		log:       log,
 		config:    &initData.Config,
 		sockaddr:  initData.Sockaddr,
@@ -140,7 +160,16 @@ func parseArgs() *initState {
 		display:   initData.Display,
 		fs:        fs.NewFilesystem(&initData.Config, log, &initData.User, &initData.Profile),
 		ephemeral: initData.Ephemeral,
+		id:        initData.Id,
+		dns:       initData.DNS,
+		privs:     privs,
 	}
+	if initData.Profile.RecordShell {
+		if st.recordings = openRecordingPipe(); st.recordings == nil {
+			log.Warning("No shell recording pipe received from oz-daemon, shells are disabled")
+		}
+	}
+	return st
 }
 
 func (st *initState) waitForParentReady() *initState {
@@ -166,6 +195,7 @@ func (st *initState) runInit() {
 		handlePing,
 		st.handleRunProgram,
 		st.handleRunShell,
+		st.handleExec,
 		st.handleSetupForwarder,
 	)
 	if err != nil {
@@ -219,6 +249,11 @@ func (st *initState) runInit() {
 			os.Exit(1)
 		}
 	}
+	if st.profile.Networking.DisableIPv6 && st.profile.Networking.Nettype != network.TYPE_HOST {
+		if err := network.DisableIPv6(); err != nil {
+			st.log.Warning("Unable to disable IPv6: %v", err)
+		}
+	}
 	network.NetPrint(st.log)
 
 	if syscall.Sethostname([]byte(st.profile.Name)) != nil {
@@ -323,6 +358,31 @@ func (st *initState) setupEtcFiles() {
 			st.log.Warning("Unable to setup etc file item: %v", err)
 		}
 	}
+	st.setupResolvConf()
+}
+
+// setupResolvConf replaces the resolv.conf of the host with one of the
+// sandbox, listing the name servers chosen by oz-daemon for its dns mode
+func (st *initState) setupResolvConf() {
+	if st.profile.Networking.Nettype != network.TYPE_BRIDGE {
+		return
+	}
+	switch st.profile.Networking.DNSMode {
+	case oz.PROFILE_NETWORK_DNS_NONE, oz.PROFILE_NETWORK_DNS_DHCP, oz.PROFILE_NETWORK_DNS_PROXY:
+	default:
+		return
+	}
+	resolv := fmt.Sprintf("# Generated by oz-init for dns mode %s\n", st.profile.Networking.DNSMode)
+	for _, ns := range st.dns {
+		resolv += "nameserver " + ns + "\n"
+	}
+	if len(st.dns) == 0 && st.profile.Networking.DNSMode != oz.PROFILE_NETWORK_DNS_NONE {
+		st.log.Warning("No name server available for dns mode %s", st.profile.Networking.DNSMode)
+	}
+	os.Remove("/etc/resolv.conf")
+	if err := ioutil.WriteFile("/etc/resolv.conf", []byte(resolv), 0644); err != nil {
+		st.log.Warning("Unable to write resolv.conf: %v", err)
+	}
 }
 
 func (st *initState) needsDbus() bool {
@@ -454,7 +514,7 @@ func (st *initState) readXpraOutput(r io.ReadCloser) {
 	}
 }
 
-func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*exec.Cmd, error) {
+func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string, onExit func(*ProgramExitedMsg)) (*exec.Cmd, error) {
 	if cpath == "" {
 		cpath = st.profile.Path
 	}
@@ -501,6 +561,11 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 		}
 	}
 
+	var landlockEnv []string
+	if st.profile.Landlock {
+		cpath, cmdArgs, landlockEnv = st.wrapLandlock(cpath, cmdArgs)
+	}
+
 	cmd := exec.Command(cpath)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -524,6 +589,7 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 	}
 	cmd.Env = setEnvironOverrides(cmd.Env)
 	cmd.Env = append(cmd.Env, st.launchEnv...)
+	cmd.Env = append(cmd.Env, landlockEnv...)
 
 	if st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_WHITELIST ||
 		st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_BLACKLIST || st.profile.Seccomp.Mode == oz.PROFILE_SECCOMP_TRAIN {
@@ -548,14 +614,19 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 		cmd.Dir = pwd
 	}
 
-	if err := cmd.Start(); err != nil {
+	st.lock.Lock()
+	// Registered before the lock is released so that the exit of the program
+	// cannot be reaped before we know about it
+	if err := st.startRestricted(cmd); err != nil {
+		st.lock.Unlock()
 		st.log.Warning("Failed to start application (%s): %v", st.profile.Path, err)
 		return nil, err
 	}
-	st.addChildProcess(cmd, true)
+	st.children[cmd.Process.Pid] = procState{cmd: cmd, track: true, onExit: onExit}
+	st.lock.Unlock()
 
-	go st.readApplicationOutput(stdout, "stdout")
-	go st.readApplicationOutput(stderr, "stderr")
+	go st.readApplicationOutput(stdout, "stdout", cmd.Process.Pid)
+	go st.readApplicationOutput(stderr, "stderr", cmd.Process.Pid)
 
 	return cmd, nil
 }
@@ -569,14 +640,17 @@ func setEnvironOverrides(env []string) []string {
 	return env
 }
 
-func (st *initState) readApplicationOutput(r io.ReadCloser, label string) {
-	sc := bufio.NewScanner(r)
+// readApplicationOutput reports the output of a program to oz-daemon as
+// OUTPUT lines on stderr, for the log file of the sandbox
+func (st *initState) readApplicationOutput(r io.ReadCloser, label string, pid int) {
+	sc := NewLineScanner(r, MaxOutputLine)
 	for sc.Scan() {
-		line := sc.Text()
-		st.log.Debug("(%s) %s", label, line)
-
+		bs, err := json.Marshal(&ProgramOutput{Pid: pid, Stream: label, Line: sc.Text()})
+		if err != nil {
+			continue
+		}
+		os.Stderr.WriteString("OUTPUT " + string(bs) + "\n")
 	}
-
 }
 
 func loadProfile(dir, name string) (*oz.Profile, error) {
@@ -644,14 +718,39 @@ func proxyForwarder(conn *net.Conn, proto string, rAddr string) error {
 
 func (st *initState) handleRunProgram(rp *RunProgramMsg, msg *ipc.Message) error {
 	st.log.Info("Run program message received: %+v", rp)
-	_, err := st.launchApplication(rp.Path, rp.Pwd, rp.Args)
+	st.lock.Lock()
+	if st.shutdownRequested {
+		st.lock.Unlock()
+		return msg.Respond(&ErrorMsg{Msg: "sandbox is shutting down"})
+	}
+	inGrace := st.graceCancel != nil
+	if inGrace {
+		st.log.Info("Program started during shutdown grace period, reusing sandbox.")
+		close(st.graceCancel)
+		st.graceCancel = nil
+	}
+	st.lock.Unlock()
+	var onExit func(*ProgramExitedMsg)
+	if rp.Wait {
+		// The exit cannot be answered before ProgramStartedMsg has been sent
+		started := make(chan struct{})
+		defer close(started)
+		onExit = func(pe *ProgramExitedMsg) {
+			<-started
+			if err := msg.Respond(pe); err != nil {
+				st.log.Warning("Failed to send exit status of pid %d: %v", pe.Pid, err)
+			}
+		}
+	}
+	cmd, err := st.launchApplication(rp.Path, rp.Pwd, rp.Args, onExit)
 	if err != nil {
+		if inGrace && !st.hasTrackedChildren() {
+			st.startGracePeriod()
+		}
 		err := msg.Respond(&ErrorMsg{Msg: err.Error()})
 		return err
-	} else {
-		err := msg.Respond(&OkMsg{})
-		return err
 	}
+	return msg.Respond(&ProgramStartedMsg{Pid: cmd.Process.Pid})
 }
 
 func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
@@ -667,6 +766,9 @@ func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
 			groups = append(groups, gid)
 		}
 	}
+	if st.profile.RecordShell && st.recordings == nil {
+		return msg.Respond(&ErrorMsg{"Cannot open shell because it cannot be recorded"})
+	}
 	st.log.Info("Starting shell with uid = %d, gid = %d", msg.Ucred.Uid, msg.Ucred.Gid)
 	cmd := exec.Command(st.config.ShellPath, "-i")
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
@@ -686,17 +788,92 @@ func (st *initState) handleRunShell(rs *RunShellMsg, msg *ipc.Message) error {
 	}
 	cmd.Env = append(cmd.Env, fmt.Sprintf("PS1=[%s] $ ", st.profile.Name))
 	st.log.Info("Executing shell...")
-	f, err := ptyStart(cmd)
-	defer f.Close()
+	f, err := st.ptyStart(cmd)
 	if err != nil {
 		return msg.Respond(&ErrorMsg{err.Error()})
 	}
 	st.addChildProcess(cmd, false)
+	if st.profile.RecordShell {
+		// The client is handed a pty of our own so that the output goes through us
+		if f, err = st.recordShell(f, cmd, msg.Ucred.Uid, rs.Term); err != nil {
+			cmd.Process.Kill()
+			return msg.Respond(&ErrorMsg{err.Error()})
+		}
+	}
+	defer f.Close()
 	err = msg.Respond(&OkMsg{}, int(f.Fd()))
 	return err
 }
 
-func ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
+func (st *initState) handleExec(ex *ExecMsg, msg *ipc.Message) error {
+	files := make([]*os.File, 0, len(msg.Fds))
+	for _, fd := range msg.Fds {
+		files = append(files, os.NewFile(uintptr(fd), ""))
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if msg.Ucred == nil {
+		return msg.Respond(&ErrorMsg{"No credentials received for Exec command"})
+	}
+	if (msg.Ucred.Uid == 0 || msg.Ucred.Gid == 0) && st.config.AllowRootShell != true {
+		return msg.Respond(&ErrorMsg{"Cannot run command because allowRootShell is disabled"})
+	}
+	if st.profile.RecordShell {
+		return msg.Respond(&ErrorMsg{"Cannot run command because the shells of this profile are recorded"})
+	}
+	if len(ex.Args) == 0 {
+		return msg.Respond(&ErrorMsg{"No command given to Exec"})
+	}
+	if len(files) != 3 {
+		return msg.Respond(&ErrorMsg{fmt.Sprintf("Exec expects 3 file descriptors, received %d", len(files))})
+	}
+	groups := append([]uint32{}, st.gid)
+	if msg.Ucred.Uid != 0 && msg.Ucred.Gid != 0 {
+		for _, gid := range st.gids {
+			groups = append(groups, gid)
+		}
+	}
+	cmd := exec.Command(ex.Args[0], ex.Args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    msg.Ucred.Uid,
+		Gid:    msg.Ucred.Gid,
+		Groups: groups,
+	}
+	cmd.Env = append(cmd.Env, st.launchEnv...)
+	cmd.Dir = ex.Pwd
+	if cmd.Dir == "" && st.user != nil {
+		cmd.Dir = st.user.HomeDir
+	}
+	cmd.Stdin = files[0]
+	cmd.Stdout = files[1]
+	cmd.Stderr = files[2]
+
+	st.lock.Lock()
+	if st.shutdownRequested {
+		st.lock.Unlock()
+		return msg.Respond(&ErrorMsg{"sandbox is shutting down"})
+	}
+	// Registered before the lock is released so that the exit of the command
+	// cannot be reaped before we know about it
+	if err := st.startRestricted(cmd); err != nil {
+		st.lock.Unlock()
+		return msg.Respond(&ErrorMsg{err.Error()})
+	}
+	st.children[cmd.Process.Pid] = procState{cmd: cmd, onExit: func(pe *ProgramExitedMsg) {
+		if err := msg.Respond(&ExecResultMsg{Status: pe.ExitCode()}); err != nil {
+			st.log.Warning("Failed to send exit status of pid %d: %v", pe.Pid, err)
+		}
+	}}
+	st.lock.Unlock()
+	st.log.Info("Executing %v with uid = %d, gid = %d, pid = %d", ex.Args, msg.Ucred.Uid, msg.Ucred.Gid, cmd.Process.Pid)
+	return nil
+}
+
+func (st *initState) ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
 	ptty, tty, err := pty.Open()
 	if err != nil {
 		return nil, err
@@ -710,7 +887,7 @@ func ptyStart(c *exec.Cmd) (ptty *os.File, err error) {
 	}
 	c.SysProcAttr.Setctty = true
 	c.SysProcAttr.Setsid = true
-	if err := c.Start(); err != nil {
+	if err := st.startRestricted(c); err != nil {
 		ptty.Close()
 		return nil, err
 	}
@@ -735,8 +912,12 @@ func (st *initState) removeChildProcess(pid int) bool {
 
 func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	st.log.Debug("Child process pid=%d exited from init with status %d", pid, wstatus.ExitStatus())
-	track := st.children[pid].track
+	st.lock.Lock()
+	proc := st.children[pid]
+	st.lock.Unlock()
+	track := proc.track
 	st.removeChildProcess(pid)
+	st.reportChildExit(pid, proc, wstatus)
 
 	for _, proc := range st.children {
 		if proc.track {
@@ -744,19 +925,12 @@ func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 		}
 	}
 
+	if track == true && st.profile.AutoShutdown == oz.PROFILE_SHUTDOWN_SOFT {
+		st.startGracePeriod()
+		return
+	}
 	if len(st.profile.Watchdog) > 0 {
-		//if st.getProcessExists(st.profile.Watchdog) {
-		//	return
-		//} else {
-		//	var ww sync.WaitGroup
-		//	ww.Add(1)
-		//	time.AfterFunc(time.Second*5, func() {
-		//		ww.Done()
-		//		st.log.Info("Watchdog timeout expired")
-		//	})
-		//	ww.Wait()
 		track = !st.getProcessExists(st.profile.Watchdog)
-		//}
 	}
 	if track == true && st.profile.AutoShutdown == oz.PROFILE_SHUTDOWN_YES {
 		st.log.Info("Shutting down sandbox after child exit.")
@@ -764,6 +938,93 @@ func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	}
 }
 
+// reportChildExit tells oz-daemon about the exit of a child with an EXITED
+// line on stderr, and the client waiting for it if there is one.
+func (st *initState) reportChildExit(pid int, proc procState, wstatus syscall.WaitStatus) {
+	path := ""
+	if proc.cmd != nil {
+		path = proc.cmd.Path
+	}
+	pe := &ProgramExitedMsg{Pid: pid, Path: path, Status: wstatus.ExitStatus()}
+	if wstatus.Signaled() {
+		pe.Signal = int(wstatus.Signal())
+	}
+	if bs, err := json.Marshal(pe); err == nil {
+		os.Stderr.WriteString("EXITED " + string(bs) + "\n")
+	}
+	if proc.onExit != nil {
+		proc.onExit(pe)
+	}
+}
+
+// hasTrackedChildren returns true if one of the programs whose exit shuts
+// the sandbox down is running
+func (st *initState) hasTrackedChildren() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for _, proc := range st.children {
+		if proc.track {
+			return true
+		}
+	}
+	return false
+}
+
+// How often the watchdog processes are looked for during a grace period
+const watchdogPollInterval = time.Second
+
+// startGracePeriod delays the shutdown of the sandbox after the last tracked
+// program exited, so that a program launched shortly after can reuse it
+func (st *initState) startGracePeriod() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.graceCancel != nil || st.shutdownRequested {
+		return
+	}
+	grace := time.Duration(st.profile.ShutdownGrace) * time.Second
+	if grace == 0 {
+		grace = oz.DefaultShutdownGrace * time.Second
+	}
+	st.log.Info("Last program exited, shutting down in %v unless a new one is started.", grace)
+	st.graceCancel = make(chan struct{})
+	go st.runGracePeriod(grace, st.graceCancel)
+}
+
+// runGracePeriod shuts the sandbox down once the grace period expires, unless
+// cancel is closed first. The period starts over as long as one of the
+// watchdog processes is running.
+func (st *initState) runGracePeriod(grace time.Duration, cancel chan struct{}) {
+	deadline := time.Now().Add(grace)
+	ticker := time.NewTicker(watchdogPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+		if len(st.profile.Watchdog) > 0 && st.getProcessExists(st.profile.Watchdog) {
+			deadline = time.Now().Add(grace)
+			continue
+		}
+		if time.Now().Before(deadline) {
+			continue
+		}
+		st.lock.Lock()
+		if st.graceCancel != cancel {
+			st.lock.Unlock()
+			return
+		}
+		st.graceCancel = nil
+		// Flagged while holding the lock so that no program can be started past this point
+		st.shutdownRequested = true
+		st.lock.Unlock()
+		st.log.Info("Shutdown grace period expired, shutting down sandbox.")
+		st.stop()
+		return
+	}
+}
+
 func (st *initState) getProcessExists(pnames []string) bool {
 	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
 	for _, path := range paths {
@@ -800,10 +1061,17 @@ func (st *initState) processSignals(c <-chan os.Signal, s *ipc.MsgServer) {
 }
 
 func (st *initState) shutdown() {
+	st.lock.Lock()
 	if st.shutdownRequested {
+		st.lock.Unlock()
 		return
 	}
 	st.shutdownRequested = true
+	st.lock.Unlock()
+	st.stop()
+}
+
+func (st *initState) stop() {
 	for _, c := range st.childrenVector() {
 		c.cmd.Process.Signal(os.Interrupt)
 	}
@@ -886,6 +1154,10 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		return err
 	}
 
+	if st.profile.Landlock {
+		st.landlockRules = st.buildLandlockRules(append(extra_whitelist, st.profile.Whitelist...))
+	}
+
 	if st.profile.XServer.Enabled {
 		xprapath, err := xpra.CreateDir(st.user, st.profile.Name)
 		if err != nil {
@@ -894,6 +1166,9 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		if err := st.fs.BindPath(xprapath, 0, st.display); err != nil {
 			return err
 		}
+		if st.profile.Landlock {
+			st.landlockRules = append(st.landlockRules, landlock.Rule{Path: xprapath, Access: landlock.AccessCreate})
+		}
 	}
 
 	if err := st.fs.Chroot(); err != nil {
@@ -0,0 +1,103 @@
+package ozinit
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/fs"
+	"github.com/subgraph/oz/landlock"
+	"github.com/subgraph/oz/oz-landlock"
+)
+
+// Directories of the jail which sandboxed programs may read, in addition to
+// the whitelist of the profile
+var landlockReadDirs = []string{
+	"/bin", "/etc", "/lib", "/lib64", "/opt", "/usr",
+	"/proc", "/sys", "/run", "/var/lib",
+}
+
+// Directories which only exist in the jail, where sandboxed programs may do
+// anything. Whitelisted paths bound below them get the same rights.
+var landlockPrivateDirs = []string{
+	"/dev", "/tmp",
+}
+
+// buildLandlockRules returns the rules granting access to the jail: the base
+// directories, the home and runtime directories of the user, and the
+// whitelisted paths with rights matching how they are bound. A writable
+// directory which is itself whitelisted read-only only gets read access.
+func (st *initState) buildLandlockRules(wlist []oz.WhitelistItem) []landlock.Rule {
+	rules := []landlock.Rule{}
+	for _, p := range landlockReadDirs {
+		rules = append(rules, landlock.Rule{Path: p, Access: landlock.AccessRead})
+	}
+	private := append([]string{
+		st.user.HomeDir,
+		path.Join("/media", st.user.Username),
+		path.Join("/run/user", strconv.FormatUint(uint64(st.uid), 10)),
+	}, landlockPrivateDirs...)
+	for _, p := range private {
+		rules = append(rules, landlock.Rule{Path: p, Access: landlock.AccessCreate})
+	}
+
+	readOnly := []string{}
+	for _, wl := range wlist {
+		if wl.Path == "" {
+			continue
+		}
+		access := uint64(landlock.AccessRead)
+		if !wl.ReadOnly && !wl.AllowSetuid {
+			access = landlock.AccessWrite
+			if wl.CanCreate {
+				access = landlock.AccessCreate
+			}
+		}
+		var paths []string
+		var err error
+		if wl.Target != "" {
+			var p string
+			p, err = fs.ResolvePathNoGlob(wl.Target, st.display, st.user, st.fs.GetXDGDirs(), st.profile)
+			paths = []string{p}
+		} else {
+			paths, err = fs.ResolvePath(wl.Path, st.display, st.user, st.fs.GetXDGDirs(), st.profile)
+		}
+		if err != nil {
+			st.log.Warning("Unable to resolve whitelist item %s for landlock: %v", wl.Path, err)
+			continue
+		}
+		for _, p := range paths {
+			rules = append(rules, landlock.Rule{Path: p, Access: access})
+			if access == landlock.AccessRead {
+				readOnly = append(readOnly, p)
+			}
+		}
+	}
+
+	for i := range rules {
+		if rules[i].Access != landlock.AccessRead {
+			rules[i].Except = readOnly
+		}
+	}
+	return rules
+}
+
+// wrapLandlock makes the command run under the landlock wrapper, which applies
+// the ruleset before executing the program. The command is left unchanged if
+// the kernel does not support landlock.
+func (st *initState) wrapLandlock(cpath string, cmdArgs []string) (string, []string, []string) {
+	if _, err := landlock.Version(); err != nil {
+		st.log.Warning("Landlock is not available, launching %s without it: %v", cpath, err)
+		return cpath, cmdArgs, nil
+	}
+	jdata, err := json.Marshal(st.landlockRules)
+	if err != nil {
+		st.log.Warning("Unable to marshal landlock rules, launching %s without them: %v", cpath, err)
+		return cpath, cmdArgs, nil
+	}
+	st.log.Notice("Enabling landlock for: %s", cpath)
+	cmdArgs = append([]string{cpath}, cmdArgs...)
+	wpath := path.Join(st.config.PrefixPath, "bin", "oz-landlock")
+	return wpath, cmdArgs, []string{ozlandlock.EnvRules + "=" + string(jdata)}
+}
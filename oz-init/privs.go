@@ -0,0 +1,103 @@
+package ozinit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+	The capability bounding set and the no_new_privs flag passed by oz-daemon
+	in the environment apply to the programs oz-init launches on behalf of the
+	user: applications, shells and commands. oz-init itself and the helpers it
+	runs as root to set up the sandbox keep their privileges.
+
+	Both are attributes of a thread which the processes it forks inherit. Go
+	offers no way to run code in the child between fork and exec, so they are
+	set on a thread locked for the purpose, which forks the program and is then
+	discarded by the runtime instead of running other goroutines.
+*/
+
+// privileges are the restrictions applied to the programs of the sandbox
+type privileges struct {
+	capbset    uint64
+	noNewPrivs bool
+}
+
+// readPrivileges reads the restrictions passed by oz-daemon in the
+// environment and removes them from it. Without a bounding set in the
+// environment the programs are not restricted.
+func readPrivileges() (*privileges, error) {
+	envv, ok := os.LookupEnv("_OZ_CAPBSET")
+	if !ok {
+		return nil, nil
+	}
+	capbset, err := strconv.ParseUint(envv, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse capability bounding set from environment: %v", err)
+	}
+	p := &privileges{
+		capbset:    capbset,
+		noNewPrivs: os.Getenv("_OZ_NO_NEW_PRIVS") == "1",
+	}
+	os.Unsetenv("_OZ_CAPBSET")
+	os.Unsetenv("_OZ_NO_NEW_PRIVS")
+	return p, nil
+}
+
+// lastCap returns the number of the last capability known to the kernel
+func lastCap() int {
+	bs, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 63
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 63
+	}
+	return last
+}
+
+// apply restricts the calling thread
+func (p *privileges) apply() error {
+	last := lastCap()
+	for cap := 0; cap <= last; cap++ {
+		if cap < 64 && p.capbset&(1<<uint(cap)) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(cap), 0); errno != 0 {
+			return fmt.Errorf("failed to drop capability %d from bounding set: %v", cap, errno)
+		}
+	}
+	if p.noNewPrivs {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+			return fmt.Errorf("failed to set no_new_privs: %v", errno)
+		}
+	}
+	return nil
+}
+
+// startRestricted starts cmd with the restrictions of the sandbox
+func (st *initState) startRestricted(cmd *exec.Cmd) error {
+	if st.privs == nil {
+		return cmd.Start()
+	}
+	errc := make(chan error)
+	go func() {
+		// Never unlocked, the thread exits along with the goroutine
+		runtime.LockOSThread()
+		if err := st.privs.apply(); err != nil {
+			errc <- err
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
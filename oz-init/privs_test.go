@@ -0,0 +1,61 @@
+package ozinit
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestReadPrivileges(t *testing.T) {
+	os.Unsetenv("_OZ_CAPBSET")
+	os.Setenv("_OZ_NO_NEW_PRIVS", "1")
+	if p, err := readPrivileges(); err != nil || p != nil {
+		t.Errorf("missing bounding set not read as no restriction: %+v, %v", p, err)
+	}
+
+	os.Setenv("_OZ_CAPBSET", "2000")
+	p, err := readPrivileges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.capbset != 1<<13 || !p.noNewPrivs {
+		t.Errorf("unexpected privileges read: %+v", p)
+	}
+	if _, ok := os.LookupEnv("_OZ_CAPBSET"); ok {
+		t.Errorf("bounding set left in the environment")
+	}
+
+	os.Setenv("_OZ_CAPBSET", "net_raw")
+	defer os.Unsetenv("_OZ_CAPBSET")
+	if _, err := readPrivileges(); err == nil {
+		t.Errorf("invalid bounding set accepted")
+	}
+}
+
+// noNewPrivs returns the no_new_privs flag reported by grep for itself
+// when started by start
+func noNewPrivs(t *testing.T, start func(*exec.Cmd) error) string {
+	cmd := exec.Command("grep", "^NoNewPrivs:", "/proc/self/status")
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	if err := start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+func TestStartRestricted(t *testing.T) {
+	st := &initState{privs: &privileges{capbset: ^uint64(0), noNewPrivs: true}}
+	if got := noNewPrivs(t, st.startRestricted); got != "NoNewPrivs: 1" {
+		t.Errorf("no_new_privs not set on the program: %s", got)
+	}
+	// The thread which started it is not reused
+	if got := noNewPrivs(t, (*exec.Cmd).Start); got != "NoNewPrivs: 0" {
+		t.Errorf("no_new_privs set on other programs: %s", got)
+	}
+}
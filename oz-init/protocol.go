@@ -1,6 +1,11 @@
 package ozinit
 
-import "github.com/subgraph/oz/ipc"
+import (
+	"bufio"
+	"io"
+
+	"github.com/subgraph/oz/ipc"
+)
 
 type OkMsg struct {
 	_ string "Ok"
@@ -18,10 +23,112 @@ type RunShellMsg struct {
 	Term string "RunShell"
 }
 
+// RunProgramMsg starts a program in the sandbox, it is answered with
+// ProgramStartedMsg. When Wait is set a ProgramExitedMsg follows once the
+// program exits.
 type RunProgramMsg struct {
 	Args []string "RunProgram"
 	Pwd  string
 	Path string
+	Wait bool
+}
+
+type ProgramStartedMsg struct {
+	Pid int "ProgramStarted"
+}
+
+// ProgramExitedMsg describes the exit of a process started by oz-init.
+// Status is -1 and Signal is set if the process was killed by a signal.
+// Besides answering RunProgramMsg, it is reported to oz-daemon for every
+// child as an EXITED line on stderr.
+type ProgramExitedMsg struct {
+	Pid    int "ProgramExited"
+	Path   string
+	Status int
+	Signal int
+}
+
+// ProgramOutput is a line output by a program launched by oz-init. It is
+// not an IPC message, it is reported to oz-daemon as an OUTPUT line on
+// stderr.
+type ProgramOutput struct {
+	Pid    int
+	Stream string
+	Line   string
+}
+
+// RecordingFd is the descriptor on which oz-daemon passes oz-init the pipe
+// to which the shell recordings are written, for sandboxes of profiles with
+// record_shell.
+const RecordingFd = 3
+
+// RecordingLine is a line of the recording of a shell, sent to oz-daemon
+// on the recording pipe as a JSON line. Close ends the recording.
+type RecordingLine struct {
+	Name  string
+	Line  string
+	Close bool
+}
+
+// Lines output by programs are truncated to MaxOutputLine bytes before being
+// reported, so that a reported line, where JSON may escape every byte as six,
+// stays below MaxReportLine. Longer lines on the stderr of oz-init are
+// truncated by oz-daemon.
+const (
+	MaxOutputLine = 4 * 1024
+	MaxReportLine = 64 * 1024
+)
+
+// NewLineScanner returns a scanner of the lines read from r which truncates
+// those longer than max bytes and drops the rest of them, instead of
+// stopping with bufio.ErrTooLong.
+func NewLineScanner(r io.Reader, max int) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), max)
+	truncating := false
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && len(data) >= max {
+			// No end of line in sight, the buffer cannot grow anymore
+			if truncating {
+				return len(data), nil, nil
+			}
+			truncating = true
+			return len(data), data[:max], nil
+		}
+		if truncating && advance > 0 {
+			truncating = false
+			return advance, nil, nil
+		}
+		if len(token) > max {
+			token = token[:max]
+		}
+		return advance, token, err
+	})
+	return sc
+}
+
+// ExitCode returns the exit status the way a shell would report it: 128 plus
+// the signal number for processes killed by a signal.
+func (pe *ProgramExitedMsg) ExitCode() int {
+	if pe.Signal != 0 {
+		return 128 + pe.Signal
+	}
+	return pe.Status
+}
+
+// ExecMsg runs a command in the sandbox with the three file descriptors
+// passed along as its stdin, stdout and stderr. The answer is sent once the
+// command exits.
+type ExecMsg struct {
+	Args []string "Exec"
+	Pwd  string
+}
+
+// ExecResultMsg carries the exit status of a command started with ExecMsg,
+// 128 plus the signal number if it was killed by a signal.
+type ExecResultMsg struct {
+	Status int "ExecResult"
 }
 
 type ForwarderSuccessMsg struct {
@@ -30,11 +137,19 @@ type ForwarderSuccessMsg struct {
 	Addr  string
 }
 
+// ProtocolVersion of the oz-init control socket, only changed by incompatible
+// changes to the messages
+const ProtocolVersion = 1
+
 var messageFactory = ipc.NewMsgFactory(
 	new(OkMsg),
 	new(ErrorMsg),
 	new(PingMsg),
 	new(RunShellMsg),
 	new(RunProgramMsg),
+	new(ProgramStartedMsg),
+	new(ProgramExitedMsg),
+	new(ExecMsg),
+	new(ExecResultMsg),
 	new(ForwarderSuccessMsg),
-)
+).WithProtocol(ProtocolVersion)
@@ -0,0 +1,34 @@
+package ozinit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineScanner(t *testing.T) {
+	in := "short\n" + strings.Repeat("x", 10) + "\n" + strings.Repeat("y", 25) + "\nlast"
+	sc := NewLineScanner(strings.NewReader(in), 8)
+	var lines []string
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		t.Errorf("scanner stopped with %v", err)
+	}
+	want := []string{"short", "xxxxxxxx", "yyyyyyyy", "last"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("scanned %q, expected %q", lines, want)
+	}
+
+	long := strings.Repeat("\x01", 3*MaxOutputLine)
+	sc = NewLineScanner(strings.NewReader(long+"\nnext\n"), MaxOutputLine)
+	lines = nil
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	want = []string{long[:MaxOutputLine], "next"}
+	if sc.Err() != nil || !reflect.DeepEqual(lines, want) {
+		t.Errorf("long line not truncated, scanned %d lines: %v", len(lines), sc.Err())
+	}
+}
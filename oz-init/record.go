@@ -0,0 +1,296 @@
+package ozinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/kr/pty"
+)
+
+// How often the window size of the client is looked for changes
+const recordResizeInterval = 250 * time.Millisecond
+
+// castHeader is the first line of an asciicast v2 recording
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder writes the events of an asciicast v2 recording, one JSON
+// array of the time since the start, the event type and its data per line.
+type castRecorder struct {
+	f       io.Writer
+	start   time.Time
+	pending []byte
+}
+
+func newCastRecorder(f io.Writer, hdr *castHeader) (*castRecorder, error) {
+	cr := &castRecorder{f: f, start: time.Now()}
+	hdr.Version = 2
+	hdr.Timestamp = cr.start.Unix()
+	if err := cr.writeLine(hdr); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *castRecorder) writeLine(v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = cr.f.Write(append(bs, '\n'))
+	return err
+}
+
+func (cr *castRecorder) event(evtype, data string) error {
+	return cr.writeLine([]interface{}{time.Since(cr.start).Seconds(), evtype, data})
+}
+
+// output records terminal output. A multibyte character split between two
+// reads is held back until it is complete, since events must be valid UTF-8.
+func (cr *castRecorder) output(bs []byte) error {
+	data := append(cr.pending, bs...)
+	n := len(data)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	cr.pending = append([]byte{}, data[n:]...)
+	if n == 0 {
+		return nil
+	}
+	return cr.event("o", string(data[:n]))
+}
+
+func (cr *castRecorder) resize(ws *winsize) error {
+	return cr.event("r", fmt.Sprintf("%dx%d", ws.Col, ws.Row))
+}
+
+type winsize struct {
+	Row uint16
+	Col uint16
+	X   uint16
+	Y   uint16
+}
+
+func getWinsize(f *os.File) (*winsize, error) {
+	ws := &winsize{}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(ws))); errno != 0 {
+		return nil, errno
+	}
+	return ws, nil
+}
+
+func setWinsize(f *os.File, ws *winsize) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw turns off the line discipline of a terminal, so that what is
+// written on one side comes out unchanged on the other.
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openRecordingPipe returns the pipe passed by oz-daemon to receive the
+// shell recordings, or nil if there is none.
+func openRecordingPipe() *os.File {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(RecordingFd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		return nil
+	}
+	// Not to be inherited by the programs of the sandbox
+	syscall.CloseOnExec(RecordingFd)
+	return os.NewFile(RecordingFd, "recordings")
+}
+
+// recordingWriter sends the lines of a recording to oz-daemon, which writes
+// them to a file of its own in the log directory of the profile, out of
+// reach of the sandbox. Lines of the recordings of every shell go through the
+// same pipe.
+type recordingWriter struct {
+	st   *initState
+	name string
+}
+
+func (st *initState) createRecording(name string) *recordingWriter {
+	return &recordingWriter{st: st, name: name}
+}
+
+func (rw *recordingWriter) send(rl *RecordingLine) error {
+	bs, err := json.Marshal(rl)
+	if err != nil {
+		return err
+	}
+	rw.st.recordLock.Lock()
+	defer rw.st.recordLock.Unlock()
+	_, err = rw.st.recordings.Write(append(bs, '\n'))
+	return err
+}
+
+// Write sends a line of the recording, castRecorder writes one per call
+func (rw *recordingWriter) Write(bs []byte) (int, error) {
+	line := strings.TrimSuffix(string(bs), "\n")
+	if err := rw.send(&RecordingLine{Name: rw.name, Line: line}); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (rw *recordingWriter) Close() error {
+	return rw.send(&RecordingLine{Name: rw.name, Close: true})
+}
+
+// recordShell puts a pty of its own between the client and the pty of a
+// shell and records what the shell outputs along with the window size
+// changes made by the client. It returns the master side of the new pty,
+// which is handed to the client in place of the pty of the shell.
+func (st *initState) recordShell(shell *os.File, cmd *exec.Cmd, uid uint32, term string) (*os.File, error) {
+	name := fmt.Sprintf("shell-%s-%d-%d.cast", time.Now().Format("20060102-150405"), st.id, cmd.Process.Pid)
+	f := st.createRecording(name)
+	master, slave, err := pty.Open()
+	if err != nil {
+		shell.Close()
+		f.Close()
+		return nil, err
+	}
+	if err := makeRaw(slave); err != nil {
+		shell.Close()
+		f.Close()
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+	// Sized by the client once it has the pty, a default is needed until then
+	ws := &winsize{Row: 24, Col: 80}
+	setWinsize(shell, ws)
+	cr, err := newCastRecorder(f, &castHeader{
+		Width:  int(ws.Col),
+		Height: int(ws.Row),
+		Title:  fmt.Sprintf("%s (sandbox %d), shell of uid %d", st.profile.Name, st.id, uid),
+		Env:    map[string]string{"SHELL": st.config.ShellPath, "TERM": term},
+	})
+	if err != nil {
+		shell.Close()
+		f.Close()
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("unable to write shell recording: %v", err)
+	}
+	st.log.Info("Recording shell of uid %d to %s", uid, name)
+
+	var lock sync.Mutex
+	closed := false
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			shell.Close()
+			slave.Close()
+		})
+	}
+	record := func(event func() error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if closed {
+			return
+		}
+		if err := event(); err != nil {
+			// The shell may not go on unrecorded
+			st.log.Warning("Failed to write shell recording %s, hanging up: %v", name, err)
+			stop()
+		}
+	}
+
+	go func() {
+		// Hangs up the shell once the client goes away
+		defer stop()
+		buf := make([]byte, 4096)
+		for {
+			n, err := slave.Read(buf)
+			if n > 0 {
+				if _, werr := shell.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(recordResizeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cur, err := getWinsize(slave)
+			if err != nil || cur.Row == 0 || cur.Col == 0 || *cur == *ws {
+				continue
+			}
+			ws = cur
+			setWinsize(shell, ws)
+			record(func() error { return cr.resize(ws) })
+		}
+	}()
+	go func() {
+		defer func() {
+			stop()
+			lock.Lock()
+			closed = true
+			f.Close()
+			lock.Unlock()
+			st.log.Info("Shell recording %s finished", name)
+		}()
+		buf := make([]byte, 4096)
+		for {
+			n, err := shell.Read(buf)
+			if n > 0 {
+				record(func() error { return cr.output(buf[:n]) })
+				if _, werr := slave.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return master, nil
+}
@@ -0,0 +1,47 @@
+package ozinit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRecordingWriter(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	st := &initState{recordings: w}
+	rw := st.createRecording("shell-test.cast")
+	cr, err := newCastRecorder(rw, &castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal("error writing recording header:", err)
+	}
+	cr.output([]byte("ls\r\n\xc3"))
+	cr.output([]byte("\xa9\n"))
+	rw.Close()
+	w.Close()
+
+	var got []RecordingLine
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var rl RecordingLine
+		if err := json.Unmarshal(sc.Bytes(), &rl); err != nil {
+			t.Fatalf("invalid recording line %q: %v", sc.Text(), err)
+		}
+		if rl.Name != "shell-test.cast" {
+			t.Errorf("recording line sent for %s", rl.Name)
+		}
+		got = append(got, rl)
+	}
+	if len(got) != 4 || !got[3].Close {
+		t.Fatalf("expecting a header, two events and the end of the recording, got %+v", got)
+	}
+	var ev []interface{}
+	if err := json.Unmarshal([]byte(got[2].Line), &ev); err != nil || !reflect.DeepEqual(ev[1:], []interface{}{"o", "é\n"}) {
+		t.Errorf("unexpected output event %s", got[2].Line)
+	}
+}
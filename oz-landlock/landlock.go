@@ -0,0 +1,59 @@
+package ozlandlock
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/subgraph/oz/landlock"
+
+	"github.com/op/go-logging"
+)
+
+// EnvRules is the environment variable through which oz-init passes the
+// ruleset, encoded in JSON
+const EnvRules = "_OZ_LANDLOCK_RULES"
+
+func createLogger() *logging.Logger {
+	l := logging.MustGetLogger("landlock-wrapper")
+	be := logging.NewLogBackend(os.Stderr, "", 0)
+	f := logging.MustStringFormatter("%{level:.1s} %{message}")
+	fbe := logging.NewBackendFormatter(be, f)
+	logging.SetBackend(fbe)
+	return l
+}
+
+var log *logging.Logger
+
+func init() {
+	// Landlock restricts the calling thread only, the restriction and the
+	// exec must happen on the same thread
+	runtime.LockOSThread()
+	log = createLogger()
+}
+
+// Main restricts the wrapper with the ruleset passed by oz-init and then
+// executes the program given as arguments
+func Main() {
+	if len(os.Args) < 2 {
+		log.Fatal("oz-landlock: must specify a command to execute.")
+	}
+	rules := []landlock.Rule{}
+	if err := json.Unmarshal([]byte(os.Getenv(EnvRules)), &rules); err != nil {
+		log.Fatalf("unable to decode landlock rules: %v", err)
+	}
+	os.Unsetenv(EnvRules)
+
+	cmd, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		log.Fatalf("unable to find %s: %v", os.Args[1], err)
+	}
+	if err := landlock.Restrict(rules); err != nil {
+		log.Fatalf("unable to apply landlock rules: %v", err)
+	}
+	if err := syscall.Exec(cmd, os.Args[1:], os.Environ()); err != nil {
+		log.Fatalf("unable to execute %s: %v", cmd, err)
+	}
+}
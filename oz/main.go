@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,8 +9,10 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/oz-daemon"
@@ -76,10 +79,13 @@ func runSandboxed() {
 			}
 		}
 	}
-	if err := daemon.Launch("0", apath, os.Args[1:], false, ephemeral); err != nil {
+	wait := os.Getenv("OZ_WAIT") != ""
+	status, err := daemon.Launch("0", apath, os.Args[1:], false, ephemeral, wait)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "launch command failed: %v.\n", err)
 		os.Exit(1)
 	}
+	os.Exit(status)
 }
 
 func runApplication() {
@@ -91,6 +97,12 @@ func runApplication() {
 	app.Email = "info@subgraph.com"
 	app.Version = oz.OzVersion
 	app.EnableBashCompletion = true
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the output of commands as JSON",
+		},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "profiles",
@@ -108,6 +120,10 @@ func runApplication() {
 				cli.BoolFlag{
 					Name: "ephemeral, e",
 				},
+				cli.BoolFlag{
+					Name:  "wait, w",
+					Usage: "wait for the program to exit and exit with its status",
+				},
 			},
 		},
 		{
@@ -125,6 +141,12 @@ func runApplication() {
 			Usage:  "start a shell in a running sandbox",
 			Action: handleShell,
 		},
+		{
+			Name:            "exec",
+			Usage:           "run a command in a running sandbox: exec <id> -- <command> [args]",
+			Action:          handleExec,
+			SkipFlagParsing: true,
+		},
 		{
 			Name:   "mount",
 			Usage:  "cause a sandbox to mount a file from the host",
@@ -158,6 +180,46 @@ func runApplication() {
 				cli.BoolFlag{
 					Name: "f",
 				},
+				cli.IntFlag{
+					Name:  "sandbox",
+					Usage: "only show the sandbox logs of a sandbox, e.g. 1",
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Usage: "only show the sandbox logs of a profile",
+				},
+				cli.StringFlag{
+					Name:  "level",
+					Usage: "only show the sandbox logs of this level or more severe (ie: warning)",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only show the sandbox logs since a time, in RFC 3339 format or as a duration ago (ie: 1h)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "only show the sandbox logs until a time, in RFC 3339 format or as a duration ago",
+				},
+				cli.BoolFlag{
+					Name:  "recordings",
+					Usage: "list the recorded shell sessions, of a single profile if one is given",
+				},
+				cli.StringFlag{
+					Name:  "export",
+					Usage: "write the recorded shell session <profile>/<file> to the standard output",
+				},
+			},
+		},
+		{
+			Name:   "events",
+			Usage:  "print sandbox events as JSON lines as they happen",
+			Action: handleEvents,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "sandbox",
+					Usage: "Only print events of a sandbox, e.g. 1",
+					Value: -1,
+				},
 			},
 		},
 		{
@@ -202,6 +264,11 @@ func runApplication() {
 			Usage:  "list established proxy circuits",
 			Action: handleListProxies,
 		},
+		{
+			Name:   "reload",
+			Usage:  "reload the oz configuration and profiles",
+			Action: handleReload,
+		},
 	}
 	app.Run(os.Args)
 }
@@ -209,14 +276,46 @@ func runApplication() {
 func handleProfiles(c *cli.Context) {
 	ps, err := daemon.ListProfiles()
 	if err != nil {
+		exitJSONError(c, "Error listing profiles: %v", err)
 		fmt.Printf("Error listing profiles: %v\n", err)
 		os.Exit(1)
 	}
+	if c.GlobalBool("json") {
+		printJSON(ps)
+		return
+	}
 	for i, p := range ps {
 		fmt.Printf("%2d) %-30s %s\n", i+1, p.Name, p.Path)
 	}
 }
 
+// printJSON writes v to stdout, used by the commands when --json is passed.
+// Empty lists are printed as such rather than as null.
+func printJSON(v interface{}) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = reflect.MakeSlice(rv.Type(), 0, 0).Interface()
+	}
+	jdata, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode output: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(jdata))
+}
+
+// exitJSONError prints an error as a JSON object and exits when --json is
+// passed, so that the output of a failed command can still be parsed. It
+// returns otherwise, leaving the command to print the error as text.
+func exitJSONError(c *cli.Context, format string, args ...interface{}) {
+	if !c.GlobalBool("json") {
+		return
+	}
+	printJSON(&struct {
+		Error string `json:"error"`
+	}{fmt.Sprintf(format, args...)})
+	os.Exit(1)
+}
+
 func handleLaunch(c *cli.Context) {
 	noexec := c.Bool("noexec")
 	ephemeral := c.Bool("ephemeral")
@@ -227,19 +326,25 @@ func handleLaunch(c *cli.Context) {
 		fmt.Println("Argument needed to launch command")
 		os.Exit(1)
 	}
-	err := daemon.Launch(c.Args()[0], "", c.Args()[1:], noexec, ephemeral)
+	status, err := daemon.Launch(c.Args()[0], "", c.Args()[1:], noexec, ephemeral, c.Bool("wait"))
 	if err != nil {
 		fmt.Printf("launch command failed: %v\n", err)
 		os.Exit(1)
 	}
+	os.Exit(status)
 }
 
 func handleList(c *cli.Context) {
 	sboxes, err := daemon.ListSandboxes()
 	if err != nil {
+		exitJSONError(c, "Error listing running sandboxes: %v", err)
 		fmt.Printf("Error listing running sandboxes: %v\n", err)
 		os.Exit(1)
 	}
+	if c.GlobalBool("json") {
+		printSandboxesJSON(sboxes, c.Bool("verbose"))
+		return
+	}
 	if len(sboxes) == 0 {
 		fmt.Println("No running sandboxes")
 		return
@@ -249,16 +354,103 @@ func handleList(c *cli.Context) {
 		if sb.Ephemeral {
 			ephemeral = " [ephemeral]"
 		}
-		fmt.Printf("%2d) %s%s\n", sb.Id, sb.Profile, ephemeral)
+		fmt.Printf("%2d) %s (%s)%s\n", sb.Id, sb.Profile, sb.User, ephemeral)
+		if c.Bool("verbose") {
+			printSandboxDetails(sb)
+			printUsage(sb.Id)
+		}
+	}
+}
+
+func printSandboxDetails(sb daemon.SandboxInfo) {
+	if !sb.Started.IsZero() {
+		fmt.Printf("    started: %s\n", sb.Started.Format(time.RFC1123))
+	}
+	if sb.IP != "" {
+		fmt.Printf("    ip: %s\n", sb.IP)
+	}
+	if sb.IPv6 != "" {
+		fmt.Printf("    ipv6: %s\n", sb.IPv6)
+	}
+	if sb.Display != 0 {
+		fmt.Printf("    display: :%d\n", sb.Display)
+	}
+	for _, m := range sb.Mounts {
+		fmt.Printf("    mounted: %s\n", m)
+	}
+	for _, p := range sb.Children {
+		fmt.Printf("    process %d: %s\n", p.Pid, p.Command)
+	}
+}
+
+// printSandboxesJSON prints the sandboxes, along with their resource usage
+// when verbose
+func printSandboxesJSON(sboxes []daemon.SandboxInfo, verbose bool) {
+	if !verbose {
+		printJSON(sboxes)
+		return
+	}
+	type sandboxUsage struct {
+		daemon.SandboxInfo
+		Usage *daemon.ResourceUsage `json:"usage"`
+	}
+	out := []sandboxUsage{}
+	for _, sb := range sboxes {
+		su := sandboxUsage{SandboxInfo: sb}
+		if usage, err := daemon.SandboxUsage(sb.Id); err == nil && len(usage) > 0 {
+			su.Usage = &usage[0]
+		}
+		out = append(out, su)
 	}
+	printJSON(out)
+}
+
+func printUsage(id int) {
+	usage, err := daemon.SandboxUsage(id)
+	if err != nil || len(usage) == 0 {
+		fmt.Printf("    resources: unavailable\n")
+		return
+	}
+	u := usage[0]
+	fmt.Printf("    memory: %s / %s\n", formatBytes(u.MemoryCurrent), formatLimit(u.MemoryMax, formatBytes))
+	fmt.Printf("    cpu: %.2fs\n", float64(u.CPUUsec)/1e6)
+	fmt.Printf("    pids: %d / %s\n", u.PidsCurrent, formatLimit(u.PidsMax, func(n uint64) string {
+		return strconv.FormatUint(n, 10)
+	}))
+	fmt.Printf("    io: %s read, %s written\n", formatBytes(u.IOReadBytes), formatBytes(u.IOWriteBytes))
+}
+
+func formatLimit(n uint64, format func(uint64) string) string {
+	if n == 0 {
+		return "max"
+	}
+	return format(n)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func handleListBridges(c *cli.Context) {
 	bridges, err := daemon.ListBridges()
 	if err != nil {
+		exitJSONError(c, "Error listing configured bridges: %v", err)
 		fmt.Printf("Error listing configured bridges: %v\n", err)
 		os.Exit(1)
 	}
+	if c.GlobalBool("json") {
+		printJSON(bridges)
+		return
+	}
 	fmt.Println(strings.Join(bridges, ","))
 }
 
@@ -350,6 +542,44 @@ func handleShell(c *cli.Context) {
 	fmt.Println("done..")
 }
 
+func handleExec(c *cli.Context) {
+	args := c.Args()
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Sandbox id argument needed\n")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Sandbox id argument must be an integer\n")
+		os.Exit(1)
+	}
+	args = args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Command argument needed\n")
+		os.Exit(1)
+	}
+
+	sb, err := getSandboxById(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving sandbox list: %v\n", err)
+		os.Exit(1)
+	}
+	if sb == nil {
+		fmt.Fprintf(os.Stderr, "No sandbox found with id = %d\n", id)
+		os.Exit(1)
+	}
+
+	status, err := ozinit.Exec(sb.Address, "", args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exec command failed: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(status)
+}
+
 func getSandboxById(id int) (*daemon.SandboxInfo, error) {
 	sboxes, err := daemon.ListSandboxes()
 	if err != nil {
@@ -394,7 +624,27 @@ func handleKill(c *cli.Context) {
 
 }
 func handleLogs(c *cli.Context) {
+	if c.Bool("recordings") {
+		handleListRecordings(c)
+		return
+	}
+	if rec := c.String("export"); rec != "" {
+		handleExportRecording(rec)
+		return
+	}
 	follow := c.Bool("f")
+	filter := &daemon.LogsMsg{
+		Follow:  follow,
+		Sandbox: c.Int("sandbox"),
+		Profile: c.String("profile"),
+		Level:   c.String("level"),
+		Since:   parseLogTime(c, c.String("since")),
+		Until:   parseLogTime(c, c.String("until")),
+	}
+	if filter.Sandbox != 0 || filter.Profile != "" || filter.Level != "" || !filter.Since.IsZero() || !filter.Until.IsZero() {
+		handleLogRecords(c, filter)
+		return
+	}
 	ch, err := daemon.Logs(0, follow)
 	if err != nil {
 		fmt.Println("Logs failed", err)
@@ -405,6 +655,107 @@ func handleLogs(c *cli.Context) {
 	}
 }
 
+// parseLogTime parses a time given to oz logs either in RFC 3339 format or
+// as a duration before now
+func parseLogTime(c *cli.Context, val string) time.Time {
+	if val == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		exitJSONError(c, "Invalid time `%s`, expected RFC 3339 format or a duration", val)
+		fmt.Fprintf(os.Stderr, "Invalid time `%s`, expected RFC 3339 format or a duration\n", val)
+		os.Exit(1)
+	}
+	return time.Now().Add(-d)
+}
+
+func handleLogRecords(c *cli.Context, filter *daemon.LogsMsg) {
+	ch, err := daemon.FilteredLogs(filter)
+	if err != nil {
+		exitJSONError(c, "Logs failed: %v", err)
+		fmt.Fprintf(os.Stderr, "Logs failed: %v\n", err)
+		os.Exit(1)
+	}
+	for rec := range ch {
+		if c.GlobalBool("json") {
+			jdata, err := json.Marshal(rec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to encode log record: %v\n", err)
+				continue
+			}
+			fmt.Println(string(jdata))
+			continue
+		}
+		source := rec.Source
+		if rec.Pid != 0 {
+			source = fmt.Sprintf("%s(%d)", source, rec.Pid)
+		}
+		fmt.Printf("%s %-8s [%d %s] %s: %s\n", rec.Time.Format("2006-01-02 15:04:05"), rec.Level, rec.Sandbox, rec.Profile, source, rec.Message)
+	}
+}
+
+func handleListRecordings(c *cli.Context) {
+	profile := ""
+	if len(c.Args()) > 0 {
+		profile = c.Args()[0]
+	}
+	recs, err := daemon.ListRecordings(profile)
+	if err != nil {
+		exitJSONError(c, "Error listing recordings: %v", err)
+		fmt.Fprintf(os.Stderr, "Error listing recordings: %v\n", err)
+		os.Exit(1)
+	}
+	if c.GlobalBool("json") {
+		printJSON(recs)
+		return
+	}
+	if len(recs) == 0 {
+		fmt.Println("No recordings")
+		return
+	}
+	for _, r := range recs {
+		fmt.Printf("%s/%s\t%d bytes\t%s\n", r.Profile, r.Name, r.Size, r.Time.Format(time.RFC3339))
+	}
+}
+
+func handleExportRecording(rec string) {
+	parts := strings.SplitN(rec, "/", 2)
+	if len(parts) != 2 {
+		fmt.Fprintf(os.Stderr, "Recording must be given as <profile>/<file>\n")
+		os.Exit(1)
+	}
+	f, err := daemon.ExportRecording(parts[0], parts[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting recording: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if _, err := io.Copy(os.Stdout, f); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting recording: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleEvents(c *cli.Context) {
+	ch, err := daemon.Subscribe(c.Int("sandbox"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Subscribing to events failed: %v\n", err)
+		os.Exit(1)
+	}
+	for ev := range ch {
+		jdata, err := json.Marshal(ev)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to encode event: %v\n", err)
+			continue
+		}
+		fmt.Println(string(jdata))
+	}
+}
+
 func handleRelaunchXpraClient(c *cli.Context) {
 	if len(c.Args()) == 0 {
 		fmt.Fprintf(os.Stderr, "Need a sandbox id to relaunch\n")
@@ -452,15 +803,21 @@ func handleForward(c *cli.Context) {
 func handleListForwarders(c *cli.Context) {
 	id := c.Int("sandbox")
 	if id == -1 {
+		exitJSONError(c, "Need a sandbox id to list forwarders")
 		fmt.Fprintf(os.Stderr, "Need a sandbox id to list forwarders\n")
 		os.Exit(1)
 	}
 	forwarders, err := daemon.ListForwarders(id)
 	if err != nil {
+		exitJSONError(c, "List forwarders failed: %v", err)
 		fmt.Fprintf(os.Stderr, "List forwarders failed: %+v %+v", err, forwarders)
 		os.Exit(1)
 	}
 
+	if c.GlobalBool("json") {
+		printJSON(forwarders)
+		return
+	}
 	fmt.Printf("Listeners for sandbox %d:\n", id)
 	for _, r := range forwarders {
 		fmt.Printf("  %s: %s => %s\n", r.Name, r.Desc, r.Target)
@@ -470,13 +827,53 @@ func handleListForwarders(c *cli.Context) {
 func handleListProxies(c *cli.Context) {
 	res, err := daemon.ListProxies()
 	if err != nil {
+		exitJSONError(c, "Error listing established proxies: %v", err)
 		fmt.Printf("Error listing established proxies: %v\n", err)
 		os.Exit(1)
 	}
+	if c.GlobalBool("json") {
+		printJSON(res)
+		return
+	}
 	fmt.Printf("Result: %d entries ...\n", len(res))
 	fmt.Println(strings.Join(res, "\n"))
 }
 
+func handleReload(c *cli.Context) {
+	res, err := daemon.Reload()
+	if err != nil {
+		exitJSONError(c, "Reload command failed: %v", err)
+		fmt.Fprintf(os.Stderr, "Reload command failed: %v\n", err)
+		os.Exit(1)
+	}
+	failed := false
+	if c.GlobalBool("json") {
+		printJSON(res)
+		for _, r := range res {
+			failed = failed || r.Error != ""
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	for _, r := range res {
+		switch {
+		case r.Error == "":
+			fmt.Printf("%s: ok\n", r.File)
+		case r.Kept:
+			failed = true
+			fmt.Printf("%s: kept previous version: %s\n", r.File, r.Error)
+		default:
+			failed = true
+			fmt.Printf("%s: %s\n", r.File, r.Error)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
 
 func checkRecursingSandbox() error {
 	hostname, _ := os.Hostname()
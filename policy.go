@@ -0,0 +1,111 @@
+package oz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Policy controls which users may use the daemon control socket for what.
+type Policy struct {
+	// Users and groups allowed to act on sandboxes they do not own, to
+	// reload the daemon and to read its logs
+	Admins PolicySubjects `json:"admins"`
+	// Rules granting the right to launch profiles, a user may launch a
+	// profile if any of the rules matches both
+	Launch []LaunchRule `json:"launch"`
+}
+
+type PolicySubjects struct {
+	// User names, or "*" for every user
+	Users []string `json:"users"`
+	// Group names, matched against the primary and supplementary groups
+	Groups []string `json:"groups"`
+}
+
+type LaunchRule struct {
+	// Profile names, shell patterns are accepted
+	Profiles []string `json:"profiles"`
+	PolicySubjects
+}
+
+var DefaultPolicyPath = "/etc/oz/policy.json"
+
+func NewDefaultPolicy() *Policy {
+	return &Policy{
+		Admins: PolicySubjects{
+			Users: []string{"root"},
+		},
+		Launch: []LaunchRule{
+			{
+				Profiles:       []string{"*"},
+				PolicySubjects: PolicySubjects{Users: []string{"*"}},
+			},
+		},
+	}
+}
+
+// LoadPolicy reads the policy file at ppath, sections missing from the file
+// keep their default value.
+func LoadPolicy(ppath string) (*Policy, error) {
+	if _, err := os.Stat(ppath); os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := checkConfigPermissions(ppath); err != nil {
+		return nil, err
+	}
+
+	bs, err := ioutil.ReadFile(ppath)
+	if err != nil {
+		return nil, err
+	}
+	p := NewDefaultPolicy()
+	if err := json.Unmarshal(bs, p); err != nil {
+		return nil, err
+	}
+	for i, r := range p.Launch {
+		for _, pattern := range r.Profiles {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("launch.%d: invalid profile pattern `%s`", i, pattern)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Matches returns true if the user or one of the groups is listed.
+func (ps *PolicySubjects) Matches(user string, groups []string) bool {
+	for _, u := range ps.Users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	for _, g := range ps.Groups {
+		for _, ug := range groups {
+			if g == ug {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Policy) IsAdmin(user string, groups []string) bool {
+	return p.Admins.Matches(user, groups)
+}
+
+func (p *Policy) CanLaunch(profile, user string, groups []string) bool {
+	for _, r := range p.Launch {
+		if !r.Matches(user, groups) {
+			continue
+		}
+		for _, pattern := range r.Profiles {
+			if ok, _ := path.Match(pattern, profile); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
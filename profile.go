@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/subgraph/oz/network"
@@ -22,12 +24,22 @@ type Profile struct {
 	Paths []string
 	// Path of the config file
 	ProfilePath string `json:"-"`
+	// Optional base profile this profile inherits from
+	Extends string `json:"extends"`
+	// Optional list of profile fragments merged into this profile
+	Include []string `json:"include"`
+	// Files merged to build this profile, in merge order (base first)
+	Chain []string `json:"-"`
+	// Files each effective setting was taken from, keyed by lowercase setting path
+	Origins map[string][]string `json:"-"`
 	// Default parameters to pass to the program
 	DefaultParams []string `json:"default_params"`
 	// Pass command-line arguments
 	RejectUserArgs bool `json:"reject_user_args"`
 	// Autoshutdown the sandbox when the process exits. One of (no, yes, soft), defaults to yes
 	AutoShutdown ShutdownMode `json:"auto_shutdown"`
+	// Seconds to wait for a new program before shutting down in soft mode, defaults to 30
+	ShutdownGrace uint `json:"shutdown_grace"`
 	// Optional list of executable names to watch for exit in case initial command spawns and exit
 	Watchdog []string
 	// Optional wrapper binary to use when launching command (ex: tsocks)
@@ -36,6 +48,16 @@ type Profile struct {
 	Multi bool
 	// Disable mounting of sys and proc inside the sandbox
 	NoSysProc bool
+	// Capabilities kept in the bounding set of every process of the sandbox, all others are dropped
+	Capabilities []string `json:"capabilities"`
+	// Set no_new_privs on every process of the sandbox, setuid binaries then gain no privileges
+	NoNewPrivs bool `json:"no_new_privs"`
+	// Restrict the filesystem access of the programs to the whitelist with landlock, implies no_new_privs for them
+	Landlock bool `json:"landlock"`
+	// Record the shells entered with oz shell as asciicast files in the log directory
+	RecordShell bool `json:"record_shell"`
+	// Launch the sandbox in a user namespace, root inside the sandbox is then unprivileged on the host
+	UserNamespace bool `json:"user_namespace"`
 	// Disable bind mounting of default directories (etc,usr,bin,lib,lib64)
 	// Also disables default blacklist items (/sbin, /usr/sbin, /usr/bin/sudo)
 	// Normally not used
@@ -43,7 +65,7 @@ type Profile struct {
 	// Allow bind mounting of files passed as arguments inside the sandbox
 	AllowFiles    bool     `json:"allow_files"`
 	AllowedGroups []string `json:"allowed_groups"`
-	// Optional directory where per-process logs will be output
+	// Optional directory where the sandbox logs and shell recordings are written, defaults to a directory named after the profile in the log path
 	LogDir string `json:"log_dir"`
 	// List of paths to bind mount inside jail
 	Whitelist []WhitelistItem
@@ -57,22 +79,28 @@ type Profile struct {
 	Environment []EnvVar
 	// Networking
 	Networking NetworkProfile
-	// Firewall
+	// Firewall rules, matched in order
 	Firewall []FWRule
+	// Policy applied to the traffic matched by no firewall rule
+	FirewallPolicy FWPolicy `json:"firewall_policy"`
 	// Seccomp
 	Seccomp SeccompConf
 	// External Forwarders
 	ExternalForwarders []ExternalForwarder `json:"external_forwarders"`
+	// Resource limits
+	Resources ResourcesConf `json:"resources"`
 }
 
 type ShutdownMode string
 
 const (
-	PROFILE_SHUTDOWN_NO  ShutdownMode = "no"
-	PROFILE_SHUTDOWN_YES ShutdownMode = "yes"
-	//PROFILE_SHUTDOWN_SOFT     ShutdownMode = "soft" // Unimplemented
+	PROFILE_SHUTDOWN_NO   ShutdownMode = "no"
+	PROFILE_SHUTDOWN_YES  ShutdownMode = "yes"
+	PROFILE_SHUTDOWN_SOFT ShutdownMode = "soft"
 )
 
+const DefaultShutdownGrace = 30
+
 type AudioMode string
 
 const (
@@ -95,6 +123,48 @@ type XServerConf struct {
 	Environment         []EnvVar  `json:"env"`
 }
 
+// Weight given by the kernel to cgroups which do not set cpu.weight or io.weight
+const DefaultResourceWeight = 100
+
+// Resource limits applied to the cgroup of the sandbox, zero values mean no limit
+type ResourcesConf struct {
+	// Maximum memory usage in bytes, accepts a K, M or G suffix (ie: 2G)
+	MemoryMax string `json:"memory_max"`
+	// Relative share of CPU time, from 1 to 10000 (kernel default is 100)
+	CPUWeight uint `json:"cpu_weight"`
+	// Maximum CPU time as a percentage of a single CPU (ie: 200 for two CPUs)
+	CPUQuota uint `json:"cpu_quota"`
+	// Maximum number of processes
+	PidsMax uint `json:"pids_max"`
+	// Relative share of disk IO, from 1 to 10000 (kernel default is 100)
+	IOWeight uint `json:"io_weight"`
+}
+
+// ParseMemorySize parses a size in bytes with an optional K, M or G suffix
+func ParseMemorySize(size string) (uint64, error) {
+	if size == "" {
+		return 0, fmt.Errorf("empty memory size")
+	}
+	s := size
+	mult := uint64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size `%s`", size)
+	}
+	return n * mult, nil
+}
+
 type SeccompMode string
 
 const (
@@ -152,11 +222,29 @@ type BlacklistItem struct {
 }
 
 type FWRule struct {
-	Whitelist bool   `json:"whitelist"`
-	DstHost   string `json:"dst_host"`
-	DstPort   int    `json:"dst_port"`
+	Whitelist bool `json:"whitelist"`
+	// Address, CIDR network or host name, any destination if empty
+	DstHost string `json:"dst_host"`
+	// Destination port, or first port of a range ending with DstPortEnd
+	DstPort    int     `json:"dst_port"`
+	DstPortEnd int     `json:"dst_port_end"`
+	Proto      FWProto `json:"proto"`
 }
 
+type FWProto string
+
+const (
+	PROFILE_FIREWALL_PROTO_TCP FWProto = "tcp"
+	PROFILE_FIREWALL_PROTO_UDP FWProto = "udp"
+)
+
+type FWPolicy string
+
+const (
+	PROFILE_FIREWALL_ALLOW FWPolicy = "allow"
+	PROFILE_FIREWALL_DENY  FWPolicy = "deny"
+)
+
 type EnvVar struct {
 	Name  string
 	Value string
@@ -165,9 +253,10 @@ type EnvVar struct {
 type DNSMode string
 
 const (
-	PROFILE_NETWORK_DNS_NONE DNSMode = "none"
-	PROFILE_NETWORK_DNS_PASS DNSMode = "pass"
-	PROFILE_NETWORK_DNS_DHCP DNSMode = "dhcp"
+	PROFILE_NETWORK_DNS_NONE  DNSMode = "none"
+	PROFILE_NETWORK_DNS_PASS  DNSMode = "pass"
+	PROFILE_NETWORK_DNS_DHCP  DNSMode = "dhcp"
+	PROFILE_NETWORK_DNS_PROXY DNSMode = "proxy"
 )
 
 // Sandbox network definition
@@ -189,10 +278,20 @@ type NetworkProfile struct {
 	//  Applies to Nettype: bridge only
 	IpByte uint `json:"ip_byte"`
 
-	// DNS Mode one of: pass, none, dhcp
+	// DNS Mode one of: pass, none, dhcp, proxy
 	//  Applies to Nettype: bridge only
 	DNSMode DNSMode `json:"dns_mode"`
 
+	// Domains the sandbox may resolve, and those it may not, along with
+	// their subdomains
+	//  Applies to DNSMode: proxy only
+	DNSAllow []string `json:"dns_allow"`
+	DNSDeny  []string `json:"dns_deny"`
+
+	// Turn IPv6 off in the network namespace of the sandbox
+	//  Applies to Nettype: bridge and empty only
+	DisableIPv6 bool `json:"disable_ipv6"`
+
 	// Additional data for the hosts file
 	Hosts string
 }
@@ -279,27 +378,71 @@ func LoadProfiles(dir string) (Profiles, error) {
 	return ps, nil
 }
 
+// ProfileLoadResult describes the outcome of loading a single profile file
+type ProfileLoadResult struct {
+	File string
+	Name string
+	Err  error
+	// Kept is set when the file failed to load and the previously
+	// loaded version of the profile was kept in its place
+	Kept bool
+}
+
+// ReloadProfiles loads every profile found in dir. Unlike LoadProfiles it does
+// not give up on the first bad file: a profile that fails to load is replaced
+// by its previous version from the current set, if there is one, and the
+// outcome for each file is returned alongside the new set.
+func ReloadProfiles(dir string, current Profiles) (Profiles, []ProfileLoadResult, error) {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	ps := []*Profile{}
+	results := []ProfileLoadResult{}
+	for _, f := range fs {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		name := path.Join(dir, f.Name())
+		p, err := loadProfileFile(name)
+		if err == nil {
+			ps = append(ps, p)
+			results = append(results, ProfileLoadResult{File: name, Name: p.Name})
+			continue
+		}
+		r := ProfileLoadResult{File: name, Err: err}
+		for _, old := range current {
+			if old.ProfilePath == name {
+				ps = append(ps, old)
+				r.Name = old.Name
+				r.Kept = true
+				break
+			}
+		}
+		results = append(results, r)
+	}
+
+	loadedProfiles = ps
+	return ps, results, nil
+}
+
 var commentRegexp = regexp.MustCompile("^[ \t]*#")
 
 func loadProfileFile(fpath string) (*Profile, error) {
-	if err := checkConfigPermissions(fpath); err != nil {
-		return nil, err
-	}
+	return newProfileLoader().loadProfile(fpath)
+}
 
-	file, err := os.Open(fpath)
+func (pl *profileLoader) loadProfile(fpath string) (*Profile, error) {
+	merged, err := pl.load(fpath)
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(file)
-	bs := ""
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !commentRegexp.MatchString(line) {
-			bs += line + "\n"
-		}
+	bs, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
 	}
 	p := new(Profile)
-	if err := json.Unmarshal([]byte(bs), p); err != nil {
+	if err := json.Unmarshal(bs, p); err != nil {
 		return nil, err
 	}
 	if p.Name == "" {
@@ -317,6 +460,47 @@ func loadProfileFile(fpath string) (*Profile, error) {
 	if p.Networking.IpByte <= 1 || p.Networking.IpByte > 254 {
 		p.Networking.IpByte = 0
 	}
+	if p.FirewallPolicy == "" && len(p.Firewall) == 0 {
+		p.FirewallPolicy = PROFILE_FIREWALL_ALLOW
+	}
 	p.ProfilePath = fpath
+	p.Extends = pl.extends
+	p.Include = pl.includes
+	p.Chain = pl.chain
+	p.Origins = pl.origins
+	if errs := pl.checkFirewall(p); errs.HasErrors() {
+		return nil, errs
+	}
 	return p, nil
 }
+
+// readProfileData reads a profile or fragment file, stripping comment lines
+func readProfileData(fpath string) ([]byte, error) {
+	if err := checkConfigPermissions(fpath); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return stripProfileComments(file)
+}
+
+func stripProfileComments(r io.Reader) ([]byte, error) {
+	scanner := bufio.NewScanner(r)
+	bs := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Comment lines are blanked rather than dropped to keep line numbers intact
+		if commentRegexp.MatchString(line) {
+			line = ""
+		}
+		bs += line + "\n"
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return []byte(bs), nil
+}
@@ -0,0 +1,233 @@
+package oz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Profiles may inherit from a base profile with `"extends": "base"` and pull in
+// shared fragments with `"include": ["fragments/xserver.json", ...]`. References
+// are resolved relative to the directory of the file that contains them, and a
+// `.json` suffix is appended when the bare name does not exist. Fragments are
+// best kept in a subdirectory of the profile directory so they are not loaded
+// as profiles themselves.
+//
+// Layers are merged in order: the base profile first, then each include in the
+// order listed, then the profile itself. Lists are appended, scalars override and
+// objects are merged key by key. The identity of a profile (name, path, paths)
+// is never inherited.
+
+var profileIdentityKeys = []string{"name", "path", "paths"}
+
+const (
+	profileExtendsKey = "extends"
+	profileIncludeKey = "include"
+)
+
+type profileLoader struct {
+	stack    []string                 // files currently being resolved, used to detect cycles
+	chain    []string                 // files merged so far, in merge order
+	origins  map[string][]string      // files each setting was taken from
+	layers   map[string]*profileLayer // raw contents of each file, kept for validation
+	extends  string                   // base declared by the top level profile
+	includes []string                 // fragments declared by the top level profile
+}
+
+func newProfileLoader() *profileLoader {
+	return &profileLoader{
+		origins: make(map[string][]string),
+		layers:  make(map[string]*profileLayer),
+	}
+}
+
+func (pl *profileLoader) load(fpath string) (map[string]interface{}, error) {
+	fpath = path.Clean(fpath)
+	for _, p := range pl.stack {
+		if p == fpath {
+			return nil, fmt.Errorf("include cycle detected: %s", strings.Join(append(pl.stack, fpath), " -> "))
+		}
+	}
+	isTop := len(pl.stack) == 0
+	pl.stack = append(pl.stack, fpath)
+	defer func() { pl.stack = pl.stack[:len(pl.stack)-1] }()
+
+	bs, err := readProfileData(fpath)
+	if err != nil {
+		return nil, err
+	}
+	pf := newProfileLayer(fpath, bs)
+	if errs := pf.checkSchema(); errs.HasErrors() {
+		return nil, errs
+	}
+	pl.layers[fpath] = pf
+
+	layer, err := decodeProfileLayer(fpath, bs)
+	if err != nil {
+		return nil, err
+	}
+	extends, includes, err := takeLayerRefs(layer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	if isTop {
+		pl.extends = extends
+		pl.includes = includes
+	} else {
+		for _, k := range profileIdentityKeys {
+			deleteLayerKey(layer, k)
+		}
+	}
+
+	merged := make(map[string]interface{})
+	dir := path.Dir(fpath)
+	if extends != "" {
+		base, err := pl.load(resolveProfileRef(dir, extends))
+		if err != nil {
+			return nil, err
+		}
+		mergeLayer(merged, base, "", nil)
+	}
+	for _, inc := range includes {
+		frag, err := pl.load(resolveProfileRef(dir, inc))
+		if err != nil {
+			return nil, err
+		}
+		mergeLayer(merged, frag, "", nil)
+	}
+	mergeLayer(merged, layer, "", func(key string, appended bool) {
+		pl.recordOrigin(key, fpath, appended)
+	})
+	pl.chain = append(pl.chain, fpath)
+	return merged, nil
+}
+
+func (pl *profileLoader) recordOrigin(key, fpath string, appended bool) {
+	if !appended {
+		pl.origins[key] = []string{fpath}
+		return
+	}
+	for _, f := range pl.origins[key] {
+		if f == fpath {
+			return
+		}
+	}
+	pl.origins[key] = append(pl.origins[key], fpath)
+}
+
+func decodeProfileLayer(fpath string, bs []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	layer := make(map[string]interface{})
+	if err := dec.Decode(&layer); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	return layer, nil
+}
+
+// takeLayerRefs removes the extends and include keys from a layer and returns their values
+func takeLayerRefs(layer map[string]interface{}) (string, []string, error) {
+	extends := ""
+	includes := []string{}
+	if v, ok := takeLayerKey(layer, profileExtendsKey); ok {
+		s, ok := v.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("`%s` must be a string", profileExtendsKey)
+		}
+		extends = s
+	}
+	if v, ok := takeLayerKey(layer, profileIncludeKey); ok {
+		vs, ok := v.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("`%s` must be a list of strings", profileIncludeKey)
+		}
+		for _, iv := range vs {
+			s, ok := iv.(string)
+			if !ok {
+				return "", nil, fmt.Errorf("`%s` must be a list of strings", profileIncludeKey)
+			}
+			includes = append(includes, s)
+		}
+	}
+	return extends, includes, nil
+}
+
+// resolveProfileRef resolves an extends or include reference relative to dir
+func resolveProfileRef(dir, ref string) string {
+	if !path.IsAbs(ref) {
+		ref = path.Join(dir, ref)
+	}
+	if !strings.HasSuffix(ref, ".json") {
+		if _, err := os.Stat(ref); os.IsNotExist(err) {
+			ref += ".json"
+		}
+	}
+	return ref
+}
+
+// layerKey finds the key in layer matching name, ignoring case as encoding/json does
+func layerKey(layer map[string]interface{}, name string) (string, bool) {
+	if _, ok := layer[name]; ok {
+		return name, true
+	}
+	for k := range layer {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return name, false
+}
+
+func takeLayerKey(layer map[string]interface{}, name string) (interface{}, bool) {
+	k, ok := layerKey(layer, name)
+	if !ok {
+		return nil, false
+	}
+	v := layer[k]
+	delete(layer, k)
+	return v, true
+}
+
+func deleteLayerKey(layer map[string]interface{}, name string) {
+	for {
+		if _, ok := takeLayerKey(layer, name); !ok {
+			return
+		}
+	}
+}
+
+// mergeLayer merges src into dst: lists are appended, objects merged recursively and
+// any other value replaces the one in dst. When record is not nil it is called with
+// the lowercase dotted path of every setting taken from src.
+func mergeLayer(dst, src map[string]interface{}, prefix string, record func(key string, appended bool)) {
+	for k, sv := range src {
+		dk, _ := layerKey(dst, k)
+		key := prefix + strings.ToLower(k)
+		switch svv := sv.(type) {
+		case map[string]interface{}:
+			dm, ok := dst[dk].(map[string]interface{})
+			if !ok {
+				dm = make(map[string]interface{})
+				dst[dk] = dm
+			}
+			mergeLayer(dm, svv, key+".", record)
+			continue
+		case []interface{}:
+			if dl, ok := dst[dk].([]interface{}); ok {
+				dst[dk] = append(append([]interface{}{}, dl...), svv...)
+				if record != nil {
+					record(key, true)
+				}
+				continue
+			}
+		}
+		dst[dk] = sv
+		if record != nil {
+			_, isList := sv.([]interface{})
+			record(key, isList)
+		}
+	}
+}
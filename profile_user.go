@@ -0,0 +1,269 @@
+package oz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/subgraph/oz/network"
+)
+
+// Users may narrow a profile for themselves by placing an override file named
+// after the profile in ~/.config/oz (ie: ~/.config/oz/firefox.json). The file
+// uses the profile syntax and is merged on top of the system profile when the
+// user launches a new sandbox, but it may only make the sandbox more restrictive:
+// read-only whitelist entries, writable entries inside $HOME, extra blacklist
+// entries, and settings that disable features. Whitelist entries of an
+// override are mounted at their own path, they cannot have a target or a
+// symlink.
+
+// UserProfileDir is the directory holding user overrides, relative to $HOME
+const UserProfileDir = ".config/oz"
+
+// UserOverridePath returns the path of the override file for a profile
+func UserOverridePath(home, name string) string {
+	return path.Join(home, UserProfileDir, name+".json")
+}
+
+// ApplyUserOverride merges the override found in home for profile p, if any,
+// and returns the resulting profile. The override file must belong to uid.
+// An error is returned if the override tries to widen the sandbox.
+func ApplyUserOverride(p *Profile, home string, uid uint32) (*Profile, error) {
+	fpath := UserOverridePath(home, p.Name)
+	bs, err := readUserOverride(fpath, uid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+
+	pf := newProfileLayer(fpath, bs)
+	if errs := pf.checkSchema(); errs.HasErrors() {
+		return nil, errs
+	}
+	layer, err := decodeProfileLayer(fpath, bs)
+	if err != nil {
+		return nil, err
+	}
+	o := new(Profile)
+	if err := json.Unmarshal(bs, o); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	if errs := pf.checkUserOverride(layer, o, p, home); len(errs) > 0 {
+		return nil, errs
+	}
+
+	jdata, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := decodeProfileLayer(p.ProfilePath, jdata)
+	if err != nil {
+		return nil, err
+	}
+	origins := make(map[string][]string)
+	for k, v := range p.Origins {
+		origins[k] = v
+	}
+	mergeLayer(merged, layer, "", func(key string, appended bool) {
+		if appended {
+			origins[key] = append(append([]string{}, origins[key]...), fpath)
+		} else {
+			origins[key] = []string{fpath}
+		}
+	})
+	if jdata, err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+	np := new(Profile)
+	if err := json.Unmarshal(jdata, np); err != nil {
+		return nil, err
+	}
+	np.ProfilePath = p.ProfilePath
+	np.Chain = append(append([]string{}, p.Chain...), fpath)
+	np.Origins = origins
+	return np, nil
+}
+
+// readUserOverride reads an override file without following symlinks, making
+// sure it is a regular file owned by uid that nobody else can write to
+func readUserOverride(fpath string, uid uint32) ([]byte, error) {
+	f, err := os.OpenFile(fpath, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("file `%s` is not a regular file", fpath)
+	}
+	if fi.Sys().(*syscall.Stat_t).Uid != uid {
+		return nil, fmt.Errorf("file `%s` is not owned by uid %d", fpath, uid)
+	}
+	if (fi.Mode().Perm() & (syscall.S_IWGRP | syscall.S_IWOTH)) != 0 {
+		return nil, fmt.Errorf("file `%s` is writable by someone else than its owner", fpath)
+	}
+	return stripProfileComments(f)
+}
+
+// checkUserOverride rejects every setting of the override layer that would
+// widen the sandbox built from the system profile p
+func (pf *profileLayer) checkUserOverride(layer map[string]interface{}, o, p *Profile, home string) ProfileErrors {
+	pf.errs = nil
+	keys := []string{}
+	collectLayerKeys(layer, "", &keys)
+	sort.Strings(keys)
+	for _, key := range keys {
+		off := pf.locate(key)
+		switch key {
+		case "whitelist":
+			for i, wl := range o.Whitelist {
+				ikey := fmt.Sprintf("whitelist.%d", i)
+				if wl.AllowSetuid {
+					pf.errorf(pf.locate(ikey+".allow_suid"), "`%s`: setuid binaries cannot be allowed in a user override", ikey)
+				}
+				// Both would place a file the user controls anywhere in
+				// the sandbox, even through symlinks planted in $HOME
+				if wl.Target != "" {
+					pf.errorf(pf.locate(ikey+".target"), "`%s`: `target` cannot be set in a user override", ikey)
+				}
+				if wl.Symlink != "" {
+					pf.errorf(pf.locate(ikey+".symlink"), "`%s`: `symlink` cannot be set in a user override", ikey)
+				}
+				if (!wl.ReadOnly || wl.CanCreate) && !isUnderHome(wl.Path, home) {
+					pf.errorf(pf.locate(ikey), "`%s`: writable paths outside of $HOME must be read_only (%s)", ikey, wl.Path)
+				}
+			}
+		case "blacklist":
+		case "xserver.disable_clipboard", "reject_user_args", "seccomp.enforce", "user_namespace", "no_new_privs", "landlock":
+			if !layerBool(layer, key) {
+				pf.errorf(off, "`%s` can only be set to true in a user override", key)
+			}
+		case "xserver.enable_tray", "xserver.enable_notifications", "allow_files":
+			if layerBool(layer, key) {
+				pf.errorf(off, "`%s` can only be set to false in a user override", key)
+			}
+		case "xserver.audio_mode":
+			am := o.XServer.AudioMode
+			if am != "" && am != PROFILE_AUDIO_NONE && am != p.XServer.AudioMode {
+				pf.errorf(off, "`%s` can only be set to `%s` in a user override", key, PROFILE_AUDIO_NONE)
+			}
+		case "networking.type":
+			nt := o.Networking.Nettype
+			if nt != "" && nt != network.TYPE_NONE && nt != network.TYPE_EMPTY && nt != p.Networking.Nettype {
+				pf.errorf(off, "`%s` can only be set to `%s` or `%s` in a user override", key, network.TYPE_NONE, network.TYPE_EMPTY)
+			}
+		case "resources.memory_max":
+			if !memoryLimitTightens(o.Resources.MemoryMax, p.Resources.MemoryMax) {
+				pf.errorf(off, "`%s` cannot be raised above the limit of the profile in a user override", key)
+			}
+		case "resources.cpu_quota", "resources.pids_max":
+			if !limitTightens(resourceLimit(&o.Resources, key), resourceLimit(&p.Resources, key)) {
+				pf.errorf(off, "`%s` cannot be raised above the limit of the profile in a user override", key)
+			}
+		case "resources.cpu_weight", "resources.io_weight":
+			if !weightTightens(resourceLimit(&o.Resources, key), resourceLimit(&p.Resources, key)) {
+				pf.errorf(off, "`%s` cannot be raised above the weight of the profile in a user override", key)
+			}
+		case "allowed_groups":
+			if len(o.AllowedGroups) > 0 {
+				pf.errorf(off, "`%s` cannot be extended in a user override", key)
+			}
+		case "capabilities":
+			if len(o.Capabilities) > 0 {
+				pf.errorf(off, "`%s` cannot be extended in a user override", key)
+			}
+		default:
+			pf.errorf(off, "`%s` cannot be set in a user override", key)
+		}
+	}
+	return pf.errs
+}
+
+// limitTightens returns true if the limit o is at least as strict as p, where zero means no limit
+func limitTightens(o, p uint64) bool {
+	return o != 0 && (p == 0 || o <= p)
+}
+
+// weightTightens returns true if the weight o is at most p, where zero means
+// the default weight
+func weightTightens(o, p uint64) bool {
+	if p == 0 {
+		p = DefaultResourceWeight
+	}
+	return o != 0 && o <= p
+}
+
+func memoryLimitTightens(o, p string) bool {
+	om, err := ParseMemorySize(o)
+	if err != nil {
+		return false
+	}
+	pm, err := ParseMemorySize(p)
+	if err != nil {
+		pm = 0
+	}
+	return limitTightens(om, pm)
+}
+
+func resourceLimit(r *ResourcesConf, key string) uint64 {
+	switch key {
+	case "resources.cpu_weight":
+		return uint64(r.CPUWeight)
+	case "resources.cpu_quota":
+		return uint64(r.CPUQuota)
+	case "resources.pids_max":
+		return uint64(r.PidsMax)
+	case "resources.io_weight":
+		return uint64(r.IOWeight)
+	}
+	return 0
+}
+
+// collectLayerKeys lists the lowercase dotted paths of every value in layer,
+// treating lists as single values
+func collectLayerKeys(layer map[string]interface{}, prefix string, keys *[]string) {
+	for k, v := range layer {
+		key := prefix + strings.ToLower(k)
+		if m, ok := v.(map[string]interface{}); ok {
+			collectLayerKeys(m, key+".", keys)
+			continue
+		}
+		*keys = append(*keys, key)
+	}
+}
+
+func layerBool(layer map[string]interface{}, key string) bool {
+	var v interface{} = layer
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		mk, _ := layerKey(m, k)
+		v = m[mk]
+	}
+	b, _ := v.(bool)
+	return b
+}
+
+// isUnderHome returns true if p designates home or a path below it
+func isUnderHome(p, home string) bool {
+	if p == "${HOME}" || strings.HasPrefix(p, "${HOME}/") {
+		p = home + strings.TrimPrefix(p, "${HOME}")
+	}
+	if strings.Contains(p, "${") || !path.IsAbs(p) {
+		return false
+	}
+	p = path.Clean(p)
+	home = path.Clean(home)
+	return p == home || strings.HasPrefix(p, home+"/")
+}
@@ -0,0 +1,106 @@
+package oz
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeTestOverride(t *testing.T, home, name, data string) {
+	dir := path.Join(home, UserProfileDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(UserOverridePath(home, name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyUserOverride(t *testing.T) {
+	home, err := ioutil.TempDir("", "oz-override-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	uid := uint32(os.Getuid())
+
+	cases := []struct {
+		override string
+		ok       bool
+	}{
+		{`{"whitelist": [{"path": "${HOME}/Documents", "read_only": true}]}`, true},
+		{`{"whitelist": [{"path": "${HOME}/Downloads"}]}`, true},
+		{`{"whitelist": [{"path": "/usr/share/fonts", "read_only": true}]}`, true},
+		{`{"blacklist": [{"path": "${HOME}/.ssh"}]}`, true},
+		{`{"whitelist": [{"path": "/etc"}]}`, false},
+		{`{"whitelist": [{"path": "${HOME}/x", "allow_suid": true}]}`, false},
+		{`{"whitelist": [{"path": "${HOME}/x", "target": "/etc/passwd", "read_only": true}]}`, false},
+		{`{"whitelist": [{"path": "${HOME}/x", "target": "${HOME}/y", "read_only": true}]}`, false},
+		{`{"whitelist": [{"path": "${HOME}/x", "symlink": "/etc/ld.so.preload", "read_only": true}]}`, false},
+		{`{"capabilities": ["CAP_NET_RAW"]}`, false},
+		{`{"no_new_privs": true}`, true},
+		{`{"no_new_privs": false}`, false},
+	}
+	for _, c := range cases {
+		writeTestOverride(t, home, "test", c.override)
+		p := &Profile{Name: "test", ProfilePath: "/var/lib/oz/cells.d/test.json"}
+		_, err := ApplyUserOverride(p, home, uid)
+		if c.ok && err != nil {
+			t.Errorf("override %s rejected: %v", c.override, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("override %s accepted", c.override)
+		}
+	}
+
+	if err := os.Chmod(UserOverridePath(home, "test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyUserOverride(&Profile{Name: "test"}, home, uid); err == nil {
+		t.Errorf("override writable by others accepted")
+	}
+	if _, err := ApplyUserOverride(&Profile{Name: "missing"}, home, uid); err != nil {
+		t.Errorf("missing override not ignored: %v", err)
+	}
+}
+
+func TestLimitTightens(t *testing.T) {
+	cases := []struct {
+		o, p uint64
+		want bool
+	}{
+		{100, 0, true},
+		{100, 200, true},
+		{200, 200, true},
+		{300, 200, false},
+		{0, 200, false},
+		{0, 0, false},
+	}
+	for _, c := range cases {
+		if got := limitTightens(c.o, c.p); got != c.want {
+			t.Errorf("limitTightens(%d, %d) = %v, expected %v", c.o, c.p, got, c.want)
+		}
+	}
+	if !memoryLimitTightens("512M", "1G") || memoryLimitTightens("2G", "1G") || memoryLimitTightens("lots", "") {
+		t.Errorf("memoryLimitTightens() does not compare parsed sizes")
+	}
+}
+
+func TestWeightTightens(t *testing.T) {
+	cases := []struct {
+		o, p uint64
+		want bool
+	}{
+		{50, 0, true},
+		{DefaultResourceWeight, 0, true},
+		{DefaultResourceWeight + 1, 0, false},
+		{50, 20, false},
+		{20, 50, true},
+		{0, 50, false},
+	}
+	for _, c := range cases {
+		if got := weightTightens(c.o, c.p); got != c.want {
+			t.Errorf("weightTightens(%d, %d) = %v, expected %v", c.o, c.p, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package oz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/oz/network"
+)
+
+// ProfileError describes a problem found in a profile file. Line and Column
+// are 1-based and are zero when the problem cannot be tied to a location.
+type ProfileError struct {
+	File    string
+	Line    int
+	Column  int
+	Msg     string
+	Warning bool
+}
+
+func (pe *ProfileError) Error() string {
+	loc := pe.File
+	if pe.Line > 0 {
+		loc = fmt.Sprintf("%s:%d:%d", pe.File, pe.Line, pe.Column)
+	}
+	if pe.Warning {
+		return fmt.Sprintf("%s: warning: %s", loc, pe.Msg)
+	}
+	return fmt.Sprintf("%s: %s", loc, pe.Msg)
+}
+
+type ProfileErrors []*ProfileError
+
+func (pes ProfileErrors) Error() string {
+	msgs := []string{}
+	for _, pe := range pes {
+		msgs = append(msgs, pe.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// HasErrors returns true if any of the problems is not a warning
+func (pes ProfileErrors) HasErrors() bool {
+	for _, pe := range pes {
+		if !pe.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed values of the enumerated string types used in profiles.
+// An empty string is always accepted and selects the default.
+var profileEnums = map[reflect.Type][]string{
+	reflect.TypeOf(PROFILE_SHUTDOWN_NO): {
+		string(PROFILE_SHUTDOWN_NO), string(PROFILE_SHUTDOWN_YES),
+		string(PROFILE_SHUTDOWN_SOFT),
+	},
+	reflect.TypeOf(PROFILE_AUDIO_NONE): {
+		string(PROFILE_AUDIO_NONE), string(PROFILE_AUDIO_SPEAKER),
+		string(PROFILE_AUDIO_FULL), string(PROFILE_AUDIO_PULSE),
+	},
+	reflect.TypeOf(PROFILE_SECCOMP_TRAIN): {
+		string(PROFILE_SECCOMP_TRAIN), string(PROFILE_SECCOMP_WHITELIST),
+		string(PROFILE_SECCOMP_BLACKLIST), string(PROFILE_SECCOMP_DISABLED),
+	},
+	reflect.TypeOf(PROFILE_NETWORK_DNS_NONE): {
+		string(PROFILE_NETWORK_DNS_NONE), string(PROFILE_NETWORK_DNS_PASS),
+		string(PROFILE_NETWORK_DNS_DHCP), string(PROFILE_NETWORK_DNS_PROXY),
+	},
+	reflect.TypeOf(PROFILE_FIREWALL_PROTO_TCP): {
+		string(PROFILE_FIREWALL_PROTO_TCP), string(PROFILE_FIREWALL_PROTO_UDP),
+	},
+	reflect.TypeOf(PROFILE_FIREWALL_ALLOW): {
+		string(PROFILE_FIREWALL_ALLOW), string(PROFILE_FIREWALL_DENY),
+	},
+	reflect.TypeOf(network.TYPE_NONE): {
+		string(network.TYPE_NONE), string(network.TYPE_HOST),
+		string(network.TYPE_EMPTY), string(network.TYPE_BRIDGE),
+	},
+	reflect.TypeOf(network.PROXY_CLIENT): {
+		string(network.PROXY_CLIENT), string(network.PROXY_SERVER),
+	},
+	reflect.TypeOf(network.PROTO_TCP): {
+		string(network.PROTO_TCP), string(network.PROTO_UDP),
+		string(network.PROTO_UNIX), string(network.PROTO_TCP_TO_UNIX),
+		string(network.PROTO_UNIXGRAM), string(network.PROTO_UNIXPACKET),
+	},
+}
+
+var profileType = reflect.TypeOf(Profile{})
+
+// profileLayer holds the raw contents of a single profile or fragment file
+// along with the offset of every key found in it. Keys are lowercase dotted
+// paths, with list elements addressed by index (ie: whitelist.2.path).
+type profileLayer struct {
+	file      string
+	data      []byte
+	positions map[string]int
+	errs      ProfileErrors
+}
+
+func newProfileLayer(fpath string, data []byte) *profileLayer {
+	return &profileLayer{
+		file:      fpath,
+		data:      data,
+		positions: make(map[string]int),
+	}
+}
+
+func (pf *profileLayer) lineCol(offset int) (int, int) {
+	if offset > len(pf.data) {
+		offset = len(pf.data)
+	}
+	line := 1 + bytes.Count(pf.data[:offset], []byte("\n"))
+	col := offset - bytes.LastIndex(pf.data[:offset], []byte("\n"))
+	return line, col
+}
+
+func (pf *profileLayer) report(offset int, warning bool, format string, args ...interface{}) {
+	pe := &ProfileError{File: pf.file, Msg: fmt.Sprintf(format, args...), Warning: warning}
+	if offset >= 0 {
+		pe.Line, pe.Column = pf.lineCol(offset)
+	}
+	pf.errs = append(pf.errs, pe)
+}
+
+func (pf *profileLayer) errorf(offset int, format string, args ...interface{}) {
+	pf.report(offset, false, format, args...)
+}
+
+func (pf *profileLayer) warningf(offset int, format string, args ...interface{}) {
+	pf.report(offset, true, format, args...)
+}
+
+// locate returns the offset of key, or of its closest recorded parent
+func (pf *profileLayer) locate(key string) int {
+	for key != "" {
+		if off, ok := pf.positions[key]; ok {
+			return off
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return -1
+}
+
+// checkSchema verifies that the file is valid JSON, that it only uses keys
+// known to the Profile structure, and that every value has the expected type
+func (pf *profileLayer) checkSchema() ProfileErrors {
+	var v interface{}
+	if err := json.Unmarshal(pf.data, &v); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			pf.errorf(int(se.Offset), "%v", se)
+		} else {
+			pf.errorf(-1, "%v", err)
+		}
+		return pf.errs
+	}
+	trimmed := bytes.TrimLeft(pf.data, " \t\r\n")
+	pf.walk(bytes.TrimSpace(trimmed), len(pf.data)-len(trimmed), profileType, "")
+	return pf.errs
+}
+
+func (pf *profileLayer) walk(raw []byte, offset int, t reflect.Type, key string) {
+	if string(raw) == "null" {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := key
+	if name == "" {
+		name = "profile"
+	}
+	if allowed, ok := profileEnums[t]; ok {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			pf.errorf(offset, "`%s` must be a string", name)
+			return
+		}
+		if s != "" && !containsString(allowed, s) {
+			pf.errorf(offset, "invalid value %q for `%s`, expecting one of: %s", s, name, strings.Join(allowed, ", "))
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := jsonFields(t)
+		pf.walkObject(raw, offset, key, func(k string) (reflect.Type, bool) {
+			ft, ok := fields[strings.ToLower(k)]
+			return ft, ok
+		})
+	case reflect.Map:
+		pf.walkObject(raw, offset, key, func(k string) (reflect.Type, bool) {
+			return t.Elem(), true
+		})
+	case reflect.Slice, reflect.Array:
+		pf.walkArray(raw, offset, key, t.Elem())
+	case reflect.String:
+		if raw[0] != '"' {
+			pf.errorf(offset, "`%s` must be a string", name)
+		}
+	case reflect.Bool:
+		if string(raw) != "true" && string(raw) != "false" {
+			pf.errorf(offset, "`%s` must be true or false", name)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(string(raw), 10, t.Bits()); err != nil {
+			pf.errorf(offset, "`%s` must be an integer", name)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(string(raw), 10, t.Bits()); err != nil {
+			pf.errorf(offset, "`%s` must be a positive integer", name)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(string(raw), t.Bits()); err != nil {
+			pf.errorf(offset, "`%s` must be a number", name)
+		}
+	}
+}
+
+func (pf *profileLayer) walkObject(raw []byte, offset int, key string, lookup func(string) (reflect.Type, bool)) {
+	if raw[0] != '{' {
+		pf.errorf(offset, "`%s` must be an object", key)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.Token()
+	for dec.More() {
+		prev := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			pf.errorf(offset+prev, "%v", err)
+			return
+		}
+		k, _ := tok.(string)
+		kstart := offset + prev + bytes.IndexByte(raw[prev:], '"')
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			pf.errorf(kstart, "%v", err)
+			return
+		}
+		vstart := offset + int(dec.InputOffset()) - len(val)
+		ckey := strings.ToLower(k)
+		if key != "" {
+			ckey = key + "." + ckey
+		}
+		if _, seen := pf.positions[ckey]; !seen {
+			pf.positions[ckey] = kstart
+		}
+		ft, ok := lookup(k)
+		if !ok {
+			pf.errorf(kstart, "unknown key `%s`", ckey)
+			continue
+		}
+		pf.walk(val, vstart, ft, ckey)
+	}
+}
+
+func (pf *profileLayer) walkArray(raw []byte, offset int, key string, et reflect.Type) {
+	if raw[0] != '[' {
+		pf.errorf(offset, "`%s` must be a list", key)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.Token()
+	for i := 0; dec.More(); i++ {
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			pf.errorf(offset+int(dec.InputOffset()), "%v", err)
+			return
+		}
+		vstart := offset + int(dec.InputOffset()) - len(val)
+		ckey := key + "." + strconv.Itoa(i)
+		pf.positions[ckey] = vstart
+		pf.walk(val, vstart, et, ckey)
+	}
+}
+
+// jsonFields maps the lowercase JSON name of each field of t to its type,
+// following the naming rules of encoding/json
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, ft := range jsonFields(f.Type) {
+				fields[k] = ft
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+var pathVarRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+var xdgVarNameRegexp = regexp.MustCompile(`^XDG_[A-Z0-9_-]+_DIR$`)
+
+var knownPathVars = []string{"HOME", "UID", "USER", "DISPLAY", "SANDBOXNAME"}
+
+// checkPath verifies that the variables used in p are known and that p is
+// absolute once resolved. It returns true if p contains variables or globs.
+func (pf *profileLayer) checkPath(p, key string) bool {
+	off := pf.locate(key)
+	vars := pathVarRegexp.FindAllStringSubmatchIndex(p, -1)
+	for _, m := range vars {
+		name := p[m[2]:m[3]]
+		switch {
+		case name == "PATH":
+			if m[0] != 0 || !strings.HasPrefix(p, "${PATH}/") {
+				pf.errorf(off, "`%s`: ${PATH} may only be used as a prefix (%s)", key, p)
+			} else if _, err := exec.LookPath(p[len("${PATH}/"):]); err != nil {
+				pf.warningf(off, "`%s`: %s not found in PATH", key, p[len("${PATH}/"):])
+			}
+		case containsString(knownPathVars, name), xdgVarNameRegexp.MatchString(name):
+		default:
+			pf.errorf(off, "`%s`: unknown variable ${%s} in %s", key, name, p)
+		}
+	}
+	if len(vars) == 0 && !path.IsAbs(p) {
+		pf.errorf(off, "`%s`: path must be absolute (%s)", key, p)
+	}
+	return len(vars) > 0 || strings.Contains(p, "*")
+}
+
+func (pf *profileLayer) checkPathExists(p, key string, warning bool) {
+	if p == "" {
+		return
+	}
+	if pf.checkPath(p, key) || !path.IsAbs(p) {
+		return
+	}
+	if _, err := os.Lstat(p); err != nil {
+		pf.report(pf.locate(key), warning, "`%s`: %v", key, err)
+	}
+}
+
+// checkValues validates the settings defined in this file alone
+func (pf *profileLayer) checkValues() ProfileErrors {
+	pf.errs = nil
+	p := new(Profile)
+	if err := json.Unmarshal(pf.data, p); err != nil {
+		pf.errorf(-1, "%v", err)
+		return pf.errs
+	}
+	pf.checkPathExists(p.Path, "path", true)
+	for i, pp := range p.Paths {
+		pf.checkPathExists(pp, fmt.Sprintf("paths.%d", i), true)
+	}
+	for i, wl := range p.Whitelist {
+		key := fmt.Sprintf("whitelist.%d", i)
+		if wl.Path == "" {
+			pf.errorf(pf.locate(key), "`%s`: missing path", key)
+		} else if wl.Ignore || wl.CanCreate {
+			pf.checkPath(wl.Path, key+".path")
+		} else {
+			pf.checkPathExists(wl.Path, key+".path", true)
+		}
+		if wl.Target != "" {
+			pf.checkPath(wl.Target, key+".target")
+		}
+		if wl.Symlink != "" {
+			pf.checkPath(wl.Symlink, key+".symlink")
+		}
+	}
+	for i, bl := range p.Blacklist {
+		key := fmt.Sprintf("blacklist.%d", i)
+		if bl.Path == "" {
+			pf.errorf(pf.locate(key), "`%s`: missing path", key)
+			continue
+		}
+		pf.checkPath(bl.Path, key+".path")
+	}
+	for i, sf := range p.SharedFolders {
+		pf.checkPath(sf, fmt.Sprintf("shared_folders.%d", i))
+	}
+	if p.Resources.MemoryMax != "" {
+		if _, err := ParseMemorySize(p.Resources.MemoryMax); err != nil {
+			pf.errorf(pf.locate("resources.memory_max"), "`resources.memory_max`: %v", err)
+		}
+	}
+	if p.Resources.CPUWeight > 10000 {
+		pf.errorf(pf.locate("resources.cpu_weight"), "`resources.cpu_weight` must be between 1 and 10000")
+	}
+	if p.Resources.IOWeight > 10000 {
+		pf.errorf(pf.locate("resources.io_weight"), "`resources.io_weight` must be between 1 and 10000")
+	}
+	for i, c := range p.Capabilities {
+		if _, ok := CapabilityNumber(c); !ok {
+			key := fmt.Sprintf("capabilities.%d", i)
+			pf.errorf(pf.locate(key), "`%s`: unknown capability `%s`", key, c)
+		}
+	}
+	pf.checkPathExists(p.Seccomp.Whitelist, "seccomp.whitelist", false)
+	pf.checkPathExists(p.Seccomp.Blacklist, "seccomp.blacklist", false)
+	for i, ed := range p.Seccomp.ExtraDefs {
+		pf.checkPathExists(ed, fmt.Sprintf("seccomp.extradefs.%d", i), false)
+	}
+	return pf.errs
+}
+
+// originLayer returns the layer the effective value of key was taken from
+func (pl *profileLoader) originLayer(p *Profile, key string) *profileLayer {
+	files := p.Origins[key]
+	if len(files) > 0 {
+		if pf := pl.layers[files[len(files)-1]]; pf != nil {
+			return pf
+		}
+	}
+	return pl.layers[path.Clean(p.ProfilePath)]
+}
+
+// checkFirewall validates the firewall rules of every file of the loaded
+// profile, reporting errors at the position of the rule in the file defining
+// it, and that a policy is set along with them. It is run whenever a profile
+// is loaded, so that a profile with rules which cannot be applied is never
+// launched.
+func (pl *profileLoader) checkFirewall(p *Profile) ProfileErrors {
+	errs := ProfileErrors{}
+	for _, f := range pl.chain {
+		if pf := pl.layers[f]; pf != nil {
+			errs = append(errs, pf.checkFirewall()...)
+		}
+	}
+	if len(p.Firewall) > 0 && p.FirewallPolicy == "" {
+		// The traffic matched by no rule is not guessed from the rules
+		pf := pl.originLayer(p, "firewall")
+		pf.errs = nil
+		pf.errorf(pf.locate("firewall"), "`firewall_policy` must be set to `allow` or `deny` along with `firewall`")
+		errs = append(errs, pf.errs...)
+	}
+	return errs
+}
+
+func (pf *profileLayer) checkFirewall() ProfileErrors {
+	pf.errs = nil
+	var l struct {
+		Firewall []FWRule `json:"firewall"`
+	}
+	if err := json.Unmarshal(pf.data, &l); err != nil {
+		pf.errorf(-1, "%v", err)
+		return pf.errs
+	}
+	for i, r := range l.Firewall {
+		key := fmt.Sprintf("firewall.%d", i)
+		if err := network.ValidFirewallHost(r.DstHost); err != nil {
+			pf.errorf(pf.locate(key+".dst_host"), "`%s.dst_host`: %v", key, err)
+		}
+		if r.DstPort < 0 || r.DstPort > 65535 {
+			pf.errorf(pf.locate(key+".dst_port"), "`%s.dst_port` must be between 1 and 65535, or 0 for any port", key)
+		}
+		if r.DstPortEnd != 0 {
+			if r.DstPort == 0 {
+				pf.errorf(pf.locate(key+".dst_port_end"), "`%s.dst_port_end` requires `dst_port`", key)
+			} else if r.DstPortEnd < r.DstPort || r.DstPortEnd > 65535 {
+				pf.errorf(pf.locate(key+".dst_port_end"), "`%s.dst_port_end` must be between `dst_port` and 65535", key)
+			}
+		}
+	}
+	return pf.errs
+}
+
+// checkMerged validates settings that depend on several fields of the
+// resolved profile, which may have been defined in different files
+func (pl *profileLoader) checkMerged(p *Profile, c *Config) ProfileErrors {
+	pf := pl.originLayer(p, "seccomp.mode")
+	pf.errs = nil
+	off := pf.locate("seccomp.mode")
+	switch p.Seccomp.Mode {
+	case PROFILE_SECCOMP_WHITELIST:
+		if p.Seccomp.Whitelist == "" {
+			pf.errorf(off, "seccomp mode is whitelist but no whitelist policy file is set")
+		}
+	case PROFILE_SECCOMP_BLACKLIST:
+		if p.Seccomp.Blacklist == "" {
+			policy := path.Join(c.EtcPrefix, "blacklist-generic.seccomp")
+			if _, err := os.Stat(policy); err != nil {
+				pf.errorf(off, "default seccomp blacklist policy: %v", err)
+			}
+		}
+	case PROFILE_SECCOMP_TRAIN:
+		policy := path.Join(c.EtcPrefix, "training-generic.seccomp")
+		if _, err := os.Stat(policy); err != nil {
+			pf.errorf(off, "seccomp training policy: %v", err)
+		}
+	}
+	errs := pf.errs
+
+	if p.UserNamespace || c.UserNamespaces {
+		pf = pl.originLayer(p, "user_namespace")
+		pf.errs = nil
+		off = pf.locate("user_namespace")
+		if c.UseFullDev {
+			pf.errorf(off, "user namespaces cannot be used together with use_full_dev")
+		}
+		if p.Networking.Nettype == network.TYPE_HOST && !p.NoSysProc {
+			pf.warningf(off, "/sys cannot be mounted in a user namespace with host networking and will be empty")
+		}
+		errs = append(errs, pf.errs...)
+	}
+
+	if p.Networking.DNSMode != "" && p.Networking.Nettype != network.TYPE_BRIDGE {
+		pf = pl.originLayer(p, "networking.dns_mode")
+		pf.errs = nil
+		pf.warningf(pf.locate("networking.dns_mode"), "`networking.dns_mode` only applies to bridge networking")
+		errs = append(errs, pf.errs...)
+	}
+	if (len(p.Networking.DNSAllow) > 0 || len(p.Networking.DNSDeny) > 0) && p.Networking.DNSMode != PROFILE_NETWORK_DNS_PROXY {
+		pf = pl.originLayer(p, "networking.dns_mode")
+		pf.errs = nil
+		pf.warningf(pf.locate("networking.dns_mode"), "`networking.dns_allow` and `networking.dns_deny` only apply to the proxy dns mode")
+		errs = append(errs, pf.errs...)
+	}
+	if (len(p.Firewall) > 0 || p.FirewallPolicy == PROFILE_FIREWALL_DENY) && p.Networking.Nettype != network.TYPE_BRIDGE {
+		pf = pl.originLayer(p, "firewall")
+		pf.errs = nil
+		pf.warningf(pf.locate("firewall"), "`firewall` and `firewall_policy` only apply to bridge networking")
+		errs = append(errs, pf.errs...)
+	}
+	if p.Networking.DisableIPv6 && (p.Networking.Nettype == network.TYPE_HOST || p.Networking.Nettype == network.TYPE_NONE) {
+		pf = pl.originLayer(p, "networking.disable_ipv6")
+		pf.errs = nil
+		pf.warningf(pf.locate("networking.disable_ipv6"), "`networking.disable_ipv6` only applies to bridge and empty networking")
+		errs = append(errs, pf.errs...)
+	}
+	return errs
+}
+
+// ValidateProfileFile loads a profile and reports every problem found in it
+// and in the files it extends or includes
+func ValidateProfileFile(fpath string, c *Config) ProfileErrors {
+	pl := newProfileLoader()
+	p, err := pl.loadProfile(fpath)
+	if err != nil {
+		if pes, ok := err.(ProfileErrors); ok {
+			return pes
+		}
+		return ProfileErrors{{File: fpath, Msg: err.Error()}}
+	}
+	pes := ProfileErrors{}
+	for _, f := range pl.chain {
+		pes = append(pes, pl.layers[f].checkValues()...)
+	}
+	return append(pes, pl.checkMerged(p, c)...)
+}
+
+// ValidateProfiles runs ValidateProfileFile on every profile found in dir
+func ValidateProfiles(dir string, c *Config) (ProfileErrors, error) {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pes := ProfileErrors{}
+	seen := make(map[string]bool)
+	for _, f := range fs {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		// Problems in shared base profiles and fragments are only reported once
+		for _, pe := range ValidateProfileFile(path.Join(dir, f.Name()), c) {
+			if !seen[pe.Error()] {
+				seen[pe.Error()] = true
+				pes = append(pes, pe)
+			}
+		}
+	}
+	return pes, nil
+}